@@ -0,0 +1,33 @@
+package webdial
+
+import (
+	"errors"
+	"net/http"
+)
+
+// WithAuth authenticates every request before it reaches a conn: fn runs
+// before a WebSocket upgrade or event stream starts and before each SSE
+// POST is accepted. A non-nil error rejects the request with 403
+// Forbidden, or 401 Unauthorized if it matches ErrUnauthorized. The
+// identity fn returns for a handshake is available from
+// ServerConn.Identity.
+func WithAuth(fn func(*http.Request) (identity any, err error)) ServerOption {
+	return func(s *Server) { s.auth = fn }
+}
+
+// authenticate runs the auth hook, writing the rejection if it fails.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (any, bool) {
+	if s.auth == nil {
+		return nil, true
+	}
+	identity, err := s.auth(r)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, ErrUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		s.reject(w, r, status, err.Error(), "")
+		return nil, false
+	}
+	return identity, true
+}
@@ -0,0 +1,53 @@
+package webdial
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// WithSessionBinding rejects SSE POSTs with 403 Forbidden unless key
+// returns the same value for them as it did for the request that opened
+// their session, so one client can't inject data into another's stream.
+// identity is what the WithAuth function returned for the request. See
+// BindIdentity, BindClientCert and BindAuthorization.
+func WithSessionBinding(key func(r *http.Request, identity any) string) ServerOption {
+	return func(s *Server) { s.binding = key }
+}
+
+// BindIdentity binds sessions to the WithAuth identity, in its %v form.
+func BindIdentity(_ *http.Request, identity any) string {
+	if identity == nil {
+		return ""
+	}
+	return fmt.Sprint(identity)
+}
+
+// BindClientCert binds sessions to the client's TLS certificate.
+func BindClientCert(r *http.Request, _ any) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// BindAuthorization binds sessions to the client's Authorization header.
+func BindAuthorization(r *http.Request, _ any) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:])
+}
+
+// samePoster reports whether r, from identity, may post to sess.
+func (s *Server) samePoster(sess Session, r *http.Request, identity any) bool {
+	if s.binding == nil {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(sess.Binding()), []byte(s.binding(r, identity))) == 1
+}
@@ -0,0 +1,43 @@
+package webdial
+
+import "sync"
+
+// Broadcast writes b to every conn the application has accepted, and
+// returns how many writes succeeded. See BroadcastFunc.
+func (s *Server) Broadcast(b []byte) int {
+	return s.BroadcastFunc(b, nil)
+}
+
+// BroadcastFunc writes b to every accepted conn for which match returns
+// true, or all of them if match is nil, and returns how many writes
+// succeeded. Conns are written concurrently, so a slow client only holds
+// up the return. Conns still waiting for Accept, and those the server
+// handles itself (listeners, rendezvous and forwarded conns), are
+// skipped. Each b is one Write, so it suits whole messages; don't let the
+// application write to the same conns at the same time.
+func (s *Server) BroadcastFunc(b []byte, match func(*ServerConn) bool) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sent int
+	for conn := range s.Conns() {
+		if conn.internal.Load() || conn.State().Phase != PhaseEstablished {
+			continue
+		}
+		if match != nil && !match(conn) {
+			continue
+		}
+		wg.Go(func() {
+			_, err := conn.Write(b)
+			if err == nil {
+				err = conn.Flush()
+			}
+			if err == nil {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return sent
+}
@@ -0,0 +1,68 @@
+package webdial
+
+import (
+	"bufio"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer returned to bufPool, so a rare
+// huge frame isn't kept around.
+const maxPooledBuffer = defaultMaxFrameSize
+
+// bufPool recycles the read paths' buffers, which at high throughput
+// would otherwise be most of the allocations.
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 32<<10)
+		return &b
+	},
+}
+
+// getBuffer returns a pooled buffer of length n.
+func getBuffer(n int) *[]byte {
+	bp := bufPool.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
+// putBuffer returns bp to the pool. It must not be used afterwards.
+func putBuffer(bp *[]byte) {
+	if cap(*bp) <= maxPooledBuffer {
+		bufPool.Put(bp)
+	}
+}
+
+// writeBuffer holds small writes back until it fills or is flushed, so
+// each doesn't become its own WebSocket message or POST. Writes at least
+// as large as the buffer go straight through once it is empty.
+type writeBuffer struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func newWriteBuffer(write func([]byte) (int, error), size int) *writeBuffer {
+	return &writeBuffer{w: bufio.NewWriterSize(writerFunc(write), size)}
+}
+
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Write(p)
+}
+
+func (b *writeBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.w.Flush()
+}
+
+type writerFunc func([]byte) (int, error)
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) { return f(b) }
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
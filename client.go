@@ -1,62 +1,1094 @@
 package webdial
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/eventsource"
 )
 
-func Dial(ctx context.Context, baseURL string) (net.Conn, error) {
-	baseURL = strings.TrimRight(baseURL, "/")
-	conn, err := dialWS(ctx, baseURL)
-	if err == nil {
-		return conn, nil
+// Dialer contains options for connecting to a webdial server.
+// The zero value dials with default settings.
+type Dialer struct {
+	// HTTPClient is used for the SSE stream and POST writes.
+	// Nil means a client using TLSConfig.
+	HTTPClient *http.Client
+	// WSDialer is used for WebSocket connections. TLSConfig and
+	// HandshakeTimeout override its settings when set.
+	// Nil means a zero websocket.Dialer.
+	WSDialer *websocket.Dialer
+	// Header is sent with every request made by both transports.
+	Header http.Header
+	// TLSConfig is used for https and wss connections.
+	// Nil means the default configuration.
+	TLSConfig *tls.Config
+	// Transport forces "ws" or "sse". Empty means try WebSocket first and
+	// fall back to SSE+POST.
+	Transport string
+	// HandshakeTimeout bounds each transport's handshake: the WebSocket
+	// upgrade, or the SSE request until the session ID arrives.
+	// Zero means no timeout.
+	HandshakeTimeout time.Duration
+	// PostTimeout bounds each POST made by the SSE transport.
+	// Zero means no timeout.
+	PostTimeout time.Duration
+	// CloseOnCancel ties the conn to the dial context: cancelling it
+	// closes the conn and aborts in-flight POSTs. By default the context
+	// only bounds the handshake.
+	CloseOnCancel bool
+	// Jar stores cookies set by the server, such as load balancer affinity
+	// cookies, and replays them on later requests. Nil means each conn
+	// gets its own in-memory jar.
+	Jar http.CookieJar
+	// Proxy returns the proxy to use for a request, as in http.Transport.
+	// Nil means http.ProxyFromEnvironment (HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY).
+	Proxy func(*http.Request) (*url.URL, error)
+	// Reconnect configures the backoff and write buffering of conns
+	// returned by DialReliable.
+	Reconnect ReconnectPolicy
+	// KeepAlive is the interval between client pings on WebSocket conns.
+	// Zero means the client doesn't ping, relying on the server's pings.
+	KeepAlive time.Duration
+	// KeepAliveTimeout closes a WebSocket conn when no pong has arrived
+	// within this long of a ping. Pongs are only seen while the conn is
+	// being read. Zero means no timeout.
+	KeepAliveTimeout time.Duration
+	// RateLimit caps reads and writes to this many bytes per second in
+	// each direction. Zero means unlimited.
+	RateLimit int
+	// LocalAddr is the local address to dial from, as in net.Dialer, for
+	// multi-homed hosts. Nil picks one automatically. Like Network, it
+	// doesn't apply to HTTPClient or to a WSDialer with its own NetDial.
+	LocalAddr net.Addr
+	// Network restricts dialing to "tcp4" or "tcp6". Empty means "tcp".
+	Network string
+	// Target names the backend the server should connect the conn to,
+	// see TargetOf. Empty means the server's default.
+	Target string
+	// Metadata is sent with the handshake for the server to read with
+	// MetadataOf, e.g. an agent ID or labels.
+	Metadata map[string]string
+	// ListenName is the name Listen registers the client under, for the
+	// server's DialClient.
+	ListenName string
+	// Tags label the conn for the server's AcceptMatch, see WithTags.
+	Tags []string
+	// Room pairs the conn with another client dialing the same room on a
+	// WithRendezvous server, see WithRoom.
+	Room string
+	// Host overrides the Host header of every request, for ingresses that
+	// route on a different name than the one dialed.
+	Host string
+	// HTTP2 makes the SSE transport speak only HTTP/2, including over
+	// plaintext (h2c), so the stream and every POST share one connection.
+	// It doesn't apply to HTTPClient, or to WebSocket, which needs HTTP/1.1.
+	HTTP2 bool
+	// CoalesceDelay makes SSE writes wait up to this long to be batched
+	// with later writes into one POST, as Nagle's algorithm does for TCP.
+	// Zero means every Write is its own POST.
+	CoalesceDelay time.Duration
+	// CoalesceSize sends batched writes as soon as this many bytes are
+	// queued. Zero means only CoalesceDelay applies.
+	CoalesceSize int
+	// AsyncWrites lets SSE writes return before their POST completes, with
+	// up to this many POSTs in flight. They carry sequence numbers so the
+	// server delivers them in order. Zero means each Write waits for its
+	// POST.
+	AsyncWrites int
+	// StrictOrder makes SSE writes strictly FIFO, for protocols that can't
+	// tolerate any reordering or duplication: each POST waits for the
+	// server to acknowledge the one before, overriding AsyncWrites, and
+	// carries a sequence number the server checks. Since a failed POST may
+	// or may not have been delivered, it fails the conn for writing.
+	// WebSocket writes are strictly ordered regardless.
+	StrictOrder bool
+	// MaxFrameSize splits writes into WebSocket messages or SSE POSTs of
+	// at most this many bytes, which the server reads as one stream.
+	// Zero means 1MB.
+	MaxFrameSize int
+	// ReadLimit fails reads with ErrMessageTooLarge once the server sends
+	// a WebSocket message or SSE event larger than this many bytes,
+	// rather than buffering it. Zero means no limit.
+	ReadLimit int64
+	// ReadWindow caps the bytes the server sends ahead of what Read has
+	// consumed, the client granting more as it reads, so a slow reader
+	// holds the server back even through proxies that buffer the stream.
+	// On WebSocket it also opts into the server's window, see
+	// WithFlowControl. Zero means TCP's flow control alone.
+	ReadWindow int
+	// ReadBufferSize is the size of the buffer reads from the network go
+	// through: the WebSocket read buffer, overriding WSDialer's, or the
+	// SSE stream's. Larger buffers mean fewer reads at high throughput.
+	// Zero means 4096 bytes.
+	ReadBufferSize int
+	// WriteBuffer holds writes back until this many bytes are queued or
+	// Flush is called, for protocols making many tiny writes. Unlike
+	// CoalesceDelay nothing is sent on a timer, so the application must
+	// Flush. Zero means every Write is sent at once.
+	WriteBuffer int
+	// WriteTimeout fails a WebSocket write with a net.Error timeout if the
+	// server takes longer than this to accept it, rather than letting a
+	// stalled peer block the writer forever. The conn can't be written to
+	// afterwards. SSE writes are bounded by PostTimeout instead.
+	// Zero means no timeout.
+	WriteTimeout time.Duration
+	// WriteQueue queues up to this many WebSocket writes for a background
+	// goroutine to send, so Write returns without waiting for the
+	// network, like AsyncWrites for SSE. A failed write is reported by a
+	// later Write or Flush, and Close sends what is queued first. Zero
+	// means Write sends at once.
+	WriteQueue int
+	// Encryption, if set, encrypts the conn end to end, see WithEncryption.
+	Encryption *Encryption
+	// Tap, if set, is called with every chunk of data the conn reads or
+	// writes, as the application sees it: after WriteBuffer's batching
+	// and before encryption, or after decryption. It's for debugging
+	// proxies, audit capture and protocol analyzers. It is called from
+	// Read and Write, so it must be safe for concurrent use and quick,
+	// and b is only valid for the call.
+	Tap func(dir Direction, b []byte)
+	// Tracer, if set, traces each transport's dial attempt as a
+	// "webdial.dial" span, whose trace context goes to the server in the
+	// handshake's headers.
+	Tracer Tracer
+	// IdleTimeout closes the conn once it has gone this long without
+	// reading or writing any data. Zero means no timeout.
+	IdleTimeout time.Duration
+	// Retries is how many times Dial retries after a transient failure: a
+	// 502, 503 or 504 response, or a timeout. Zero means no retries.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubling after
+	// each one. A longer Retry-After from the server takes precedence.
+	// Zero means one second.
+	RetryBackoff time.Duration
+}
+
+// DefaultDialer is the Dialer used by Dial.
+var DefaultDialer = &Dialer{}
+
+// DialOption configures a single Dial call.
+type DialOption func(*Dialer)
+
+// WithHTTPClient sets the HTTP client used by the SSE transport.
+func WithHTTPClient(c *http.Client) DialOption {
+	return func(d *Dialer) { d.HTTPClient = c }
+}
+
+// WithWebsocketDialer sets the dialer used by the WebSocket transport.
+func WithWebsocketDialer(wd *websocket.Dialer) DialOption {
+	return func(d *Dialer) { d.WSDialer = wd }
+}
+
+// WithTLSConfig sets the TLS configuration used by both transports, e.g.
+// to pin server certificates, set ServerName or present a client
+// certificate. It doesn't apply to a client set with WithHTTPClient.
+func WithTLSConfig(c *tls.Config) DialOption {
+	return func(d *Dialer) { d.TLSConfig = c }
+}
+
+// WithInsecureSkipVerify disables server certificate verification on both
+// transports, for development against self-signed local servers. It keeps
+// any earlier WithTLSConfig settings. Never use it in production.
+func WithInsecureSkipVerify() DialOption {
+	return func(d *Dialer) {
+		if d.TLSConfig != nil {
+			d.TLSConfig = d.TLSConfig.Clone()
+		} else {
+			d.TLSConfig = &tls.Config{}
+		}
+		d.TLSConfig.InsecureSkipVerify = true
+	}
+}
+
+// WithProxy sends both transports through the HTTP, HTTPS or SOCKS5 proxy
+// at u, instead of the proxy from the environment.
+func WithProxy(u *url.URL) DialOption {
+	return func(d *Dialer) { d.Proxy = http.ProxyURL(u) }
+}
+
+// WithCookieJar sets the cookie jar used by both transports, e.g. to share
+// sticky session cookies between conns.
+func WithCookieJar(jar http.CookieJar) DialOption {
+	return func(d *Dialer) { d.Jar = jar }
+}
+
+// WithHandshakeTimeout bounds each transport's handshake. The dial
+// context's deadline applies too, whichever comes first.
+func WithHandshakeTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.HandshakeTimeout = timeout }
+}
+
+// WithPostTimeout bounds each POST made by the SSE transport, so a write
+// to an unresponsive server fails instead of hanging.
+func WithPostTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.PostTimeout = timeout }
+}
+
+// WithCloseOnCancel closes the conn, aborting in-flight POSTs, when the
+// dial context is cancelled.
+func WithCloseOnCancel() DialOption {
+	return func(d *Dialer) { d.CloseOnCancel = true }
+}
+
+// WithKeepAlive pings WebSocket conns every interval and closes them when
+// no pong arrives within timeout of a ping. It doesn't affect SSE conns,
+// which the server keeps alive.
+func WithKeepAlive(interval, timeout time.Duration) DialOption {
+	return func(d *Dialer) {
+		d.KeepAlive = interval
+		d.KeepAliveTimeout = timeout
+	}
+}
+
+// WithHTTP2 makes the SSE transport use HTTP/2 with prior knowledge,
+// including h2c against plaintext servers, multiplexing the stream and all
+// POSTs over a single connection. The server must accept unencrypted
+// HTTP/2, see http.Server.Protocols.
+func WithHTTP2() DialOption {
+	return func(d *Dialer) { d.HTTP2 = true }
+}
+
+// WithCoalescing batches small SSE writes into one POST, sent after delay
+// or once size bytes are queued. Writes then return before the data is
+// sent, and a failed POST is reported by a later Write or Flush.
+func WithCoalescing(delay time.Duration, size int) DialOption {
+	return func(d *Dialer) {
+		d.CoalesceDelay = delay
+		d.CoalesceSize = size
+	}
+}
+
+// WithAsyncWrites pipelines SSE writes, keeping up to n POSTs in flight
+// instead of waiting a round trip per Write. A failed POST is reported by a
+// later Write or Flush.
+func WithAsyncWrites(n int) DialOption {
+	return func(d *Dialer) { d.AsyncWrites = n }
+}
+
+// WithStrictOrder sets Dialer.StrictOrder, trading SSE write throughput
+// for strict FIFO delivery.
+func WithStrictOrder() DialOption {
+	return func(d *Dialer) { d.StrictOrder = true }
+}
+
+// WithMaxFrameSize sets Dialer.MaxFrameSize, e.g. below a server's
+// WithMaxPostSize so large SSE writes aren't rejected.
+func WithMaxFrameSize(n int) DialOption {
+	return func(d *Dialer) { d.MaxFrameSize = n }
+}
+
+// WithReadLimit sets Dialer.ReadLimit.
+func WithReadLimit(n int64) DialOption {
+	return func(d *Dialer) { d.ReadLimit = n }
+}
+
+// WithReadWindow sets Dialer.ReadWindow.
+func WithReadWindow(n int) DialOption {
+	return func(d *Dialer) { d.ReadWindow = n }
+}
+
+// WithReadBuffer sets Dialer.ReadBufferSize.
+func WithReadBuffer(size int) DialOption {
+	return func(d *Dialer) { d.ReadBufferSize = size }
+}
+
+// WithWriteBuffer sets Dialer.WriteBuffer: writes are held in a buffer of
+// size bytes until it fills, Flush is called or the conn is closed.
+func WithWriteBuffer(size int) DialOption {
+	return func(d *Dialer) { d.WriteBuffer = size }
+}
+
+// WithWriteTimeout sets Dialer.WriteTimeout.
+func WithWriteTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.WriteTimeout = timeout }
+}
+
+// WithWriteQueue sets Dialer.WriteQueue.
+func WithWriteQueue(n int) DialOption {
+	return func(d *Dialer) { d.WriteQueue = n }
+}
+
+// WithLocalAddr dials both transports from addr, e.g. a *net.TCPAddr
+// with only the IP of the interface to use.
+func WithLocalAddr(addr net.Addr) DialOption {
+	return func(d *Dialer) { d.LocalAddr = addr }
+}
+
+// WithNetwork restricts both transports to "tcp4" or "tcp6".
+func WithNetwork(network string) DialOption {
+	return func(d *Dialer) { d.Network = network }
+}
+
+// WithHost sets the Host header sent with every request, e.g. to reach a
+// virtual host on a shared ingress dialed by IP.
+func WithHost(host string) DialOption {
+	return func(d *Dialer) { d.Host = host }
+}
+
+// WithIdleTimeout closes the conn after timeout without reads or writes,
+// e.g. so a forgotten tunnel doesn't hold a billed stream open. Reads and
+// writes then fail with ErrIdleTimeout.
+func WithIdleTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.IdleTimeout = timeout }
+}
+
+// WithRetry retries transient dial failures up to max times, waiting
+// backoff before the first retry and doubling it after each, unless the
+// server asks for longer with Retry-After.
+func WithRetry(max int, backoff time.Duration) DialOption {
+	return func(d *Dialer) {
+		d.Retries = max
+		d.RetryBackoff = backoff
 	}
-	return dialSSE(ctx, baseURL)
 }
 
-func dialWS(ctx context.Context, baseURL string) (net.Conn, error) {
-	wsURL := strings.Replace(baseURL, "https://", "wss://", 1)
-	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
-	dialer := websocket.Dialer{}
-	ws, _, err := dialer.DialContext(ctx, wsURL, nil)
+// WithHeader adds a header sent with the WebSocket upgrade, the SSE
+// request and every POST.
+func WithHeader(key, value string) DialOption {
+	return func(d *Dialer) {
+		d.Header = cloneHeader(d.Header)
+		d.Header.Add(key, value)
+	}
+}
+
+// WithHeaders adds all of h to the headers sent with every request.
+func WithHeaders(h http.Header) DialOption {
+	return func(d *Dialer) {
+		d.Header = cloneHeader(d.Header)
+		for k, vs := range h {
+			for _, v := range vs {
+				d.Header.Add(k, v)
+			}
+		}
+	}
+}
+
+// cloneHeader copies h so options never modify a shared Dialer's header.
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return http.Header{}
+	}
+	return h.Clone()
+}
+
+// Dial connects to the webdial server at baseURL using DefaultDialer,
+// modified by opts.
+func Dial(ctx context.Context, baseURL string, opts ...DialOption) (*Conn, error) {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.DialContext(ctx, baseURL)
+}
+
+// DialContext connects to the webdial server at baseURL, an http, https,
+// wd or wds URL, where wd and wds mean http and https. It retries
+// transient failures as configured by Retries.
+// If every attempted transport fails, the error is a *DialError.
+func (d *Dialer) DialContext(ctx context.Context, baseURL string) (*Conn, error) {
+	backoff := d.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := d.dial(ctx, baseURL)
+		if err == nil || attempt >= d.Retries || ctx.Err() != nil {
+			return conn, err
+		}
+		wait, ok := retryDelay(err)
+		if !ok {
+			return nil, err
+		}
+		wait = max(wait, backoff)
+		backoff *= 2
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// retryDelay reports whether err is worth retrying and how long the server
+// asked us to wait.
+func retryDelay(err error) (time.Duration, bool) {
+	retryable := func(status int) bool {
+		return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+	}
+	var se *serverError
+	if errors.As(err, &se) && retryable(se.status) {
+		return se.retryAfter, true
+	}
+	var ste *statusError
+	if errors.As(err, &ste) && retryable(ste.status) {
+		return ste.retryAfter, true
+	}
+	return 0, isTimeout(err)
+}
+
+// rejected reports whether the server turned a dial away in a way that
+// retrying won't change: with a *VersionError, or with a client error
+// status such as 401, 403 or 404, other than 408 Request Timeout and 429
+// Too Many Requests.
+func rejected(err error) bool {
+	var ve *VersionError
+	if errors.As(err, &ve) {
+		return true
+	}
+	status := errStatus(err)
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+// errStatus is the HTTP status a dial was turned away with, or zero.
+func errStatus(err error) int {
+	var se *serverError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	var ste *statusError
+	if errors.As(err, &ste) {
+		return ste.status
+	}
+	return 0
+}
+
+func (d *Dialer) dial(ctx context.Context, baseURL string) (*Conn, error) {
+	// The handler can be mounted at any path, so baseURL's path and query
+	// are used as given.
+	u, err := url.Parse(baseURL)
 	if err != nil {
+		return nil, fmt.Errorf("webdial: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "wd", "wds":
+		// Explicit webdial schemes, so configs can tell webdial endpoints
+		// from plain HTTP ones.
+		u.Scheme = strings.Replace(u.Scheme, "wd", "http", 1)
+		baseURL = u.String()
+	default:
+		return nil, fmt.Errorf("%w: scheme %q", ErrUnsupportedTransport, u.Scheme)
+	}
+	var transports []string
+	switch d.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("webdial: unsupported network %q", d.Network)
+	}
+	switch d.Transport {
+	case "ws", "sse":
+		transports = []string{d.Transport}
+	case "":
+		transports = []string{"ws", "sse"}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedTransport, d.Transport)
+	}
+	dialErr := &DialError{}
+	for _, transport := range transports {
+		var conn *Conn
+		var err error
+		spanCtx, span := startSpan(d.Tracer, ctx, "webdial.dial",
+			slog.String("transport", transport),
+			slog.String("server", u.Host))
+		if transport == "ws" {
+			conn, err = d.dialWS(spanCtx, baseURL)
+		} else {
+			conn, err = d.dialSSE(spanCtx, baseURL)
+		}
+		span.End(err)
+		if err == nil {
+			if d.CloseOnCancel {
+				bindContext(ctx, conn.Conn)
+			}
+			if d.RateLimit > 0 {
+				conn.readRate = newTokenBucket(d.RateLimit, 0)
+				conn.writeRate = newTokenBucket(d.RateLimit, 0)
+			}
+			if d.IdleTimeout > 0 {
+				conn.idle = newIdleWatch(d.IdleTimeout, func() { conn.Conn.Close() })
+			}
+			conn.tap = d.Tap
+			if d.WriteBuffer > 0 {
+				conn.wbuf = newWriteBuffer(conn.write, d.WriteBuffer)
+			}
+			if d.Encryption != nil {
+				rw := struct {
+					io.Reader
+					io.Writer
+				}{readerFunc(conn.read), writerFunc(conn.sendRaw)}
+				conn.noise = newNoiseConn(rw, conn.Conn, *d.Encryption)
+			}
+			return conn, nil
+		}
+		dialErr.Transports = append(dialErr.Transports, transport)
+		dialErr.Errors = append(dialErr.Errors, err)
+		var se *serverError
+		var ve *VersionError
+		if errors.As(err, &ve) || (errors.As(err, &se) && se.hint != "sse") {
+			// The server rejected us outright, SSE won't fare any better.
+			break
+		}
+	}
+	return nil, dialErr
+}
+
+// bindContext closes conn when ctx is done.
+func bindContext(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	switch c := conn.(type) {
+	case *wsConn:
+		c.onClose = func() { stop() }
+	case *sseClientConn:
+		c.postCtx = ctx
+		c.onClose = func() { stop() }
+	}
+}
+
+// Conn is a conn returned by Dial, carrying details of its handshake.
+type Conn struct {
+	net.Conn
+	transport string
+	resp      *http.Response
+	readRate  *tokenBucket // nil when unlimited
+	writeRate *tokenBucket
+	idle      *idleWatch   // nil without an idle timeout
+	wbuf      *writeBuffer // nil without WithWriteBuffer
+	noise     *noiseConn   // nil without WithEncryption
+	tap       func(Direction, []byte)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	if c.noise != nil {
+		n, err = c.noise.Read(b)
+	} else {
+		n, err = c.read(b)
+	}
+	if c.tap != nil && n > 0 {
+		c.tap(Inbound, b[:n])
+	}
+	return n, c.idleErr(n, err)
+}
+
+func (c *Conn) read(b []byte) (int, error) {
+	if c.readRate == nil {
+		return c.Conn.Read(b)
+	}
+	n, err := c.Conn.Read(b[:min(len(b), c.readRate.burst)])
+	c.readRate.take(n)
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.wbuf != nil {
+		n, err := c.wbuf.Write(b)
+		return n, c.idleErr(n, err)
+	}
+	n, err := c.write(b)
+	return n, c.idleErr(n, err)
+}
+
+func (c *Conn) write(b []byte) (n int, err error) {
+	if c.noise != nil {
+		n, err = c.noise.Write(b)
+	} else {
+		n, err = c.sendRaw(b)
+	}
+	if c.tap != nil && n > 0 {
+		c.tap(Outbound, b[:n])
+	}
+	return n, err
+}
+
+// sendRaw writes b to the transport, past any encryption.
+func (c *Conn) sendRaw(b []byte) (int, error) {
+	if c.writeRate == nil {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.writeRate.burst)]
+		c.writeRate.take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// idleErr records activity and reports ErrIdleTimeout for errors caused
+// by the idle timeout closing the conn.
+func (c *Conn) idleErr(n int, err error) error {
+	if c.idle == nil {
+		return err
+	}
+	if n > 0 {
+		c.idle.touch()
+	}
+	if err != nil && c.idle.fired.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+func (c *Conn) Close() error {
+	return c.CloseWithError(closeNormal, "")
+}
+
+// CloseWithError closes the conn, telling the server why: its reads
+// return a *CloseError carrying code and reason rather than io.EOF. See
+// CloseError for the codes.
+func (c *Conn) CloseWithError(code int, reason string) error {
+	if c.wbuf != nil {
+		c.wbuf.Flush()
+	}
+	if c.idle != nil {
+		c.idle.stop()
+	}
+	if cc, ok := c.Conn.(interface {
+		CloseWithError(int, string) error
+	}); ok {
+		return cc.CloseWithError(code, reason)
+	}
+	return c.Conn.Close()
+}
+
+// Context returns a context cancelled once the conn is closed, by either
+// end, or its reads find the connection has failed, so that goroutines
+// using the conn can select on it. context.Cause reports why: net.ErrClosed
+// for Close, or what Read returned.
+func (c *Conn) Context() context.Context {
+	return connContext(c.Conn)
+}
+
+// Draining returns a channel closed once the server has said it is
+// shutting down, see Server.Shutdown, so the application can finish what
+// it's doing and reconnect, perhaps elsewhere, before the server closes
+// the conn. Over WebSocket, like pongs, the notice is only seen while the
+// conn is being read.
+func (c *Conn) Draining() <-chan struct{} {
+	if d, ok := c.Conn.(interface{ Draining() <-chan struct{} }); ok {
+		return d.Draining()
+	}
+	return nil
+}
+
+// Transport returns the transport that was negotiated, "ws" or "sse".
+func (c *Conn) Transport() string {
+	return c.transport
+}
+
+// HTTPResponse returns the handshake response: the 101 Switching Protocols
+// for WebSocket, or the event stream for SSE. Its body belongs to the conn
+// and must not be read.
+func (c *Conn) HTTPResponse() *http.Response {
+	return c.resp
+}
+
+// SetKeepAlive turns keep-alive pings on or off, as on a net.TCPConn, so
+// code that configures keep-alives on any net.Conn works on either
+// transport: WebSocket pings, or empty POSTs for SSE, whose stream the
+// server keeps alive. It overrides Dialer.KeepAlive.
+func (c *Conn) SetKeepAlive(keepalive bool) error {
+	if ka, ok := c.Conn.(keepAliver); ok {
+		return ka.SetKeepAlive(keepalive)
+	}
+	return nil
+}
+
+// SetKeepAlivePeriod sets the interval between keep-alive pings. Without
+// one, SetKeepAlive(true) pings every 15 seconds.
+func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
+	if ka, ok := c.Conn.(keepAliver); ok {
+		return ka.SetKeepAlivePeriod(d)
+	}
+	return nil
+}
+
+// Handshake runs the WithEncryption handshake if it hasn't run yet,
+// giving up when ctx is done. Without encryption it does nothing.
+func (c *Conn) Handshake(ctx context.Context) error {
+	if c.noise == nil {
+		return nil
+	}
+	return c.noise.handshake(ctx)
+}
+
+// PeerKey returns the static key the peer proved it holds during the
+// WithEncryption handshake, nil before it or without encryption.
+func (c *Conn) PeerKey() *ecdh.PublicKey {
+	if c.noise == nil {
+		return nil
+	}
+	return c.noise.remoteKey()
+}
+
+// Unwrap returns what the conn runs over, for tuning it beyond what
+// webdial offers: the *websocket.Conn, whose NetConn is the socket, e.g.
+// to call (*net.TCPConn).SetNoDelay, or the SSE stream's *http.Response.
+func (c *Conn) Unwrap() any {
+	if u, ok := c.Conn.(interface{ Unwrap() any }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// PeerVersion returns the webdial version the server reported during the
+// handshake, empty if it didn't.
+func (c *Conn) PeerVersion() string {
+	return c.resp.Header.Get(versionHeader)
+}
+
+// Stats returns the conn's counters.
+func (c *Conn) Stats() Stats {
+	if sc, ok := c.Conn.(interface{ counters() *connStats }); ok {
+		return sc.counters().stats(c.transport)
+	}
+	return Stats{Transport: c.transport}
+}
+
+// Ping measures the round trip to the server: a WebSocket ping, or an
+// empty POST for SSE. WebSocket pongs are only seen while the conn is
+// being read. Conns that can't ping return errors.ErrUnsupported.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	p, ok := c.Conn.(interface {
+		Ping(context.Context) (time.Duration, error)
+	})
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return p.Ping(ctx)
+}
+
+// Flush sends any writes held back by WithWriteBuffer or WithCoalescing
+// and waits for those in flight with WithAsyncWrites or queued with
+// WithWriteQueue, returning the first error from sending them. It is a
+// no-op for other conns.
+func (c *Conn) Flush() error {
+	if c.wbuf != nil {
+		if err := c.wbuf.Flush(); err != nil {
+			return c.idleErr(0, err)
+		}
+	}
+	if f, ok := c.Conn.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// State returns a snapshot of the conn's internal state.
+func (c *Conn) State() ConnState {
+	st, _ := StateOf(c.Conn)
+	return st
+}
+
+func (c *Conn) meta() *connMeta {
+	if mc, ok := c.Conn.(interface{ meta() *connMeta }); ok {
+		return mc.meta()
+	}
+	return &connMeta{}
+}
+
+// DialError reports the failure of every transport Dial attempted.
+type DialError struct {
+	// Transports lists the transports tried, in order.
+	Transports []string
+	// Errors holds the error from each transport in Transports.
+	Errors []error
+}
+
+func (e *DialError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		parts[i] = e.Transports[i] + ": " + err.Error()
+	}
+	return "webdial: dial failed (" + strings.Join(parts, "; ") + ")"
+}
+
+// Unwrap returns every transport error, so errors.Is and errors.As match
+// any of them, as with errors.Join.
+func (e *DialError) Unwrap() []error {
+	return e.Errors
+}
+
+func (d *Dialer) httpClient() *http.Client {
+	var c http.Client
+	switch {
+	case d.HTTPClient != nil:
+		c = *d.HTTPClient
+	case d.TLSConfig != nil || d.Proxy != nil || d.HTTP2 || d.customNet():
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = d.TLSConfig
+		if d.customNet() {
+			t.DialContext = d.netDial
+		}
+		if d.Proxy != nil {
+			t.Proxy = d.Proxy
+		}
+		if d.HTTP2 {
+			// HTTP/2 only, with prior knowledge over plaintext (h2c).
+			t.Protocols = new(http.Protocols)
+			t.Protocols.SetHTTP2(true)
+			t.Protocols.SetUnencryptedHTTP2(true)
+		}
+		c.Transport = t
+	}
+	if d.Jar != nil {
+		c.Jar = d.Jar
+	} else if c.Jar == nil {
+		c.Jar, _ = cookiejar.New(nil)
+	}
+	return &c
+}
+
+func (d *Dialer) dialWS(ctx context.Context, baseURL string) (*Conn, error) {
+	u, _ := url.Parse(baseURL)
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment}
+	if d.WSDialer != nil {
+		dialer = *d.WSDialer
+	}
+	if d.Proxy != nil {
+		dialer.Proxy = d.Proxy
+	}
+	if d.Jar != nil {
+		dialer.Jar = d.Jar
+	}
+	if d.TLSConfig != nil {
+		dialer.TLSClientConfig = d.TLSConfig
+	}
+	if d.HandshakeTimeout > 0 {
+		dialer.HandshakeTimeout = d.HandshakeTimeout
+	}
+	if d.ReadBufferSize > 0 {
+		dialer.ReadBufferSize = d.ReadBufferSize
+	}
+	if d.customNet() && dialer.NetDial == nil && dialer.NetDialContext == nil {
+		dialer.NetDialContext = d.netDial
+	}
+	header := d.handshakeHeader(ctx)
+	if d.Host != "" {
+		header.Set("Host", d.Host)
+	}
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	for hops := 0; err != nil && hops < maxMountRedirects; hops++ {
+		next, ok := mountRedirect(u, resp)
+		if !ok {
+			break
+		}
+		u = next
+		ws, resp, err = dialer.DialContext(ctx, u.String(), header)
+	}
+	if err != nil {
+		if resp != nil {
+			return nil, responseError(resp, err)
+		}
+		return nil, err
+	}
+	if d.ReadLimit > 0 {
+		ws.SetReadLimit(d.ReadLimit)
+	}
+	conn := newWSConn(ws, d.KeepAlive, d.KeepAliveTimeout)
+	conn.maxFrame = d.MaxFrameSize
+	conn.writeTimeout = d.WriteTimeout
+	if d.WriteQueue > 0 {
+		conn.startWriteQueue(d.WriteQueue)
+	}
+	if n, ok := parseWindow(resp.Header.Get(windowHeader)); ok && d.ReadWindow > 0 {
+		conn.startFlowControl(n, int64(d.ReadWindow))
+	}
+	conn.peerVersion = resp.Header.Get(versionHeader)
+	conn.setPhase(PhaseEstablished)
+	return &Conn{Conn: conn, transport: "ws", resp: resp}, nil
+}
+
+func (d *Dialer) dialSSE(ctx context.Context, baseURL string) (*Conn, error) {
+	// The stream outlives the dial, so ctx and HandshakeTimeout only bound
+	// the handshake.
+	streamCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() { cancel(context.Cause(ctx)) })
+	defer stop()
+	if d.HandshakeTimeout > 0 {
+		timer := time.AfterFunc(d.HandshakeTimeout, func() { cancel(ErrHandshakeTimeout) })
+		defer timer.Stop()
+	}
+	conn, err := d.handshakeSSE(streamCtx, baseURL, cancel)
+	if err != nil {
+		if cause := context.Cause(streamCtx); cause != nil {
+			err = cause
+		}
+		cancel(err)
 		return nil, err
 	}
-	return newWSConn(ws, -1), nil
+	return conn, nil
 }
 
-func dialSSE(ctx context.Context, baseURL string) (net.Conn, error) {
+func (d *Dialer) handshakeSSE(ctx context.Context, baseURL string, cancel context.CancelCauseFunc) (*Conn, error) {
 	sseURL := baseURL
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sseURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	setHeader(req, d.handshakeHeader(ctx))
+	req.Host = d.Host
 	req.Header.Set("Accept", "text/event-stream")
-	client := &http.Client{}
+	client := d.httpClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("webdial: sse returned %d", resp.StatusCode)
+		defer resp.Body.Close()
+		return nil, responseError(resp, fmt.Errorf("webdial: sse returned %d", resp.StatusCode))
+	}
+	var body io.Reader = resp.Body
+	if d.ReadLimit > 0 {
+		body = newEventLimiter(body, d.ReadLimit)
+	}
+	if d.ReadBufferSize > 0 {
+		// The decoder reads through this rather than its own bufio.Reader
+		// unless it is below the default 4096 bytes.
+		body = bufio.NewReaderSize(body, d.ReadBufferSize)
 	}
-	decoder := eventsource.NewDecoder(resp.Body)
+	decoder := eventsource.NewDecoder(body)
 	var ev eventsource.Event
 	if err := decoder.Decode(&ev); err != nil {
 		resp.Body.Close()
-		return nil, fmt.Errorf("webdial: reading session id: %w", err)
+		return nil, fmt.Errorf("%w: reading session id: %w", ErrHandshake, err)
 	}
 	if ev.Type != "sid" {
 		resp.Body.Close()
-		return nil, fmt.Errorf("webdial: expected sid event, got %q", ev.Type)
+		return nil, fmt.Errorf("%w: expected sid event, got %q", ErrHandshake, ev.Type)
 	}
 	sid := string(ev.Data)
-	return newSSEClientConn(baseURL, sid, resp, decoder, client), nil
+	if resp.Request != nil && sameOrigin(baseURL, resp.Request.URL) {
+		// POST straight to where any redirects led, see mountRedirect.
+		// POSTs carry d.Header, so they never follow a redirect to
+		// another host, as http.Client drops credentials on those.
+		baseURL = resp.Request.URL.String()
+	}
+	conn := newSSEClientConn(baseURL, sid, resp, decoder, client)
+	conn.header = d.Header
+	conn.host = d.Host
+	conn.coalesceDelay = d.CoalesceDelay
+	conn.coalesceSize = d.CoalesceSize
+	conn.maxFrame = d.MaxFrameSize
+	if _, ok := parseWindow(resp.Header.Get(windowHeader)); ok && d.ReadWindow > 0 {
+		conn.window = &recvWindow{size: int64(d.ReadWindow)}
+	}
+	if d.StrictOrder {
+		conn.strict = true
+	} else if d.AsyncWrites > 0 {
+		conn.asyncWindow = make(chan struct{}, d.AsyncWrites)
+	}
+	conn.ownsTransport = d.HTTPClient == nil && client.Transport != nil
+	conn.cancel = cancel
+	conn.postTimeout = d.PostTimeout
+	conn.peerVersion = resp.Header.Get(versionHeader)
+	conn.setPhase(PhaseEstablished)
+	return &Conn{Conn: conn, transport: "sse", resp: resp}, nil
+}
+
+// maxMountRedirects bounds the redirects followed by a WebSocket dial.
+const maxMountRedirects = 5
+
+// mountRedirect returns where a redirected WebSocket handshake should be
+// retried. Servers mounted on a subtree, as with http.Handle("/wd/", srv),
+// redirect "/wd" to "/wd/"; only such redirects to the same host are
+// followed, as browsers and http.Client would for the SSE transport.
+func mountRedirect(u *url.URL, resp *http.Response) (*url.URL, bool) {
+	if resp == nil {
+		return nil, false
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return nil, false
+	}
+	next := u.ResolveReference(loc)
+	next.Scheme = strings.Replace(next.Scheme, "http", "ws", 1)
+	if next.Scheme != u.Scheme || next.Host != u.Host {
+		return nil, false
+	}
+	return next, true
+}
+
+// sameOrigin reports whether u has the scheme and host of rawURL.
+func sameOrigin(rawURL string, u *url.URL) bool {
+	base, err := url.Parse(rawURL)
+	return err == nil && base.Scheme == u.Scheme && base.Host == u.Host
+}
+
+// customNet reports whether LocalAddr or Network need a custom net dialer.
+func (d *Dialer) customNet() bool {
+	return d.LocalAddr != nil || (d.Network != "" && d.Network != "tcp")
+}
+
+// netDial dials TCP connections for both transports, honoring LocalAddr
+// and Network.
+func (d *Dialer) netDial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Network != "" {
+		network = d.Network
+	}
+	nd := net.Dialer{LocalAddr: d.LocalAddr, Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return nd.DialContext(ctx, network, address)
+}
+
+// handshakeHeader is sent with the WebSocket upgrade or SSE request.
+func (d *Dialer) handshakeHeader(ctx context.Context) http.Header {
+	h := cloneHeader(d.Header)
+	h.Set(versionHeader, version)
+	if d.Tracer != nil {
+		d.Tracer.Inject(ctx, h)
+	}
+	if d.Target != "" {
+		h.Set(targetHeader, d.Target)
+	}
+	if len(d.Metadata) > 0 {
+		h.Set(metadataHeader, encodeMetadata(d.Metadata))
+	}
+	if len(d.Tags) > 0 {
+		h.Set(tagsHeader, strings.Join(d.Tags, ","))
+	}
+	if d.Room != "" {
+		h.Set(roomHeader, d.Room)
+	}
+	if d.ReadWindow > 0 {
+		h.Set(windowHeader, strconv.Itoa(d.ReadWindow))
+	}
+	return h
+}
+
+func setHeader(req *http.Request, h http.Header) {
+	for k, vs := range h {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
 }
@@ -0,0 +1,110 @@
+package webdial
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientLimits caps what each client may use, so that one misbehaving
+// client can't exhaust the accept queue or the session table.
+type ClientLimits struct {
+	// MaxConns caps the live conns per client. Zero means no cap.
+	MaxConns int
+	// PostRate caps the SSE POSTs per second per client, with bursts of up
+	// to a second's worth. Zero means no cap.
+	PostRate int
+	// Key identifies the client making a request. Nil means RemoteIP.
+	Key func(*http.Request) string
+}
+
+// WithClientLimits applies l to every client. Handshakes beyond MaxConns
+// and POSTs beyond PostRate get 429 Too Many Requests with Retry-After.
+func WithClientLimits(l ClientLimits) ServerOption {
+	return func(s *Server) {
+		s.clients = &clientTable{limits: l, m: map[string]*clientEntry{}}
+	}
+}
+
+// RemoteIP is the default ClientLimits.Key: the IP the request came from.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientTable tracks each client's usage against ClientLimits.
+type clientTable struct {
+	limits ClientLimits
+	mu     sync.Mutex
+	m      map[string]*clientEntry // clients with live conns
+}
+
+type clientEntry struct {
+	conns int
+	posts *tokenBucket // nil without PostRate
+}
+
+func (t *clientTable) key(r *http.Request) string {
+	if t.limits.Key != nil {
+		return t.limits.Key(r)
+	}
+	return RemoteIP(r)
+}
+
+// acquire counts a new conn for the client, reporting false if it is at
+// MaxConns.
+func (t *clientTable) acquire(r *http.Request) bool {
+	key := t.key(r)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.m[key]
+	if e == nil {
+		e = &clientEntry{}
+		if t.limits.PostRate > 0 {
+			e.posts = newTokenBucket(t.limits.PostRate, 0)
+		}
+		t.m[key] = e
+	}
+	if t.limits.MaxConns > 0 && e.conns >= t.limits.MaxConns {
+		return false
+	}
+	e.conns++
+	return true
+}
+
+func (t *clientTable) release(r *http.Request) {
+	key := t.key(r)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.m[key]; e != nil {
+		if e.conns--; e.conns <= 0 {
+			delete(t.m, key)
+		}
+	}
+}
+
+// allowPost reports whether the client is within PostRate, and if not how
+// long it should wait. Clients without live conns have no sessions to
+// post to, so aren't tracked.
+func (t *clientTable) allowPost(r *http.Request) (time.Duration, bool) {
+	key := t.key(r)
+	t.mu.Lock()
+	e := t.m[key]
+	t.mu.Unlock()
+	if e == nil || e.posts == nil {
+		return 0, true
+	}
+	return e.posts.tryTake(1)
+}
+
+// tooMany rejects a request over a client limit.
+func (s *Server) tooMany(w http.ResponseWriter, r *http.Request, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds()))))
+	s.reject(w, r, http.StatusTooManyRequests, msg, "")
+}
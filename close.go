@@ -0,0 +1,81 @@
+package webdial
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseError is returned by Read once the peer has closed the conn with
+// CloseWithError, carrying the code and reason it gave. Codes are
+// WebSocket's, see RFC 6455 section 7.4; 4000 to 4999 are free for
+// applications. A peer that simply closes the conn gives io.EOF instead.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("webdial: closed by peer with code %d", e.Code)
+	}
+	return fmt.Sprintf("webdial: closed by peer with code %d: %s", e.Code, e.Reason)
+}
+
+// closeNormal is the code of an ordinary Close.
+const closeNormal = websocket.CloseNormalClosure
+
+// maxCloseReason is what fits in a WebSocket close frame after the code.
+const maxCloseReason = 123
+
+// peerClosed is what Read returns once the peer closed with code and
+// reason: io.EOF for an ordinary close, a *CloseError otherwise.
+func peerClosed(code int, reason string) error {
+	if (code == closeNormal || code == websocket.CloseGoingAway) && reason == "" {
+		return io.EOF
+	}
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// wsCloseErr maps a close frame from the peer to peerClosed. Conns that
+// dropped without one are left as gorilla reports them.
+func wsCloseErr(err error) error {
+	ce, ok := err.(*websocket.CloseError)
+	if !ok || ce.Code == websocket.CloseAbnormalClosure {
+		return err
+	}
+	return peerClosed(ce.Code, ce.Text)
+}
+
+// formatClose is the data of an SSE close event, empty for an ordinary
+// close so that clients which predate close reasons see what they always
+// have.
+func formatClose(code int, reason string) string {
+	if peerClosed(code, reason) == io.EOF {
+		return ""
+	}
+	return strconv.Itoa(code) + " " + reason
+}
+
+// parseClose reverses formatClose.
+func parseClose(data string) error {
+	if data == "" {
+		return io.EOF
+	}
+	code, reason, _ := strings.Cut(data, " ")
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("webdial: bad close event %q", data)
+	}
+	return peerClosed(n, reason)
+}
+
+func truncateReason(reason string) string {
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	return reason
+}
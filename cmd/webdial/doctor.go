@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jpillora/webdial"
+)
+
+// slowSID is how long the SSE session ID may take to arrive before we
+// suspect a proxy is buffering the stream.
+const slowSID = time.Second
+
+type status int
+
+const (
+	statusOK status = iota
+	statusWarn
+	statusFail
+)
+
+func (s status) String() string {
+	return [...]string{"ok  ", "WARN", "FAIL"}[s]
+}
+
+type probe struct {
+	name string
+	run  func(ctx context.Context, url string) (status, string)
+}
+
+// doctor probes a webdial endpoint. The WebSocket and SSE probes open real
+// conns, so the server's application will briefly see them in Accept.
+func doctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each probe")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("doctor: expected <url>")
+	}
+	url := strings.TrimRight(fs.Arg(0), "/")
+	probes := []probe{
+		{"websocket upgrade", probeWS},
+		{"sse stream", probeSSE},
+		{"post round-trip", probePost},
+		{"max post size", probePostSize},
+		{"cors", probeCORS},
+	}
+	results := map[string]status{}
+	fmt.Printf("webdial doctor %s\n\n", url)
+	for _, p := range probes {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		st, detail := p.run(ctx, url)
+		cancel()
+		results[p.name] = st
+		fmt.Printf("  %s  %-18s %s\n", st, p.name, detail)
+	}
+	fmt.Println()
+	ws := results["websocket upgrade"] != statusFail
+	sse := results["sse stream"] != statusFail && results["post round-trip"] != statusFail
+	switch {
+	case ws:
+		fmt.Println("ready: clients will use websockets")
+	case sse:
+		fmt.Println("ready: clients will fall back to sse+post")
+	default:
+		fmt.Println("not ready: no transport works on this network path")
+		return errors.New("doctor: endpoint unreachable")
+	}
+	return nil
+}
+
+func probeWS(ctx context.Context, url string) (status, string) {
+	start := time.Now()
+	conn, err := (&webdial.Dialer{Transport: "ws"}).DialContext(ctx, url)
+	if err != nil {
+		return statusFail, err.Error()
+	}
+	conn.Close()
+	return statusOK, fmt.Sprintf("upgraded in %s", since(start))
+}
+
+func probeSSE(ctx context.Context, url string) (status, string) {
+	start := time.Now()
+	conn, err := (&webdial.Dialer{Transport: "sse"}).DialContext(ctx, url)
+	if err != nil {
+		return statusFail, err.Error()
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	if elapsed > slowSID {
+		return statusWarn, fmt.Sprintf("session id took %s, a proxy may be buffering the stream", elapsed.Round(time.Millisecond))
+	}
+	return statusOK, fmt.Sprintf("session id received in %s", since(start))
+}
+
+// probePost posts to a session that can't exist, so the request reaches
+// the webdial server without injecting data into a real conn.
+func probePost(ctx context.Context, url string) (status, string) {
+	const rounds = 5
+	var total time.Duration
+	for range rounds {
+		start := time.Now()
+		code, err := post(ctx, url, nil)
+		if err != nil {
+			return statusFail, err.Error()
+		}
+		if code != http.StatusNotFound {
+			return statusFail, fmt.Sprintf("unexpected status %d, posts may not reach the server", code)
+		}
+		total += time.Since(start)
+	}
+	return statusOK, fmt.Sprintf("average %s over %d requests", (total / rounds).Round(time.Microsecond), rounds)
+}
+
+func probePostSize(ctx context.Context, url string) (status, string) {
+	largest := 0
+	for _, size := range []int{64 << 10, 1 << 20, 8 << 20} {
+		code, err := post(ctx, url, make([]byte, size))
+		if err != nil || code != http.StatusNotFound {
+			break
+		}
+		largest = size
+	}
+	switch largest {
+	case 0:
+		return statusWarn, "even 64KiB posts are rejected, large writes will fail"
+	case 8 << 20:
+		return statusOK, "accepts posts of at least 8MiB"
+	}
+	return statusWarn, fmt.Sprintf("posts above %dKiB are rejected", largest>>10)
+}
+
+func probeCORS(ctx context.Context, url string) (status, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, url, nil)
+	if err != nil {
+		return statusFail, err.Error()
+	}
+	req.Header.Set("Origin", "https://webdial-doctor.invalid")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return statusFail, err.Error()
+	}
+	resp.Body.Close()
+	origin := resp.Header.Get("Access-Control-Allow-Origin")
+	if origin == "" {
+		return statusWarn, "no CORS headers, cross-origin browser clients can only use websockets"
+	}
+	return statusOK, "allows origin " + origin
+}
+
+func post(ctx context.Context, url string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"?s=webdial-doctor", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Millisecond)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpillora/webdial"
+)
+
+// gateway serves webdial, forwarding each conn to -forward, or to the
+// target its client asked for if it matches -allow. Egress controls are
+// on by default: only the ports of those targets may be dialed, conns are
+// closed after -max-duration, and every dial and close is logged.
+func gateway(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "address to serve webdial on")
+	forward := fs.String("forward", "", "host:port to forward every conn to")
+	allow := fs.String("allow", "", `comma-separated host:port patterns clients may target instead, e.g. "db-*.internal:5432"`)
+	ports := fs.String("allow-ports", "", `comma-separated ports that may be dialed, or "any" (default: those of -forward or -allow)`)
+	maxDuration := fs.Duration("max-duration", time.Hour, "close forwarded conns after this long, 0 for no cap")
+	fs.Parse(args)
+
+	var targets []string
+	if *forward != "" {
+		targets = []string{*forward}
+	} else if *allow != "" {
+		targets = strings.Split(*allow, ",")
+	} else {
+		return errors.New("gateway: -forward or -allow is required")
+	}
+	egress := &webdial.EgressPolicy{
+		MaxDuration: *maxDuration,
+		Audit: func(ev webdial.EgressEvent) {
+			attrs := []any{slog.String("address", ev.Address), slog.Bool("allowed", ev.Allowed)}
+			if ev.Err != nil {
+				attrs = append(attrs, slog.Any("err", ev.Err))
+			}
+			if ev.Closed {
+				slog.Info("egress closed", append(attrs, slog.Duration("duration", ev.Duration))...)
+				return
+			}
+			slog.Info("egress dial", attrs...)
+		},
+	}
+	switch {
+	case *ports == "any":
+	case *ports != "":
+		for p := range strings.SplitSeq(*ports, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				return fmt.Errorf("gateway: bad port %q", p)
+			}
+			egress.AllowPorts = append(egress.AllowPorts, port)
+		}
+	default:
+		for _, target := range targets {
+			_, p, err := net.SplitHostPort(strings.TrimSpace(target))
+			if err != nil {
+				return fmt.Errorf("gateway: bad target %q: %w", target, err)
+			}
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				// A pattern such as "*" leaves the port open.
+				return fmt.Errorf("gateway: target %q has no fixed port, set -allow-ports", target)
+			}
+			egress.AllowPorts = append(egress.AllowPorts, port)
+		}
+	}
+	policy := webdial.ForwardPolicy{Egress: egress}
+	if *forward == "" {
+		for _, target := range targets {
+			policy.Allow = append(policy.Allow, strings.TrimSpace(target))
+		}
+	}
+	srv := webdial.NewServer(
+		webdial.WithForward("tcp", *forward),
+		webdial.WithForwardPolicy(policy),
+		webdial.WithLogger(slog.Default()))
+	defer srv.Close()
+	fmt.Printf("gateway listening on %s\n", *listen)
+	return http.ListenAndServe(*listen, srv)
+}
@@ -0,0 +1,38 @@
+// Command webdial provides tools for working with webdial endpoints.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: webdial <command> [args]
+
+commands:
+  doctor <url>   probe a webdial endpoint and print a readiness report
+  soak           run a long-lived stability test against an echo endpoint
+  gateway        serve webdial, forwarding conns to TCP with egress controls
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "doctor":
+		err = doctor(args)
+	case "soak":
+		err = soak(args)
+	case "gateway":
+		err = gateway(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "webdial:", err)
+		os.Exit(1)
+	}
+}
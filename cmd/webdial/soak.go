@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/webdial"
+)
+
+// soak keeps many conns busy with random echo traffic for a long time. With
+// no -url it runs its own echo server in-process and, once every conn is
+// closed, fails if goroutines or heap have grown.
+func soak(args []string) error {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	url := fs.String("url", "", "echo endpoint to soak (default: in-process server)")
+	conns := fs.Int("conns", 50, "number of concurrent conns")
+	duration := fs.Duration("duration", time.Hour, "how long to run")
+	interval := fs.Duration("interval", 100*time.Millisecond, "mean delay between writes on each conn")
+	maxSize := fs.Int("max-size", 4096, "maximum payload size")
+	transport := fs.String("transport", "", `force "ws" or "sse"`)
+	report := fs.Duration("report", time.Minute, "interval between progress reports")
+	fs.Parse(args)
+
+	before := goroutines()
+	var srv *webdial.Server
+	var ln net.Listener
+	if *url == "" {
+		var err error
+		srv, ln, err = startEcho()
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		*url = "http://" + ln.Addr().String()
+	}
+	fmt.Printf("soaking %s with %d conns for %s\n", *url, *conns, *duration)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	st := &soakStats{}
+	d := &webdial.Dialer{Transport: *transport}
+	var wg sync.WaitGroup
+	for range *conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			soakConn(ctx, d, *url, *interval, *maxSize, st)
+		}()
+	}
+	var baseHeap uint64
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+	start := time.Now()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			heap := heapAlloc()
+			if baseHeap == 0 {
+				// The first report is taken as warmed up.
+				baseHeap = heap
+			}
+			fmt.Printf("%s: %s goroutines=%d heap=%dKiB\n", time.Since(start).Round(time.Second), st, runtime.NumGoroutine(), heap>>10)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	wg.Wait()
+	fmt.Printf("\ndone: %s\nlatency: %s\n", st, st.percentiles())
+	if st.errors.Load() > 0 {
+		return fmt.Errorf("soak: %d errors, last: %v", st.errors.Load(), st.lastErr.Load())
+	}
+	if srv == nil {
+		return nil
+	}
+	if heap := heapAlloc(); baseHeap > 0 && heap > 2*baseHeap+1<<20 {
+		return fmt.Errorf("soak: heap grew from %dKiB to %dKiB", baseHeap>>10, heap>>10)
+	}
+	srv.Close()
+	ln.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	// Give conn goroutines a moment to observe their closes.
+	deadline := time.Now().Add(5 * time.Second)
+	for goroutines() > before && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if after := goroutines(); after > before {
+		return fmt.Errorf("soak: goroutines grew from %d to %d", before, after)
+	}
+	fmt.Println("no goroutine or heap growth")
+	return nil
+}
+
+func soakConn(ctx context.Context, d *webdial.Dialer, url string, interval time.Duration, maxSize int, st *soakStats) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for ctx.Err() == nil {
+		if conn == nil {
+			c, err := d.DialContext(ctx, url)
+			if err != nil {
+				st.fail(err)
+				time.Sleep(time.Second)
+				continue
+			}
+			conn = c
+		}
+		select {
+		case <-time.After(time.Duration(rand.Int64N(int64(2*interval) + 1))):
+		case <-ctx.Done():
+			return
+		}
+		msg := make([]byte, 1+rand.IntN(maxSize))
+		for i := range msg {
+			msg[i] = byte(rand.Uint32())
+		}
+		start := time.Now()
+		err := echo(conn, msg)
+		if err != nil {
+			if ctx.Err() == nil {
+				st.fail(err)
+			}
+			conn.Close()
+			conn = nil
+			continue
+		}
+		st.record(time.Since(start), len(msg))
+	}
+}
+
+func echo(conn net.Conn, msg []byte) error {
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return errors.New("echo mismatch")
+	}
+	return nil
+}
+
+func startEcho() (*webdial.Server, net.Listener, error) {
+	srv := webdial.NewServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go http.Serve(ln, srv)
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return srv, ln, nil
+}
+
+// latencyBuckets are the upper bounds of the latency histogram.
+var latencyBuckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+type soakStats struct {
+	mu      sync.Mutex
+	counts  [13]int64 // one per bucket plus overflow
+	max     time.Duration
+	echoes  atomic.Int64
+	bytes   atomic.Int64
+	errors  atomic.Int64
+	lastErr atomic.Value // error
+}
+
+func (s *soakStats) record(d time.Duration, n int) {
+	s.echoes.Add(1)
+	s.bytes.Add(int64(n))
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	s.mu.Lock()
+	s.counts[i]++
+	s.max = max(s.max, d)
+	s.mu.Unlock()
+}
+
+func (s *soakStats) fail(err error) {
+	s.errors.Add(1)
+	s.lastErr.Store(err)
+}
+
+func (s *soakStats) String() string {
+	return fmt.Sprintf("echoes=%d bytes=%d errors=%d", s.echoes.Load(), s.bytes.Load(), s.errors.Load())
+}
+
+// percentiles reports the bucket upper bound containing each percentile.
+func (s *soakStats) percentiles() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, c := range s.counts {
+		total += c
+	}
+	if total == 0 {
+		return "no samples"
+	}
+	out := ""
+	for _, p := range []float64{0.5, 0.9, 0.99} {
+		target := int64(p * float64(total))
+		var seen int64
+		for i, c := range s.counts {
+			seen += c
+			if seen > target {
+				bound := "inf"
+				if i < len(latencyBuckets) {
+					bound = "≤" + latencyBuckets[i].String()
+				}
+				out += fmt.Sprintf("p%g%s ", p*100, bound)
+				break
+			}
+		}
+	}
+	return out + "max=" + s.max.Round(time.Microsecond).String()
+}
+
+func goroutines() int {
+	runtime.GC()
+	return runtime.NumGoroutine()
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
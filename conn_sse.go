@@ -4,28 +4,74 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/jpillora/eventsource"
 )
 
 type sseClientConn struct {
-	noopDeadline
-	baseURL    string
-	sessionID  string
-	sseResp    *http.Response
-	decoder    *eventsource.Decoder
-	readBuf    bytes.Buffer
-	writeMu    sync.Mutex
-	client     *http.Client
+	stateTracker
+	connMeta
+	connStats
+	drainSignal
+	baseURL   string
+	sessionID string
+	sseResp   *http.Response
+	decoder   *eventsource.Decoder
+	// unread is what Read hasn't consumed of chunk, a pooled buffer.
+	chunk    *[]byte
+	unread   []byte
+	buffered atomic.Int64
+	// A goroutine decodes the stream into events, so that Read can give
+	// up at the read deadline. readErr is set before events is closed.
+	startRead     sync.Once
+	events        chan *[]byte
+	readErr       error
+	readDeadline  deadline
+	writeDeadline deadline
+	window        *recvWindow // nil unless the server honours ReadWindow
+	writeMu       sync.Mutex
+	client        *http.Client
+	ownsTransport bool // client's transport was built for this conn
+	header        http.Header
+	host          string
+	cancel        context.CancelCauseFunc
+	postTimeout   time.Duration
+	postCtx       context.Context // nil means context.Background
+	onClose       func()
+	maxFrame      int // largest POST body, see writeFrames
+	// Coalesced writes, see Dialer.CoalesceDelay.
+	coalesceDelay time.Duration
+	coalesceSize  int
+	pendMu        sync.Mutex
+	pend          []byte
+	pendTimer     *time.Timer
+	pendErr       error // sticky error from a background POST
+	// Async writes, see Dialer.AsyncWrites. Nil asyncWindow means
+	// synchronous writes.
+	asyncWindow chan struct{}
+	inflight    sync.WaitGroup
+	seq         uint64        // next POST sequence number, guarded by writeMu
+	strict      bool          // see Dialer.StrictOrder
+	postKey     atomic.Uint64 // last POST's idempotency key
+
 	closed     atomic.Bool
+	done       chan struct{} // closed by Close
 	localAddr  addr
 	remoteAddr addr
+	// keepAlive pings with POSTs once SetKeepAlive turns it on.
+	keepAlive     *keepAlive
+	keepAliveOnce sync.Once
 }
 
 func newSSEClientConn(baseURL, sessionID string, sseResp *http.Response, decoder *eventsource.Decoder, client *http.Client) *sseClientConn {
@@ -35,6 +81,9 @@ func newSSEClientConn(baseURL, sessionID string, sseResp *http.Response, decoder
 		sseResp:    sseResp,
 		decoder:    decoder,
 		client:     client,
+		events:     make(chan *[]byte),
+		done:       make(chan struct{}),
+		keepAlive:  newKeepAlive(0),
 		localAddr:  addr{transport: "sse", url: "local"},
 		remoteAddr: addr{transport: "sse", url: baseURL},
 	}
@@ -42,130 +91,870 @@ func newSSEClientConn(baseURL, sessionID string, sseResp *http.Response, decoder
 
 func (c *sseClientConn) Read(b []byte) (int, error) {
 	for {
-		if c.readBuf.Len() > 0 {
-			return c.readBuf.Read(b)
+		if len(c.unread) > 0 {
+			n := copy(b, c.unread)
+			c.unread = c.unread[n:]
+			if len(c.unread) == 0 {
+				putBuffer(c.chunk)
+				c.chunk, c.unread = nil, nil
+			}
+			c.bytesRead.Add(int64(n))
+			c.buffered.Add(-int64(n))
+			if c.window != nil {
+				if credit := c.window.consumed(n); credit > 0 {
+					go c.credit(credit)
+				}
+			}
+			return n, nil
 		}
-		if c.closed.Load() {
+		select {
+		case <-c.done:
+			return 0, io.EOF
+		default:
+		}
+		c.startRead.Do(func() { go c.decode() })
+		select {
+		case chunk, ok := <-c.events:
+			if !ok {
+				if c.readErr == io.EOF {
+					return 0, io.EOF
+				}
+				// Including a *CloseError from the server.
+				return 0, c.recordErr(c.readErr)
+			}
+			if len(*chunk) == 0 {
+				putBuffer(chunk)
+				continue
+			}
+			c.chunk, c.unread = chunk, *chunk
+		case <-c.done:
 			return 0, io.EOF
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
 		}
+	}
+}
+
+// decode reads the event stream, handing data to Read, until it fails or
+// the server closes the conn.
+func (c *sseClientConn) decode() {
+	defer func() {
+		c.end(c.readErr)
+		close(c.events)
+	}()
+	for {
 		var ev eventsource.Event
 		if err := c.decoder.Decode(&ev); err != nil {
-			return 0, err
+			if err == io.EOF {
+				// The stream ended without a close event: the conn
+				// dropped rather than being closed.
+				err = io.ErrUnexpectedEOF
+			}
+			c.readErr = err
+			return
 		}
 		switch ev.Type {
 		case "d":
-			decoded, err := base64.RawStdEncoding.DecodeString(string(ev.Data))
+			chunk := getBuffer(base64.RawStdEncoding.DecodedLen(len(ev.Data)))
+			n, err := base64.RawStdEncoding.Decode(*chunk, ev.Data)
 			if err != nil {
-				return 0, fmt.Errorf("webdial: base64 decode: %w", err)
+				putBuffer(chunk)
+				c.readErr = fmt.Errorf("webdial: base64 decode: %w", err)
+				return
+			}
+			*chunk = (*chunk)[:n]
+			c.framesRead.Add(1)
+			c.buffered.Add(int64(n))
+			select {
+			case c.events <- chunk:
+			case <-c.done:
+				putBuffer(chunk)
+				c.readErr = net.ErrClosed
+				return
 			}
-			c.readBuf.Write(decoded)
+		case drainEvent:
+			c.setDraining()
 		case "close":
+			c.advancePhase(PhaseDraining)
 			c.closed.Store(true)
-			return 0, io.EOF
+			c.readErr = parseClose(string(ev.Data))
+			return
+		}
+	}
+}
+
+// eventLimiter fails reads of an event stream with ErrMessageTooLarge once
+// an event runs past the encoded size of a limit-byte "d" event, before
+// the decoder buffers it all.
+type eventLimiter struct {
+	r      io.Reader
+	limit  int64
+	n      int64 // bytes of the current event
+	prevNL bool  // the last byte ended a line
+	err    error
+}
+
+func newEventLimiter(r io.Reader, limit int64) *eventLimiter {
+	// Room for the base64 data plus the event and data field names.
+	return &eventLimiter{r: r, limit: limit*4/3 + 64}
+}
+
+func (l *eventLimiter) Read(b []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	n, err := l.r.Read(b)
+	for i, c := range b[:n] {
+		switch c {
+		case '\n':
+			if l.prevNL {
+				l.n = 0 // a blank line ends the event
+			}
+			l.prevNL = true
+		case '\r':
+		default:
+			l.prevNL = false
+		}
+		l.n++
+		if l.n > l.limit {
+			// Pass on the events before this one.
+			l.err = ErrMessageTooLarge
+			return i, l.err
 		}
 	}
+	return n, err
 }
 
 func (c *sseClientConn) Write(b []byte) (int, error) {
 	if c.closed.Load() {
-		return 0, io.ErrClosedPipe
+		return 0, net.ErrClosed
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if c.coalesceDelay > 0 {
+		return c.coalesce(b)
 	}
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	url := c.baseURL + "?s=" + c.sessionID
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(b))
+	return writeFrames(b, c.maxFrame, c.send)
+}
+
+// send posts b, or with async writes starts posting a copy of it once the
+// window has room. writeMu must be held, which keeps sequence numbers in
+// the order of the writes.
+func (c *sseClientConn) send(b []byte) error {
+	if c.strict {
+		return c.sendStrict(b)
+	}
+	if c.asyncWindow == nil {
+		return c.post(b, -1)
+	}
+	if err := c.stickyErr(); err != nil {
+		return err
+	}
+	b = bytes.Clone(b)
+	select {
+	case c.asyncWindow <- struct{}{}:
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	}
+	seq := c.seq
+	c.seq++
+	c.inflight.Add(1)
+	go func() {
+		defer c.inflight.Done()
+		if err := c.post(b, int64(seq)); err != nil {
+			c.setStickyErr(err)
+		}
+		<-c.asyncWindow
+	}()
+	return nil
+}
+
+// sendStrict posts b tagged with the next sequence number, once the last
+// POST has been acknowledged. writeMu must be held. A failed POST may have
+// been delivered or not, so to neither lose nor repeat it, its error
+// fails every later write.
+func (c *sseClientConn) sendStrict(b []byte) error {
+	if err := c.stickyErr(); err != nil {
+		return err
+	}
+	if err := c.post(b, int64(c.seq)); err != nil {
+		c.setStickyErr(err)
+		return err
+	}
+	c.seq++
+	return nil
+}
+
+func (c *sseClientConn) stickyErr() error {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+	return c.pendErr
+}
+
+func (c *sseClientConn) setStickyErr(err error) {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+	if c.pendErr == nil {
+		c.pendErr = err
+	}
+}
+
+// coalesce queues b to be sent with other writes in one POST, after
+// coalesceDelay or once coalesceSize bytes are queued.
+func (c *sseClientConn) coalesce(b []byte) (int, error) {
+	c.pendMu.Lock()
+	if err := c.pendErr; err != nil {
+		c.pendMu.Unlock()
+		return 0, err
+	}
+	c.pend = append(c.pend, b...)
+	full := c.coalesceSize > 0 && len(c.pend) >= c.coalesceSize
+	if !full && c.pendTimer == nil {
+		c.pendTimer = time.AfterFunc(c.coalesceDelay, func() { c.Flush() })
+	}
+	c.pendMu.Unlock()
+	if full {
+		if err := c.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends any coalesced writes now and waits for async writes to
+// complete, returning the error of this or any earlier background POST.
+func (c *sseClientConn) Flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err := c.flushLocked()
+	c.inflight.Wait()
+	if err != nil {
+		return err
+	}
+	return c.stickyErr()
+}
+
+// flushLocked is Flush with writeMu held, which keeps POSTs in order.
+func (c *sseClientConn) flushLocked() error {
+	c.pendMu.Lock()
+	b, err := c.pend, c.pendErr
+	c.pend = nil
+	if c.pendTimer != nil {
+		c.pendTimer.Stop()
+		c.pendTimer = nil
+	}
+	c.pendMu.Unlock()
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	if _, err := writeFrames(b, c.maxFrame, c.send); err != nil {
+		c.setStickyErr(err)
+		return err
+	}
+	return nil
+}
+
+// SetKeepAlive turns keep-alive pings on or off, as on a net.TCPConn.
+// They are empty POSTs, which keep proxies from timing out the session
+// while the client has nothing to write; the server keeps the stream
+// alive itself.
+func (c *sseClientConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive.setEnabled(keepalive)
+	c.keepAliveOnce.Do(func() {
+		go c.keepAlive.loop(c.done, func(time.Duration) error {
+			// A failed ping may be transient; the conn's reads and
+			// writes report failures that aren't.
+			c.Ping(context.Background())
+			return nil
+		})
+	})
+	return nil
+}
+
+// SetKeepAlivePeriod sets the interval between keep-alive pings.
+func (c *sseClientConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlive.setPeriod(d)
+	return nil
+}
+
+// Ping measures the round trip of an empty POST, which the server answers
+// without involving the conn.
+func (c *sseClientConn) Ping(ctx context.Context) (time.Duration, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	ctx, cancel := c.postContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.postURL(url.Values{"ping": {"1"}}), nil)
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
+	setHeader(req, c.header)
+	req.Host = c.host
+	c.posts.Add(1)
+	start := time.Now()
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return 0, err
 	}
 	resp.Body.Close()
+	rtt := time.Since(start)
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+	case http.StatusNotFound:
+		return 0, c.recordErr(ErrSessionNotFound)
+	default:
+		return 0, fmt.Errorf("webdial: ping returned %d", resp.StatusCode)
+	}
+	c.observeRTT(rtt)
+	return rtt, nil
+}
+
+// credit lets the server send n more bytes, see Dialer.ReadWindow.
+func (c *sseClientConn) credit(n int64) {
+	if c.closed.Load() {
+		return
+	}
+	ctx, cancel := c.postContext(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.postURL(url.Values{"credit": {strconv.FormatInt(n, 10)}}), nil)
+	if err != nil {
+		return
+	}
+	setHeader(req, c.header)
+	req.Host = c.host
+	c.posts.Add(1)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.recordErr(err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// post sends b in one POST, tagged with seq unless it is negative.
+func (c *sseClientConn) post(b []byte, seq int64) error {
+	parent := c.postCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := c.postContext(parent)
+	defer cancel()
+	deadline := c.writeDeadline.time()
+	if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	params := url.Values{}
+	if seq >= 0 {
+		params.Set("q", strconv.FormatInt(seq, 10))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.postURL(params), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	setHeader(req, c.header)
+	// Makes the POST safe to retry, which http.Transport then does if
+	// the connection drops before the response.
+	req.Header.Set(idempotencyHeader, strconv.FormatUint(c.postKey.Add(1), 10))
+	req.Host = c.host
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.posts.Add(1)
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		return c.recordErr(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return c.recordErr(ErrSessionNotFound)
+	}
 	if resp.StatusCode != http.StatusNoContent {
-		return 0, fmt.Errorf("webdial: post returned %d", resp.StatusCode)
+		return c.recordErr(fmt.Errorf("webdial: post returned %d", resp.StatusCode))
 	}
-	return len(b), nil
+	// Includes the server's time to hand the body to the conn's reader.
+	c.observeRTT(time.Since(start))
+	c.framesWritten.Add(1)
+	c.bytesWritten.Add(int64(len(b)))
+	return nil
 }
 
 func (c *sseClientConn) Close() error {
+	return c.CloseWithError(closeNormal, "")
+}
+
+// CloseWithError is Close, except that the server's reads return a
+// *CloseError carrying code and reason.
+func (c *sseClientConn) CloseWithError(code int, reason string) error {
 	if c.closed.Swap(true) {
+		c.setPhase(PhaseClosed)
 		return nil
 	}
+	c.setPhase(PhaseClosed)
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	url := c.baseURL + "?s=" + c.sessionID + "&close=1"
-	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, url, nil)
+	c.flushLocked()
+	c.inflight.Wait()
+	// Tell the server even if the conn's context was what closed it.
+	ctx, cancel := c.postContext(context.Background())
+	defer cancel()
+	params := url.Values{"close": {"1"}}
+	if data := formatClose(code, reason); data != "" {
+		params.Set("code", strconv.Itoa(code))
+		params.Set("reason", reason)
+	}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.postURL(params), nil)
+	setHeader(req, c.header)
+	req.Host = c.host
+	c.posts.Add(1)
 	resp, err := c.client.Do(req)
 	if err == nil {
 		resp.Body.Close()
 	}
+	if c.cancel != nil {
+		c.cancel(net.ErrClosed)
+	}
+	close(c.done)
 	c.sseResp.Body.Close()
+	if c.ownsTransport {
+		c.client.CloseIdleConnections()
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
 	return nil
 }
 
+// postURL is baseURL, keeping its path and query, plus the session ID and
+// params.
+func (c *sseClientConn) postURL(params url.Values) string {
+	u, _ := url.Parse(c.baseURL) // validated by Dial
+	q := u.Query()
+	q.Set("s", c.sessionID)
+	for k, vs := range params {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *sseClientConn) postContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if c.postTimeout > 0 {
+		return context.WithTimeout(parent, c.postTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// State returns a snapshot of the conn's internal state.
+func (c *sseClientConn) State() ConnState {
+	st := c.snapshot("sse", c.localAddr, c.remoteAddr)
+	st.SessionID = c.sessionID
+	c.annotate(&st)
+	st.ReadBuffered = int(c.buffered.Load())
+	return st
+}
+
+// Unwrap returns the event stream's response.
+func (c *sseClientConn) Unwrap() any { return c.sseResp }
+
 func (c *sseClientConn) LocalAddr() net.Addr  { return c.localAddr }
 func (c *sseClientConn) RemoteAddr() net.Addr { return c.remoteAddr }
 
+func (c *sseClientConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *sseClientConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline bounds the POSTs of later writes, including waiting
+// for room among async writes. Coalesced writes return once queued, so
+// it applies to the POST that sends them instead.
+func (c *sseClientConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
 type sseServerConn struct {
-	noopDeadline
-	sessionID  string
-	w          http.ResponseWriter
-	readPipe   *io.PipeReader
-	writePipe  *io.PipeWriter
-	writeMu    sync.Mutex
+	stateTracker
+	connMeta
+	connStats
+	sessionID string
+	w         http.ResponseWriter
+	readPipe  *pipeReader
+	writePipe *pipeWriter
+	writeMu   sync.Mutex
+	finished  bool // the SSE handler has returned, guarded by writeMu
+	// deadlineMu guards released, which is finished for SetWriteDeadline,
+	// so it needn't wait for a blocked Write.
+	deadlineMu sync.Mutex
+	released   bool
+	pending    atomic.Int64
 	closed     atomic.Bool
 	closeCh    chan struct{}
 	localAddr  addr
 	remoteAddr addr
+	out        *sseOutbox // nil without WithSSEWriteBuffer
+	maxFrame   int        // largest event payload, see writeFrames
+	// sendMu keeps the events of one Write together while it waits for
+	// credit from a client with a read window; window is nil otherwise.
+	sendMu        sync.Mutex
+	window        *sendWindow
+	writeDeadline deadline
+	keepAlive     *keepAlive // heartbeats, run by the SSE handler
 }
 
 func (c *sseServerConn) Read(b []byte) (int, error) {
-	return c.readPipe.Read(b)
+	n, err := c.readPipe.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, c.recordErr(err)
 }
 
+// Write sends b as one event, or as several if it is larger than the max
+// frame size or the client's read window. The events of one Write are
+// never interleaved with those of another.
 func (c *sseServerConn) Write(b []byte) (int, error) {
 	if c.closed.Load() {
-		return 0, io.ErrClosedPipe
+		return 0, net.ErrClosed
 	}
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
-	encoded := base64.RawStdEncoding.EncodeToString(b)
-	err := eventsource.WriteEvent(c.w, eventsource.Event{
-		Type: "d",
-		Data: []byte(encoded),
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return writeFrames(b, c.maxFrame, func(frame []byte) error {
+		if c.window == nil {
+			return c.writeEvent(frame)
+		}
+		for first := true; first || len(frame) > 0; first = false {
+			n, err := c.window.take(len(frame), c.closeCh, c.writeDeadline.wait())
+			if err != nil {
+				return err
+			}
+			if err := c.writeEvent(frame[:n]); err != nil {
+				return err
+			}
+			frame = frame[n:]
+		}
+		return nil
 	})
-	if err != nil {
-		return 0, err
+}
+
+// writeEvent sends b as a "d" event, queueing it with WithSSEWriteBuffer.
+func (c *sseServerConn) writeEvent(b []byte) error {
+	encoded := getBuffer(base64.RawStdEncoding.EncodedLen(len(b)))
+	defer putBuffer(encoded)
+	base64.RawStdEncoding.Encode(*encoded, b)
+	ev := eventsource.Event{Type: "d", Data: *encoded}
+	if c.out != nil {
+		var buf bytes.Buffer
+		eventsource.WriteEvent(&buf, ev)
+		if err := c.out.put(buf.Bytes()); err != nil {
+			return c.recordErr(err)
+		}
+	} else {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if c.finished {
+			return net.ErrClosed
+		}
+		if err := eventsource.WriteEvent(c.w, ev); err != nil {
+			return c.recordErr(err)
+		}
 	}
-	return len(b), nil
+	c.framesWritten.Add(1)
+	c.bytesWritten.Add(int64(len(b)))
+	return nil
+}
+
+// SetKeepAlive turns heartbeat events on or off, as on a net.TCPConn,
+// overriding Server.KeepAlive.
+func (c *sseServerConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive.setEnabled(keepalive)
+	return nil
+}
+
+// SetKeepAlivePeriod sets the interval between heartbeat events.
+func (c *sseServerConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlive.setPeriod(d)
+	return nil
 }
 
 func (c *sseServerConn) writeHeartbeat() error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	if c.closed.Load() {
-		return io.ErrClosedPipe
+	if c.closed.Load() || c.finished {
+		return net.ErrClosed
 	}
 	return eventsource.WriteEvent(c.w, eventsource.Event{Type: "ping"})
 }
 
+// goingAway tells the client the server is shutting down.
+func (c *sseServerConn) goingAway() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed.Load() || c.finished {
+		return net.ErrClosed
+	}
+	return eventsource.WriteEvent(c.w, eventsource.Event{Type: drainEvent})
+}
+
 func (c *sseServerConn) Close() error {
+	return c.CloseWithError(closeNormal, "")
+}
+
+// CloseWithError is Close, except that the client's reads return a
+// *CloseError carrying code and reason.
+func (c *sseServerConn) CloseWithError(code int, reason string) error {
 	if c.closed.Swap(true) {
 		return nil
 	}
-	c.writeMu.Lock()
-	eventsource.WriteEvent(c.w, eventsource.Event{Type: "close"})
-	c.writeMu.Unlock()
+	c.advancePhase(PhaseDraining)
+	ev := eventsource.Event{Type: "close", Data: []byte(formatClose(code, reason))}
+	if c.out != nil {
+		// The close event goes out after whatever is buffered.
+		var buf bytes.Buffer
+		eventsource.WriteEvent(&buf, ev)
+		c.out.closeWith(buf.Bytes())
+	} else {
+		c.writeMu.Lock()
+		if !c.finished {
+			eventsource.WriteEvent(c.w, ev)
+		}
+		c.writeMu.Unlock()
+	}
 	c.readPipe.Close()
 	close(c.closeCh)
+	c.setPhase(PhaseClosed)
 	return nil
 }
 
+// closedByClient closes the conn for a client that closed its end, so
+// that reads return what the client's code and reason map to.
+func (c *sseServerConn) closedByClient(code int, reason string) error {
+	err := peerClosed(code, reason)
+	c.end(err)
+	c.writePipe.CloseWithError(err)
+	return c.Close()
+}
+
+// State returns a snapshot of the conn's internal state. ReadBuffered
+// counts posted bytes still waiting to be read.
+func (c *sseServerConn) State() ConnState {
+	st := c.snapshot("sse", c.localAddr, c.remoteAddr)
+	st.SessionID = c.sessionID
+	c.annotate(&st)
+	st.ReadBuffered = int(c.pending.Load())
+	return st
+}
+
+// finish marks the response as complete, the ResponseWriter must not be
+// used once the handler returns.
+func (c *sseServerConn) finish() {
+	c.deadlineMu.Lock()
+	c.released = true
+	c.deadlineMu.Unlock()
+	c.writeMu.Lock()
+	c.finished = true
+	c.writeMu.Unlock()
+}
+
+// Unwrap returns the event stream's http.ResponseWriter.
+func (c *sseServerConn) Unwrap() any { return c.w }
+
 func (c *sseServerConn) LocalAddr() net.Addr  { return c.localAddr }
 func (c *sseServerConn) RemoteAddr() net.Addr { return c.remoteAddr }
 
+func (c *sseServerConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bounds how long Read waits for a POST.
+func (c *sseServerConn) SetReadDeadline(t time.Time) error {
+	c.readPipe.SetReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline applies to the event stream's HTTP connection, so a
+// write that times out leaves the stream broken. It also bounds waiting
+// for a client's read window, which doesn't.
+func (c *sseServerConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.released {
+		return net.ErrClosed
+	}
+	err := http.NewResponseController(c.w).SetWriteDeadline(t)
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// sseOutbox buffers a server conn's events for a client that can't keep
+// up, so Write only blocks once the buffer is full. A single writer
+// goroutine drains it, flushing once per batch.
+type sseOutbox struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer // encoded events
+	limit  int
+	delay  time.Duration // time to gather a batch before flushing
+	closed bool          // no more events may be queued
+	done   chan struct{} // closed when the writer returns
+}
+
+func newSSEOutbox(limit int, delay time.Duration) *sseOutbox {
+	o := &sseOutbox{limit: limit, delay: delay, done: make(chan struct{})}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// put queues an encoded event, waiting while the buffer is full. An event
+// larger than the whole buffer is queued once the buffer is empty.
+func (o *sseOutbox) put(ev []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for !o.closed && o.buf.Len() > 0 && o.buf.Len()+len(ev) > o.limit {
+		o.cond.Wait()
+	}
+	if o.closed {
+		return net.ErrClosed
+	}
+	o.buf.Write(ev)
+	o.cond.Broadcast()
+	return nil
+}
+
+// closeWith queues a final event, if any, and stops further puts. The
+// writer returns once it has written everything queued.
+func (o *sseOutbox) closeWith(ev []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.closed {
+		o.buf.Write(ev)
+		o.closed = true
+	}
+	o.cond.Broadcast()
+}
+
+// run writes batches of events to c's stream until closed and drained,
+// or until a write fails.
+func (o *sseOutbox) run(c *sseServerConn) {
+	defer close(o.done)
+	rc := http.NewResponseController(c.w)
+	for {
+		o.mu.Lock()
+		for o.buf.Len() == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if o.buf.Len() == 0 {
+			o.mu.Unlock()
+			return
+		}
+		if o.delay > 0 && !o.closed {
+			o.mu.Unlock()
+			time.Sleep(o.delay)
+			o.mu.Lock()
+		}
+		batch := bytes.Clone(o.buf.Bytes())
+		o.buf.Reset()
+		o.cond.Broadcast()
+		o.mu.Unlock()
+
+		c.writeMu.Lock()
+		err := net.ErrClosed
+		if !c.finished {
+			_, err = c.w.Write(batch)
+			if err == nil {
+				err = rc.Flush()
+			}
+		}
+		c.writeMu.Unlock()
+		if err != nil {
+			c.recordErr(err)
+			o.mu.Lock()
+			o.closed = true
+			o.buf.Reset()
+			o.cond.Broadcast()
+			o.mu.Unlock()
+			return
+		}
+	}
+}
+
 type sseSession struct {
 	conn *sseServerConn
+	idle *idleWatch // nil without WithSessionIdleTimeout
+	// binding is the WithSessionBinding key of the opening request.
+	binding string
+
+	// Sequenced POSTs from clients with async writes, which may arrive
+	// out of order.
+	seqMu   sync.Mutex
+	seqCond *sync.Cond
+	nextSeq uint64
+
+	// Recent POSTs by idempotency key, oldest first in postKeys, so
+	// retries aren't delivered twice.
+	postMu   sync.Mutex
+	posted   map[string]*postResult
+	postKeys []string
+}
+
+// maxSeqAhead bounds how far ahead of the next expected POST a sequenced
+// POST may be, and so how many can be waiting for their turn.
+const maxSeqAhead = 1024
+
+var errSeqOutOfWindow = errors.New("webdial: post sequence out of window")
+
+// idempotencyHeader carries a POST's idempotency key, see Session.Post.
+const idempotencyHeader = "Idempotency-Key"
+
+func newSSESession(conn *sseServerConn) *sseSession {
+	sess := &sseSession{conn: conn}
+	sess.seqCond = sync.NewCond(&sess.seqMu)
+	return sess
+}
+
+// Write delivers posted bytes to the conn's reader.
+func (s *sseSession) Write(b []byte) (int, error) {
+	s.conn.pending.Add(int64(len(b)))
+	n, err := s.conn.writePipe.Write(b)
+	s.conn.pending.Add(-int64(len(b)))
+	return n, err
+}
+
+// inOrder calls fn once every POST before seq has been delivered,
+// returning its error, or returns early if ctx is done first.
+func (s *sseSession) inOrder(ctx context.Context, seq uint64, fn func() error) error {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	if seq < s.nextSeq || seq-s.nextSeq > maxSeqAhead {
+		return errSeqOutOfWindow
+	}
+	stop := context.AfterFunc(ctx, func() {
+		s.seqMu.Lock()
+		s.seqCond.Broadcast()
+		s.seqMu.Unlock()
+	})
+	defer stop()
+	for s.nextSeq != seq {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.seqCond.Wait()
+	}
+	err := fn()
+	s.nextSeq++
+	s.seqCond.Broadcast()
+	return err
 }
@@ -1,60 +1,213 @@
 package webdial
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type wsConn struct {
-	ws        *websocket.Conn
-	reader    io.Reader
-	mu        sync.Mutex
-	done      chan struct{}
-	closeOnce sync.Once
+	stateTracker
+	connMeta
+	connStats
+	drainSignal
+	ws          *websocket.Conn
+	reader      io.Reader
+	mu          sync.Mutex
+	done        chan struct{}
+	closeOnce   sync.Once
+	onClose     func()
+	keepAlive   *keepAlive
+	pongTimeout time.Duration
+	lastPong    atomic.Int64 // unix nanos
+	timedOut    atomic.Bool  // closed by the keep-alive
+	pingMu      sync.Mutex
+	pingWait    map[int64]chan time.Time // Ping calls by ping send time
+	maxFrame    int                      // see writeFrames
+	// Flow control, see Dialer.ReadWindow; nil windows without it. With
+	// it, pump reads the socket into inbox, so that credit from the peer
+	// arrives whether or not the conn is being read, and the peer's
+	// window bounds inbox.
+	sendWin       *sendWindow
+	recvWin       *recvWindow
+	inbox         *wsInbox
+	readDeadline  deadline
+	writeDeadline deadline
+	// writeMu serializes writes, as gorilla allows only one writer, and
+	// keeps the messages of one Write together.
+	writeMu sync.Mutex
+	// writeTimeout bounds each message write, see Dialer.WriteTimeout.
+	writeTimeout time.Duration
+	queue        *wsQueue // nil without Dialer.WriteQueue
+	remoteAddr   net.Addr // overrides the socket's, see WithTrustedProxies
 }
 
-func newWSConn(ws *websocket.Conn, keepAlive time.Duration) net.Conn {
+// errWindowOverrun fails conns whose peer sent more than its credit.
+var errWindowOverrun = errors.New("webdial: peer overran the flow control window")
+
+// creditPrefix marks the pings that grant flow control credit, as opposed
+// to keep-alive pings, which carry a timestamp.
+const creditPrefix = "c"
+
+// errPongTimeout isn't a timeout to callers: the conn is dead, not slow.
+var errPongTimeout = errors.New("webdial: keep-alive pong timeout")
+
+// newWSConn wraps ws, pinging every keepAlive if it is positive. A
+// positive pongTimeout closes the conn when pongs stop arriving; pongs are
+// only seen while the conn is being read.
+func newWSConn(ws *websocket.Conn, keepAlive, pongTimeout time.Duration) *wsConn {
 	c := &wsConn{
-		ws:   ws,
-		done: make(chan struct{}),
-	}
-	if keepAlive >= 0 {
-		go c.pingLoop(keepAlive)
+		ws:          ws,
+		done:        make(chan struct{}),
+		keepAlive:   newKeepAlive(keepAlive),
+		pongTimeout: pongTimeout,
 	}
+	c.lastPong.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(data string) error {
+		now := time.Now()
+		c.lastPong.Store(now.UnixNano())
+		// Our pings carry their send time.
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			c.observeRTT(now.Sub(time.Unix(0, sent)))
+			c.pingMu.Lock()
+			if ch, ok := c.pingWait[sent]; ok {
+				ch <- now
+				delete(c.pingWait, sent)
+			}
+			c.pingMu.Unlock()
+		}
+		return nil
+	})
+	ws.SetPingHandler(c.handlePing)
+	go c.keepAlive.loop(c.done, c.keepAlivePing)
 	return c
 }
 
-func (c *wsConn) pingLoop(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
-				return
-			}
-		case <-c.done:
-			return
+// startFlowControl windows the conn: the peer grants send bytes to start
+// with, and may send recv bytes ahead of Read.
+func (c *wsConn) startFlowControl(send, recv int64) {
+	c.sendWin = newSendWindow(send)
+	c.recvWin = &recvWindow{size: recv}
+	c.inbox = &wsInbox{ready: make(chan struct{}, 1)}
+	go c.pump()
+}
+
+// handlePing takes flow control credit and drain notices from the peer's
+// pings, and answers them.
+func (c *wsConn) handlePing(data string) error {
+	if credit, ok := strings.CutPrefix(data, creditPrefix); ok {
+		if n, ok := parseWindow(credit); ok && c.sendWin != nil {
+			c.sendWin.grant(n)
 		}
+	} else if data == drainPing {
+		c.setDraining()
+	}
+	// As gorilla's default handler does.
+	err := c.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+	if _, ok := err.(net.Error); ok || err == websocket.ErrCloseSent {
+		return nil
+	}
+	return err
+}
+
+// keepAlivePing pings the peer, first closing the conn if the last ping
+// went unanswered for longer than the pong timeout.
+func (c *wsConn) keepAlivePing(interval time.Duration) error {
+	if c.pongTimeout > 0 && time.Since(time.Unix(0, c.lastPong.Load())) > interval+c.pongTimeout {
+		c.timedOut.Store(true)
+		c.close()
+		return errPongTimeout
+	}
+	return c.writePing(time.Now())
+}
+
+// SetKeepAlive turns keep-alive pings on or off, as on a net.TCPConn,
+// overriding the Dialer's or Server's setting.
+func (c *wsConn) SetKeepAlive(keepalive bool) error {
+	if keepalive {
+		// Don't time out for the pongs missed while off.
+		c.lastPong.Store(time.Now().UnixNano())
+	}
+	c.keepAlive.setEnabled(keepalive)
+	return nil
+}
+
+// SetKeepAlivePeriod sets the interval between keep-alive pings.
+func (c *wsConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlive.setPeriod(d)
+	return nil
+}
+
+// writePing sends a ping carrying its send time, for the pong handler to
+// measure the round trip.
+func (c *wsConn) writePing(now time.Time) error {
+	return c.ws.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(now.UnixNano(), 10)), now.Add(10*time.Second))
+}
+
+// Ping measures the round trip of a WebSocket ping. The pong is only seen
+// while the conn is being read.
+func (c *wsConn) Ping(ctx context.Context) (time.Duration, error) {
+	sent := time.Now()
+	ch := make(chan time.Time, 1)
+	c.pingMu.Lock()
+	if c.pingWait == nil {
+		c.pingWait = map[int64]chan time.Time{}
+	}
+	c.pingWait[sent.UnixNano()] = ch
+	c.pingMu.Unlock()
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pingWait, sent.UnixNano())
+		c.pingMu.Unlock()
+	}()
+	if err := c.writePing(sent); err != nil {
+		return 0, c.recordErr(err)
+	}
+	select {
+	case recv := <-ch:
+		return recv.Sub(sent), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
 }
 
 func (c *wsConn) Read(b []byte) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.inbox != nil {
+		return c.readInbox(b)
+	}
 	for {
 		if c.reader == nil {
 			_, r, err := c.ws.NextReader()
 			if err != nil {
-				return 0, err
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					c.advancePhase(PhaseDraining)
+				}
+				if c.timedOut.Load() {
+					err = errPongTimeout
+				}
+				err = readLimitErr(wsCloseErr(err))
+				c.end(err)
+				return 0, c.recordErr(err)
 			}
 			c.reader = r
+			c.framesRead.Add(1)
 		}
 		n, err := c.reader.Read(b)
+		c.bytesRead.Add(int64(n))
 		if err == io.EOF {
 			c.reader = nil
 			if n > 0 {
@@ -62,39 +215,361 @@ func (c *wsConn) Read(b []byte) (int, error) {
 			}
 			continue
 		}
-		return n, err
+		return n, c.recordErr(readLimitErr(err))
+	}
+}
+
+// pump reads messages into the inbox until the conn fails.
+func (c *wsConn) pump() {
+	for {
+		_, r, err := c.ws.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.advancePhase(PhaseDraining)
+			}
+			if c.timedOut.Load() {
+				err = errPongTimeout
+			}
+			err = readLimitErr(wsCloseErr(err))
+			c.end(err)
+			c.inbox.fail(c.recordErr(err))
+			return
+		}
+		c.framesRead.Add(1)
+		if err := c.fill(r); err != nil {
+			c.inbox.fail(c.recordErr(err))
+			c.ws.Close()
+			return
+		}
+	}
+}
+
+// fill copies a message into the inbox, checking it is within the credit
+// the peer has left.
+func (c *wsConn) fill(r io.Reader) error {
+	room := c.recvWin.size - int64(c.inbox.buffered())
+	buf := getBuffer(32 << 10)
+	defer putBuffer(buf)
+	for {
+		n, err := r.Read(*buf)
+		if room -= int64(n); room < 0 {
+			return errWindowOverrun
+		}
+		c.inbox.put((*buf)[:n])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return readLimitErr(err)
+		}
 	}
 }
 
+// readInbox is Read with flow control. c.mu must be held.
+func (c *wsConn) readInbox(b []byte) (int, error) {
+	for {
+		n, err := c.inbox.read(b)
+		if n > 0 {
+			c.bytesRead.Add(int64(n))
+			if credit := c.recvWin.consumed(n); credit > 0 {
+				// Not here, as writing could block reading.
+				go c.grant(credit)
+			}
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-c.inbox.ready:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// grant lets the peer send n more bytes.
+func (c *wsConn) grant(n int64) {
+	msg := creditPrefix + strconv.FormatInt(n, 10)
+	c.ws.WriteControl(websocket.PingMessage, []byte(msg), time.Now().Add(10*time.Second))
+}
+
+// wsInbox holds the messages pump has read until Read takes them.
+type wsInbox struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	err   error
+	ready chan struct{} // signalled when data or err arrives
+}
+
+func (in *wsInbox) put(b []byte) {
+	in.mu.Lock()
+	in.buf.Write(b)
+	in.mu.Unlock()
+	signal(in.ready)
+}
+
+func (in *wsInbox) fail(err error) {
+	in.mu.Lock()
+	in.err = err
+	in.mu.Unlock()
+	signal(in.ready)
+}
+
+// read takes buffered data, or returns the error once it has all been
+// read.
+func (in *wsInbox) read(b []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.buf.Len() > 0 {
+		return in.buf.Read(b)
+	}
+	return 0, in.err
+}
+
+func (in *wsInbox) buffered() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.buf.Len()
+}
+
+// readLimitErr reports gorilla's read limit error as ErrMessageTooLarge.
+func readLimitErr(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return ErrMessageTooLarge
+	}
+	return err
+}
+
+// Write sends b as one binary message, or as several if it is larger than
+// the max frame size or the peer's flow control window. It is safe to call
+// from several goroutines, as on a net.TCPConn. With a write queue it
+// returns once b is queued.
 func (c *wsConn) Write(b []byte) (int, error) {
-	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
-	if err != nil {
+	if c.queue != nil {
+		return c.enqueue(b)
+	}
+	return c.write(b)
+}
+
+func (c *wsConn) write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.sendWin == nil {
+		return writeFrames(b, c.maxFrame, c.writeMessage)
+	}
+	return writeFrames(b, c.maxFrame, func(frame []byte) error {
+		for first := true; first || len(frame) > 0; first = false {
+			n, err := c.sendWin.take(len(frame), c.done, c.writeDeadline.wait())
+			if err != nil {
+				return err
+			}
+			if err := c.writeMessage(frame[:n]); err != nil {
+				return err
+			}
+			frame = frame[n:]
+		}
+		return nil
+	})
+}
+
+func (c *wsConn) writeMessage(b []byte) error {
+	if c.writeTimeout > 0 {
+		deadline := time.Now().Add(c.writeTimeout)
+		if t := c.writeDeadline.time(); !t.IsZero() && t.Before(deadline) {
+			deadline = t
+		}
+		c.ws.SetWriteDeadline(deadline)
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return c.recordErr(err)
+	}
+	c.framesWritten.Add(1)
+	c.bytesWritten.Add(int64(len(b)))
+	return nil
+}
+
+// wsQueue holds writes for drain to send, see Dialer.WriteQueue.
+type wsQueue struct {
+	writes chan queuedWrite
+	mu     sync.Mutex
+	err    error // the first failed write
+}
+
+// queuedWrite is a copy of a Write's data, or, with flushed set, a marker
+// that Flush waits for.
+type queuedWrite struct {
+	b       *[]byte
+	flushed chan struct{}
+}
+
+// startWriteQueue queues up to n writes.
+func (c *wsConn) startWriteQueue(n int) {
+	c.queue = &wsQueue{writes: make(chan queuedWrite, n)}
+	go c.drain()
+}
+
+// enqueue copies b into the queue, waiting while it is full.
+func (c *wsConn) enqueue(b []byte) (int, error) {
+	if err := c.queue.failed(); err != nil {
+		return 0, err
+	}
+	buf := getBuffer(len(b))
+	copy(*buf, b)
+	if err := c.put(queuedWrite{b: buf}); err != nil {
+		putBuffer(buf)
 		return 0, err
 	}
 	return len(b), nil
 }
 
+func (c *wsConn) put(w queuedWrite) error {
+	select {
+	case c.queue.writes <- w:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// drain sends queued writes until the conn is closed. Once one fails the
+// rest are dropped, the error going to the next Write or Flush.
+func (c *wsConn) drain() {
+	for {
+		select {
+		case w := <-c.queue.writes:
+			if w.flushed != nil {
+				close(w.flushed)
+				continue
+			}
+			if c.queue.failed() == nil {
+				if _, err := c.write(*w.b); err != nil {
+					c.queue.fail(err)
+				}
+			}
+			putBuffer(w.b)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Flush waits for queued writes to be sent, returning the first error from
+// sending them. It is a no-op without a write queue.
+func (c *wsConn) Flush() error {
+	if c.queue == nil {
+		return nil
+	}
+	flushed := make(chan struct{})
+	if err := c.put(queuedWrite{flushed: flushed}); err != nil {
+		return err
+	}
+	select {
+	case <-flushed:
+		return c.queue.failed()
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
+
+func (q *wsQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *wsQueue) failed() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Close sends any queued writes, then closes the conn with a normal
+// closure, which the peer reads as io.EOF.
 func (c *wsConn) Close() error {
+	return c.CloseWithError(closeNormal, "")
+}
+
+// CloseWithError sends any queued writes, then closes the conn with a
+// close frame carrying code and reason, which the peer reads as a
+// *CloseError. Reasons are cut to fit the frame.
+func (c *wsConn) CloseWithError(code int, reason string) error {
+	if c.queue != nil {
+		c.Flush()
+	}
+	// Ahead of the peer's reply to the close frame.
+	c.end(net.ErrClosed)
+	msg := websocket.FormatCloseMessage(code, truncateReason(reason))
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	return c.close()
+}
+
+// goingAway tells the client the server is shutting down.
+func (c *wsConn) goingAway() error {
+	return c.ws.WriteControl(websocket.PingMessage, []byte(drainPing), time.Now().Add(closeTimeout))
+}
+
+// closeTimeout bounds sending the close frame to a peer that isn't
+// reading.
+const closeTimeout = time.Second
+
+// close closes the conn without waiting for queued writes.
+func (c *wsConn) close() error {
 	c.closeOnce.Do(func() {
+		c.setPhase(PhaseClosed)
 		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
 	})
 	return c.ws.Close()
 }
 
-func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
-func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+// State returns a snapshot of the conn's internal state.
+func (c *wsConn) State() ConnState {
+	st := c.snapshot("ws", c.LocalAddr(), c.RemoteAddr())
+	c.annotate(&st)
+	return st
+}
+
+// Unwrap returns the *websocket.Conn.
+func (c *wsConn) Unwrap() any { return c.ws }
+
+func (c *wsConn) LocalAddr() net.Addr { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.ws.RemoteAddr()
+}
 
 func (c *wsConn) SetDeadline(t time.Time) error {
-	if err := c.ws.SetReadDeadline(t); err != nil {
+	if err := c.SetReadDeadline(t); err != nil {
 		return err
 	}
-	return c.ws.SetWriteDeadline(t)
+	return c.SetWriteDeadline(t)
 }
 
+// SetReadDeadline is the socket's read deadline, except with flow control,
+// where it bounds waiting for pump and leaves the conn usable.
 func (c *wsConn) SetReadDeadline(t time.Time) error {
+	if c.inbox != nil {
+		c.readDeadline.set(t)
+		return nil
+	}
 	return c.ws.SetReadDeadline(t)
 }
 
+// SetWriteDeadline is the socket's write deadline. With a write timeout
+// each write sets the socket's deadline itself, to the earlier of the two.
 func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	if c.writeTimeout > 0 {
+		return nil
+	}
 	return c.ws.SetWriteDeadline(t)
 }
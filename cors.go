@@ -0,0 +1,78 @@
+package webdial
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy lets browser clients on other origins use the SSE transport,
+// whose event stream and POSTs are ordinary cross-origin requests.
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins allowed to connect, e.g.
+	// "https://app.example.com", or "*" for any.
+	AllowedOrigins []string
+	// AllowCredentials lets browsers send cookies and HTTP auth. The
+	// allowed origin is then echoed back rather than "*".
+	AllowCredentials bool
+	// AllowHeaders lists request headers allowed beyond those webdial
+	// clients send, e.g. "Authorization".
+	AllowHeaders []string
+	// MaxAge is how long browsers may cache a preflight. Zero leaves it
+	// to the browser.
+	MaxAge time.Duration
+}
+
+// WithCORS answers preflights and adds CORS headers to responses for the
+// origins p allows. It doesn't affect WebSocket origin checks, see
+// WithAllowedOrigins.
+func WithCORS(p CORSPolicy) ServerOption {
+	return func(s *Server) { s.cors = &p }
+}
+
+// handle adds CORS headers to the response, reporting whether r was a
+// preflight it has answered.
+func (p *CORSPolicy) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	allowed := p.allowed(origin)
+	if !allowed {
+		if preflight {
+			writeError(w, http.StatusForbidden, "webdial: origin not allowed", "")
+		}
+		return preflight
+	}
+	if slices.Contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		h.Set("Access-Control-Expose-Headers", versionHeader+", Retry-After")
+		return false
+	}
+	headers := append([]string{"Content-Type", versionHeader, targetHeader, metadataHeader}, p.AllowHeaders...)
+	h.Set("Access-Control-Allow-Methods", "GET, POST")
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (p *CORSPolicy) allowed(origin string) bool {
+	return slices.ContainsFunc(p.AllowedOrigins, func(o string) bool {
+		return o == "*" || strings.EqualFold(o, origin)
+	})
+}
@@ -0,0 +1,201 @@
+package webdial
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadline is a resettable deadline, as in net.Pipe: wait returns a
+// channel that is closed once the deadline has passed. The zero value has
+// no deadline.
+type deadline struct {
+	mu     sync.Mutex
+	t      time.Time
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer to close it
+	}
+	d.timer = nil
+	d.t = t
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+// time returns the deadline, zero if there is none.
+func (d *deadline) time() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.t
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// newPipe is io.Pipe with a read deadline: reads block until a write
+// arrives, and each write blocks until reads have taken all of it. Closed
+// pipes fail with net.ErrClosed rather than io.ErrClosedPipe, as conns do.
+func newPipe() (*pipeReader, *pipeWriter) {
+	p := &pipe{
+		wrCh: make(chan []byte),
+		rdCh: make(chan int),
+		done: make(chan struct{}),
+	}
+	return &pipeReader{p}, &pipeWriter{p}
+}
+
+type pipe struct {
+	wrMu sync.Mutex // serializes writes
+	wrCh chan []byte
+	rdCh chan int
+
+	once     sync.Once
+	done     chan struct{}
+	errMu    sync.Mutex
+	rerr     error  // why the read side closed
+	werr     error  // why the write side closed
+	first    *error // the side that closed first
+	deadline deadline
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, p.readCloseError()
+	case <-p.deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	select {
+	case bw := <-p.wrCh:
+		nr := copy(b, bw)
+		p.rdCh <- nr
+		return nr, nil
+	case <-p.done:
+		return 0, p.readCloseError()
+	case <-p.deadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *pipe) write(b []byte) (n int, err error) {
+	select {
+	case <-p.done:
+		return 0, p.writeCloseError()
+	default:
+		p.wrMu.Lock()
+		defer p.wrMu.Unlock()
+	}
+	for once := true; once || len(b) > 0; once = false {
+		select {
+		case p.wrCh <- b:
+			nw := <-p.rdCh
+			b = b[nw:]
+			n += nw
+		case <-p.done:
+			return n, p.writeCloseError()
+		}
+	}
+	return n, nil
+}
+
+func (p *pipe) closeWith(side *error, err error) {
+	p.errMu.Lock()
+	if *side == nil {
+		*side = err
+	}
+	if p.first == nil {
+		p.first = side
+	}
+	p.errMu.Unlock()
+	p.once.Do(func() { close(p.done) })
+}
+
+func (p *pipe) readCloseError() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.first == &p.werr {
+		return p.werr
+	}
+	return net.ErrClosed
+}
+
+func (p *pipe) writeCloseError() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	if p.first == &p.rerr {
+		return p.rerr
+	}
+	return net.ErrClosed
+}
+
+type pipeReader struct{ p *pipe }
+
+func (r *pipeReader) Read(b []byte) (int, error) { return r.p.read(b) }
+
+// Close closes the read side, failing writes with net.ErrClosed.
+func (r *pipeReader) Close() error {
+	r.p.closeWith(&r.p.rerr, net.ErrClosed)
+	return nil
+}
+
+func (r *pipeReader) SetReadDeadline(t time.Time) {
+	r.p.deadline.set(t)
+}
+
+type pipeWriter struct{ p *pipe }
+
+func (w *pipeWriter) Write(b []byte) (int, error) { return w.p.write(b) }
+
+// Close closes the write side, so reads return io.EOF.
+func (w *pipeWriter) Close() error {
+	return w.CloseWithError(io.EOF)
+}
+
+// CloseWithError closes the write side, so reads return err.
+func (w *pipeWriter) CloseWithError(err error) error {
+	w.p.closeWith(&w.p.werr, err)
+	return nil
+}
@@ -0,0 +1,78 @@
+package webdial
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainPing is the WebSocket ping, and drainEvent the SSE event, telling
+// a client the server is shutting down.
+const (
+	drainPing  = "drain"
+	drainEvent = "drain"
+)
+
+// Shutdown shuts the server down gracefully. New handshakes are turned
+// away with 503 and Retry-After, and every live conn is told the server
+// is going away, which its client sees as Conn.Draining, so that it can
+// finish what it's doing and reconnect elsewhere. Shutdown then waits for
+// the conns to close, until ctx is done, when it closes the rest as Close
+// does and returns ctx's error. Like the HTTP server, the Server is done
+// with afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		s.shuttingDown.Store(true)
+		s.logger.Info("shutting down, draining conns", slog.Int64("conns", s.live.Load()))
+		s.conns.Range(func(key, _ any) bool {
+			go key.(interface{ goingAway() error }).goingAway()
+			return true
+		})
+	})
+	const maxPoll = 500 * time.Millisecond
+	poll := time.Millisecond
+	timer := time.NewTimer(poll)
+	defer timer.Stop()
+	for s.live.Load() > 0 {
+		select {
+		case <-timer.C:
+			poll = min(2*poll, maxPoll)
+			timer.Reset(poll)
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+	return s.Close()
+}
+
+// rejectShutdown turns away handshakes once Shutdown has begun.
+func (s *Server) rejectShutdown(w http.ResponseWriter, r *http.Request) bool {
+	if !s.shuttingDown.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	s.reject(w, r, http.StatusServiceUnavailable, "webdial: server shutting down", "")
+	return true
+}
+
+// drainSignal is closed when the server says it is going away.
+type drainSignal struct {
+	once      sync.Once
+	ch        chan struct{}
+	closeOnce sync.Once
+}
+
+// Draining returns a channel closed once the server has said it is
+// shutting down, see Server.Shutdown.
+func (d *drainSignal) Draining() <-chan struct{} {
+	d.once.Do(func() { d.ch = make(chan struct{}) })
+	return d.ch
+}
+
+func (d *drainSignal) setDraining() {
+	d.Draining()
+	d.closeOnce.Do(func() { close(d.ch) })
+}
@@ -0,0 +1,113 @@
+package webdial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EgressPolicy restricts the outbound connections made when forwarding
+// webdial conns to other destinations, so a gateway can't be turned into
+// a general purpose tunnel (e.g. for reverse shells). The zero value
+// allows everything; the webdial gateway command enables one by default.
+type EgressPolicy struct {
+	// AllowPorts lists the destination ports that may be dialed.
+	// Empty means any port.
+	AllowPorts []int
+	// MaxDuration caps how long a forwarded connection may stay open.
+	// Zero means no cap.
+	MaxDuration time.Duration
+	// Audit, if set, is called for every dial attempt and every close.
+	Audit func(EgressEvent)
+	// Dialer dials permitted destinations. Nil means a zero net.Dialer.
+	Dialer *net.Dialer
+}
+
+// EgressEvent describes one outbound dial attempt or close.
+type EgressEvent struct {
+	Network string
+	Address string
+	// Allowed is false when the policy denied the dial.
+	Allowed bool
+	// Err is the denial or dial error, if any.
+	Err error
+	// Closed is true for the event emitted when the connection closes,
+	// in which case Duration is how long it was open.
+	Closed   bool
+	Duration time.Duration
+}
+
+// DialContext dials address if the policy permits it. The returned conn is
+// closed once MaxDuration elapses.
+func (p *EgressPolicy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := p.check(address); err != nil {
+		p.audit(EgressEvent{Network: network, Address: address, Err: err})
+		return nil, err
+	}
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	p.audit(EgressEvent{Network: network, Address: address, Allowed: true, Err: err})
+	if err != nil {
+		return nil, err
+	}
+	c := &egressConn{Conn: conn, policy: p, network: network, address: address, start: time.Now()}
+	if p.MaxDuration > 0 {
+		c.timer = time.AfterFunc(p.MaxDuration, func() { c.Close() })
+	}
+	return c, nil
+}
+
+func (p *EgressPolicy) check(address string) error {
+	if len(p.AllowPorts) == 0 {
+		return nil
+	}
+	_, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || !slices.Contains(p.AllowPorts, port) {
+		return fmt.Errorf("webdial: egress to port %s not allowed", portStr)
+	}
+	return nil
+}
+
+func (p *EgressPolicy) audit(ev EgressEvent) {
+	if p.Audit != nil {
+		p.Audit(ev)
+	}
+}
+
+type egressConn struct {
+	net.Conn
+	policy    *EgressPolicy
+	network   string
+	address   string
+	start     time.Time
+	timer     *time.Timer
+	closeOnce sync.Once
+}
+
+func (c *egressConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.policy.audit(EgressEvent{
+			Network:  c.network,
+			Address:  c.address,
+			Allowed:  true,
+			Closed:   true,
+			Duration: time.Since(c.start),
+		})
+	})
+	return err
+}
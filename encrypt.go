@@ -0,0 +1,528 @@
+package webdial
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Encryption configures end-to-end encryption of a conn's payload, for
+// when the server in between isn't trusted, as with WithRendezvous. The
+// two ends run a Noise XX handshake (Noise_XX_25519_AESGCM_SHA256) over
+// the conn before the first byte of data, which authenticates each end's
+// static X25519 key and derives the keys for the rest of the stream. Both
+// ends must be encrypted; the handshake fails against one that isn't.
+type Encryption struct {
+	// Key is this end's static key, e.g. from
+	// ecdh.X25519().GenerateKey(rand.Reader). Nil uses a key generated for
+	// the conn, which peers can't pin.
+	Key *ecdh.PrivateKey
+	// PeerKeys pins the peer: the handshake fails with ErrUntrustedPeer
+	// unless the peer's static key is one of these. Empty accepts any
+	// peer, which hides the payload from a relay that only watches, but
+	// not from one that poses as the peer; check PeerKey instead.
+	PeerKeys []*ecdh.PublicKey
+}
+
+// WithEncryption encrypts the conn end to end, see Encryption. The
+// handshake runs on the first Read or Write, or Handshake, so it needn't
+// hold up Dial while a rendezvous peer is on its way.
+func WithEncryption(e Encryption) DialOption {
+	return func(d *Dialer) { d.Encryption = &e }
+}
+
+// EncryptConn encrypts any conn end to end, e.g. a ServerConn talking to
+// a client dialed WithEncryption. Like WithEncryption, the handshake runs
+// on first use.
+func EncryptConn(conn net.Conn, e Encryption) *EncryptedConn {
+	return &EncryptedConn{Conn: conn, noise: newNoiseConn(conn, conn, e)}
+}
+
+// EncryptedConn is a conn encrypted with EncryptConn.
+type EncryptedConn struct {
+	net.Conn
+	noise *noiseConn
+}
+
+func (c *EncryptedConn) Read(b []byte) (int, error)  { return c.noise.Read(b) }
+func (c *EncryptedConn) Write(b []byte) (int, error) { return c.noise.Write(b) }
+
+// Handshake runs the encryption handshake if it hasn't run yet, giving up
+// when ctx is done.
+func (c *EncryptedConn) Handshake(ctx context.Context) error {
+	return c.noise.handshake(ctx)
+}
+
+// PeerKey returns the peer's static key, nil before the handshake.
+func (c *EncryptedConn) PeerKey() *ecdh.PublicKey {
+	return c.noise.remoteKey()
+}
+
+// Unwrap returns the conn being encrypted.
+func (c *EncryptedConn) Unwrap() any { return c.Conn }
+
+const (
+	// noiseProtocol names the handshake, which is hashed into its keys.
+	noiseProtocol = "Noise_XX_25519_AESGCM_SHA256"
+	// encryptMagic starts each end's hello, which settles which end
+	// starts the handshake: as either might have dialed first, the one
+	// with the lower random goes first.
+	encryptMagic = "WDE1"
+	helloSize    = len(encryptMagic) + 32
+	// maxRecord is the largest Noise message, plus its length prefix.
+	maxRecord    = 65535
+	maxPlaintext = maxRecord - 16
+)
+
+// noiseConn runs the handshake and record layer over rw, using conn for
+// deadlines.
+type noiseConn struct {
+	rw     io.ReadWriter
+	conn   net.Conn
+	config Encryption
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	done         bool // guarded by handshakeMu
+	peerKey      *ecdh.PublicKey
+	send, recv   *cipherState
+
+	readMu  sync.Mutex
+	record  []byte // read buffer, with the length prefix
+	have    int    // bytes of record read so far
+	unread  []byte // decrypted, not yet read
+	readErr error
+	writeMu sync.Mutex
+}
+
+func newNoiseConn(rw io.ReadWriter, conn net.Conn, e Encryption) *noiseConn {
+	return &noiseConn{rw: rw, conn: conn, config: e}
+}
+
+func (c *noiseConn) Read(b []byte) (int, error) {
+	if err := c.handshake(context.Background()); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.unread) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		msg, err := c.readRecord()
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = netError(err)
+			}
+			if !isTimeout(err) {
+				// A timeout leaves any half read record to resume.
+				c.readErr = err
+			}
+			return 0, err
+		}
+		pt, err := c.recv.decrypt(msg[:0], nil, msg)
+		if err != nil {
+			c.readErr = fmt.Errorf("webdial: decrypting record: %w", err)
+			return 0, netError(c.readErr)
+		}
+		c.unread = pt
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(b []byte) (int, error) {
+	if err := c.handshake(context.Background()); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := getBuffer(2 + maxRecord)
+	defer putBuffer(buf)
+	var written int
+	for first := true; first || len(b) > 0; first = false {
+		chunk := b[:min(len(b), maxPlaintext)]
+		ct := c.send.encrypt((*buf)[:2], nil, chunk)
+		binary.BigEndian.PutUint16(ct, uint16(len(ct)-2))
+		if _, err := c.rw.Write(ct); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// readRecord reads a length-prefixed message into c.record. What it has
+// read is kept in c.have, so that after an error such as a read deadline
+// the next call resumes the record, as crypto/tls keeps its rawInput.
+func (c *noiseConn) readRecord() ([]byte, error) {
+	if c.record == nil {
+		c.record = make([]byte, 2+maxRecord)
+	}
+	if err := c.fill(2); err != nil {
+		return nil, err
+	}
+	size := 2 + int(binary.BigEndian.Uint16(c.record))
+	if err := c.fill(size); err != nil {
+		return nil, err
+	}
+	c.have = 0
+	return c.record[2:size], nil
+}
+
+// fill reads until c.record holds n bytes.
+func (c *noiseConn) fill(n int) error {
+	for c.have < n {
+		m, err := c.rw.Read(c.record[c.have:n])
+		c.have += m
+		if err != nil && c.have < n {
+			if err == io.EOF && c.have > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *noiseConn) remoteKey() *ecdh.PublicKey {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	return c.peerKey
+}
+
+// handshake runs the handshake once, returning its error to every call.
+func (c *noiseConn) handshake(ctx context.Context) error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	if c.done {
+		return c.handshakeErr
+	}
+	if ctx.Done() != nil {
+		// As tls.Conn.HandshakeContext does.
+		stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Unix(1, 0)) })
+		defer func() {
+			if !stop() {
+				c.conn.SetDeadline(time.Time{})
+				if c.handshakeErr != nil {
+					c.handshakeErr = ctx.Err()
+				}
+			}
+		}()
+	}
+	c.done = true
+	if c.handshakeErr = c.runHandshake(); c.handshakeErr != nil {
+		// The stream is mid-handshake, so can't continue.
+		c.conn.Close()
+		c.handshakeErr = netError(c.handshakeErr)
+	}
+	return c.handshakeErr
+}
+
+func (c *noiseConn) runHandshake() error {
+	s := c.config.Key
+	if s == nil {
+		var err error
+		if s, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return err
+		}
+	}
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hello := make([]byte, helloSize)
+	copy(hello, encryptMagic)
+	rand.Read(hello[len(encryptMagic):])
+	// Both hellos go out at once, so write ours while reading theirs.
+	wrote := make(chan error, 1)
+	go func() {
+		_, err := c.rw.Write(hello)
+		wrote <- err
+	}()
+	peerHello := make([]byte, helloSize)
+	_, err = io.ReadFull(c.rw, peerHello)
+	if werr := <-wrote; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	if !bytes.HasPrefix(peerHello, []byte(encryptMagic)) {
+		return ErrNotEncrypted
+	}
+	order := bytes.Compare(hello, peerHello)
+	if order == 0 {
+		return errors.New("webdial: encryption handshake: peer echoed our hello")
+	}
+	initiator := order < 0
+	// The hellos are the prologue, so tampering with them fails the
+	// handshake.
+	hs := newHandshakeState()
+	if initiator {
+		hs.mixHash(append(hello, peerHello...))
+	} else {
+		hs.mixHash(append(peerHello, hello...))
+	}
+	var rs *ecdh.PublicKey
+	if initiator {
+		// -> e
+		if err := c.writeHandshake(hs.encryptAndHash(hs.writeEphemeral(e), nil)); err != nil {
+			return err
+		}
+		// <- e, ee, s, es
+		msg, err := c.readHandshake()
+		if err != nil {
+			return err
+		}
+		re, msg, err := hs.readEphemeral(msg)
+		if err != nil {
+			return err
+		}
+		if err := hs.mixDH(e, re); err != nil {
+			return err
+		}
+		if rs, msg, err = hs.readStatic(msg); err != nil {
+			return err
+		}
+		if err := hs.mixDH(e, rs); err != nil {
+			return err
+		}
+		if _, err := hs.decryptAndHash(msg); err != nil {
+			return err
+		}
+		// -> s, se
+		out := hs.encryptAndHash(nil, s.PublicKey().Bytes())
+		if err := hs.mixDH(s, re); err != nil {
+			return err
+		}
+		if err := c.writeHandshake(hs.encryptAndHash(out, nil)); err != nil {
+			return err
+		}
+	} else {
+		// <- e
+		msg, err := c.readHandshake()
+		if err != nil {
+			return err
+		}
+		re, msg, err := hs.readEphemeral(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := hs.decryptAndHash(msg); err != nil {
+			return err
+		}
+		// -> e, ee, s, es
+		out := hs.writeEphemeral(e)
+		if err := hs.mixDH(e, re); err != nil {
+			return err
+		}
+		out = hs.encryptAndHash(out, s.PublicKey().Bytes())
+		if err := hs.mixDH(s, re); err != nil {
+			return err
+		}
+		if err := c.writeHandshake(hs.encryptAndHash(out, nil)); err != nil {
+			return err
+		}
+		// <- s, se
+		if msg, err = c.readHandshake(); err != nil {
+			return err
+		}
+		if rs, msg, err = hs.readStatic(msg); err != nil {
+			return err
+		}
+		if err := hs.mixDH(e, rs); err != nil {
+			return err
+		}
+		if _, err := hs.decryptAndHash(msg); err != nil {
+			return err
+		}
+	}
+	if len(c.config.PeerKeys) > 0 && !slices.ContainsFunc(c.config.PeerKeys, func(k *ecdh.PublicKey) bool { return k.Equal(rs) }) {
+		return ErrUntrustedPeer
+	}
+	first, second, err := hs.split()
+	if err != nil {
+		return err
+	}
+	c.send, c.recv = first, second
+	if !initiator {
+		c.send, c.recv = second, first
+	}
+	c.peerKey = rs
+	return nil
+}
+
+func (c *noiseConn) writeHandshake(msg []byte) error {
+	record := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	if _, err := c.rw.Write(append(record, msg...)); err != nil {
+		return fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	return nil
+}
+
+func (c *noiseConn) readHandshake() ([]byte, error) {
+	msg, err := c.readRecord()
+	if err != nil {
+		return nil, fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	return msg, nil
+}
+
+// handshakeState is Noise's SymmetricState, holding the chaining key and
+// hash of the handshake so far.
+type handshakeState struct {
+	ck, h []byte
+	k     *cipherState // nil until the first DH
+}
+
+func newHandshakeState() *handshakeState {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocol) // shorter than the hash, so padded
+	return &handshakeState{ck: slices.Clone(h), h: h}
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	sum := sha256.Sum256(append(slices.Clone(hs.h), data...))
+	hs.h = sum[:]
+}
+
+// mixKey derives the next chaining key and cipher key from ikm.
+func (hs *handshakeState) mixKey(ikm []byte) error {
+	out, err := hkdf.Key(sha256.New, ikm, hs.ck, "", 2*sha256.Size)
+	if err != nil {
+		return err
+	}
+	hs.ck = out[:sha256.Size]
+	hs.k, err = newCipherState(out[sha256.Size:])
+	return err
+}
+
+func (hs *handshakeState) mixDH(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	return hs.mixKey(secret)
+}
+
+func (hs *handshakeState) encryptAndHash(out, plaintext []byte) []byte {
+	start := len(out)
+	if hs.k == nil {
+		out = append(out, plaintext...)
+	} else {
+		out = hs.k.encrypt(out, hs.h, plaintext)
+	}
+	hs.mixHash(out[start:])
+	return out
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if hs.k == nil {
+		hs.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	plaintext, err := hs.k.decrypt(nil, hs.h, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (hs *handshakeState) writeEphemeral(e *ecdh.PrivateKey) []byte {
+	out := e.PublicKey().Bytes()
+	hs.mixHash(out)
+	return out
+}
+
+func (hs *handshakeState) readEphemeral(msg []byte) (*ecdh.PublicKey, []byte, error) {
+	if len(msg) < 32 {
+		return nil, nil, errShortHandshake
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:32])
+	if err != nil {
+		return nil, nil, fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	hs.mixHash(msg[:32])
+	return re, msg[32:], nil
+}
+
+func (hs *handshakeState) readStatic(msg []byte) (*ecdh.PublicKey, []byte, error) {
+	if len(msg) < 32+16 {
+		return nil, nil, errShortHandshake
+	}
+	key, err := hs.decryptAndHash(msg[:32+16])
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("webdial: encryption handshake: %w", err)
+	}
+	return rs, msg[32+16:], nil
+}
+
+// split derives the keys for the initiator's and responder's sends.
+func (hs *handshakeState) split() (*cipherState, *cipherState, error) {
+	out, err := hkdf.Key(sha256.New, nil, hs.ck, "", 2*sha256.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	first, err := newCipherState(out[:sha256.Size])
+	if err != nil {
+		return nil, nil, err
+	}
+	second, err := newCipherState(out[sha256.Size:])
+	return first, second, err
+}
+
+var errShortHandshake = errors.New("webdial: encryption handshake: message too short")
+
+// cipherState is AES-256-GCM with Noise's counter nonce.
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead}, nil
+}
+
+func (cs *cipherState) nonce() []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], cs.n)
+	cs.n++
+	return nonce[:]
+}
+
+func (cs *cipherState) encrypt(out, ad, plaintext []byte) []byte {
+	return cs.aead.Seal(out, cs.nonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(out, ad, ciphertext []byte) ([]byte, error) {
+	return cs.aead.Open(out, cs.nonce(), ciphertext, ad)
+}
@@ -0,0 +1,40 @@
+package webdial
+
+import "errors"
+
+var (
+	// ErrServerClosed is returned by Server.Accept once the server is
+	// closed.
+	ErrServerClosed = errors.New("webdial: server closed")
+	// ErrSessionNotFound is returned by writes on an SSE conn whose
+	// session the server no longer knows, e.g. because it restarted.
+	ErrSessionNotFound = errors.New("webdial: session not found")
+	// ErrUnsupportedTransport is returned by Dial for an unknown
+	// Dialer.Transport or URL scheme.
+	ErrUnsupportedTransport = errors.New("webdial: unsupported transport")
+	// ErrHandshake matches every Dial error caused by the server rejecting
+	// or garbling a handshake, including a *VersionError.
+	ErrHandshake = errors.New("webdial: handshake failed")
+	// ErrHandshakeTimeout is returned by Dial when HandshakeTimeout
+	// elapses. It is a net.Error whose Timeout method reports true.
+	ErrHandshakeTimeout error = &timeoutError{"webdial: handshake timeout"}
+	// ErrIdleTimeout is returned by reads and writes on a conn closed by
+	// its IdleTimeout. It is a net.Error whose Timeout method reports true.
+	ErrIdleTimeout error = &timeoutError{"webdial: idle timeout"}
+	// ErrMessageTooLarge is returned by reads on a conn whose peer sent a
+	// WebSocket message or SSE event over the read limit, see
+	// WithReadLimit and WithMaxMessageSize. The conn can't continue.
+	ErrMessageTooLarge = errors.New("webdial: message too large")
+	// ErrUnauthorized can be returned, or wrapped, by a WithAuth function
+	// to reject a request with 401 Unauthorized rather than 403 Forbidden.
+	ErrUnauthorized = errors.New("webdial: unauthorized")
+	// ErrNotEncrypted is returned by reads and writes on a conn dialed
+	// WithEncryption whose peer isn't encrypted.
+	ErrNotEncrypted = errors.New("webdial: peer is not encrypted")
+	// ErrUntrustedPeer is returned by reads and writes on an encrypted
+	// conn whose peer's key isn't among Encryption.PeerKeys.
+	ErrUntrustedPeer = errors.New("webdial: untrusted peer key")
+	// ErrNoListener is returned by Server.DialClient when no client is
+	// listening under the name.
+	ErrNoListener = errors.New("webdial: no such listener")
+)
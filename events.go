@@ -0,0 +1,108 @@
+package webdial
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// ServerEventType is the kind of a ServerEvent.
+type ServerEventType int
+
+const (
+	// EventOpen is emitted when a handshake completes, before the conn is
+	// queued for Accept.
+	EventOpen ServerEventType = iota
+	// EventClose is emitted when a conn is closed.
+	EventClose
+)
+
+func (t ServerEventType) String() string {
+	switch t {
+	case EventOpen:
+		return "open"
+	case EventClose:
+		return "close"
+	}
+	return fmt.Sprintf("ServerEventType(%d)", int(t))
+}
+
+// ServerEvent describes a conn opening or closing, for monitoring.
+type ServerEvent struct {
+	Type      ServerEventType
+	Transport string
+	// SessionID is the SSE session ID, empty for WebSocket conns.
+	SessionID  string
+	ClientAddr net.Addr
+	Target     string
+	// Fingerprint is the client's TLS fingerprint, if captured, see
+	// EnableTLSFingerprinting.
+	Fingerprint *TLSFingerprint
+	// Err is the last read or write error of a closed conn, if any.
+	Err error
+	// BytesRead and BytesWritten are the conn's totals when it closed.
+	BytesRead    int64
+	BytesWritten int64
+	// Duration is how long a closed conn was open.
+	Duration time.Duration
+}
+
+// WithEvents calls fn as each conn opens and closes. fn is called
+// synchronously from the conn's handler or Close, so it must not block.
+func WithEvents(fn func(ServerEvent)) ServerOption {
+	return func(s *Server) { s.events = fn }
+}
+
+// connOpened emits the open event for conn and returns a func emitting
+// its close event.
+func (s *Server) connOpened(conn *ServerConn, sessionID string) func() {
+	s.logger.Info("conn opened",
+		slog.String("id", conn.ID()),
+		slog.String("transport", conn.Transport()),
+		slog.String("client", conn.Request().RemoteAddr))
+	s.metrics.opened(conn)
+	endSession := s.traceSession(conn)
+	if s.events == nil {
+		return func() {
+			s.metrics.retire(conn)
+			endSession()
+			s.logConnClosed(conn)
+		}
+	}
+	ev := ServerEvent{
+		Type:        EventOpen,
+		Transport:   conn.Transport(),
+		SessionID:   sessionID,
+		ClientAddr:  conn.ClientAddr(),
+		Target:      conn.Target(),
+		Fingerprint: conn.meta().fingerprint,
+	}
+	s.events(ev)
+	opened := time.Now()
+	return func() {
+		s.metrics.retire(conn)
+		endSession()
+		ev.Type = EventClose
+		st := conn.Stats()
+		ev.BytesRead, ev.BytesWritten = st.BytesRead, st.BytesWritten
+		ev.Err = conn.State().LastError
+		ev.Duration = time.Since(opened)
+		s.events(ev)
+		s.logConnClosed(conn)
+	}
+}
+
+func (s *Server) logConnClosed(conn *ServerConn) {
+	st := conn.Stats()
+	attrs := []any{
+		slog.String("id", conn.ID()),
+		slog.String("transport", conn.Transport()),
+		slog.Int64("read", st.BytesRead),
+		slog.Int64("written", st.BytesWritten),
+	}
+	if err := conn.State().LastError; err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	s.logger.Info("conn closed", attrs...)
+}
@@ -0,0 +1,65 @@
+package webdial
+
+import (
+	"net"
+	"net/http"
+)
+
+// ConnInfo describes a handshake for a WithAcceptFilter function.
+type ConnInfo struct {
+	// Transport is "ws" or "sse".
+	Transport string
+	// ClientAddr is where the handshake came from.
+	ClientAddr net.Addr
+	// Request is the handshake request. Its body must not be read.
+	Request *http.Request
+	// Target and Metadata are what the client sent with WithTarget and
+	// WithMetadata.
+	Target   string
+	Metadata map[string]string
+	// Tags are what the client sent with WithTags.
+	Tags []string
+	// Identity is what the WithAuth function returned, if any.
+	Identity any
+	// Fingerprint is the client's TLS fingerprint, if captured, see
+	// EnableTLSFingerprinting.
+	Fingerprint *TLSFingerprint
+	// Conns is the number of live conns, and Queued how many of them are
+	// waiting for Accept.
+	Conns  int
+	Queued int
+}
+
+// WithAcceptFilter calls fn for each handshake that passed WithAuth, and
+// rejects it with 403 Forbidden before it reaches Accept if fn returns
+// false.
+func WithAcceptFilter(fn func(ConnInfo) bool) ServerOption {
+	return func(s *Server) { s.filter = fn }
+}
+
+// filterAccepts runs the accept filter, writing the rejection if it fails.
+func (s *Server) filterAccepts(w http.ResponseWriter, r *http.Request, transport string, identity any) bool {
+	if s.filter == nil {
+		return true
+	}
+	if !s.filter(s.connInfo(r, transport, identity)) {
+		s.reject(w, r, http.StatusForbidden, "webdial: conn rejected", "")
+		return false
+	}
+	return true
+}
+
+func (s *Server) connInfo(r *http.Request, transport string, identity any) ConnInfo {
+	return ConnInfo{
+		Transport:   transport,
+		ClientAddr:  clientAddr(r, transport),
+		Request:     r,
+		Target:      requestTarget(r),
+		Metadata:    requestMetadata(r),
+		Tags:        requestTags(r),
+		Identity:    identity,
+		Fingerprint: requestFingerprint(r),
+		Conns:       int(s.live.Load()),
+		Queued:      len(s.acceptCh),
+	}
+}
@@ -0,0 +1,189 @@
+package webdial
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TLSFingerprint identifies the TLS client that established a conn.
+type TLSFingerprint struct {
+	// JA3 is the raw JA3 string; JA3Hash is its MD5.
+	JA3     string
+	JA3Hash string
+	// JA4 is the JA4 (TLS over TCP) fingerprint.
+	JA4 string
+}
+
+type fingerprintKey struct{}
+
+// EnableTLSFingerprinting configures hs to capture the JA3/JA4 fingerprint
+// of every TLS client hello. It must be called before hs starts serving TLS
+// and only has an effect when hs terminates TLS itself, either via ServeTLS
+// or a tls.NewListener using hs.TLSConfig. Fingerprints are available on
+// accepted conns via TLSFingerprintOf.
+func EnableTLSFingerprinting(hs *http.Server) {
+	if hs.TLSConfig == nil {
+		hs.TLSConfig = &tls.Config{}
+	}
+	getConfig := hs.TLSConfig.GetConfigForClient
+	hs.TLSConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		if fp, ok := info.Context().Value(fingerprintKey{}).(*TLSFingerprint); ok && fp.JA4 == "" {
+			*fp = newTLSFingerprint(info)
+		}
+		if getConfig != nil {
+			return getConfig(info)
+		}
+		return nil, nil
+	}
+	connContext := hs.ConnContext
+	hs.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, fingerprintKey{}, &TLSFingerprint{})
+	}
+}
+
+// TLSFingerprintOf returns the TLS fingerprint captured when conn was
+// accepted, if any.
+func TLSFingerprintOf(conn net.Conn) (TLSFingerprint, bool) {
+	mc, ok := conn.(interface{ meta() *connMeta })
+	if !ok {
+		return TLSFingerprint{}, false
+	}
+	fp := mc.meta().fingerprint
+	if fp == nil || fp.JA4 == "" {
+		return TLSFingerprint{}, false
+	}
+	return *fp, true
+}
+
+// requestFingerprint returns a copy of the fingerprint captured for r's
+// connection, or nil if there is none.
+func requestFingerprint(r *http.Request) *TLSFingerprint {
+	fp, ok := r.Context().Value(fingerprintKey{}).(*TLSFingerprint)
+	if !ok || fp.JA4 == "" {
+		return nil
+	}
+	c := *fp
+	return &c
+}
+
+func newTLSFingerprint(info *tls.ClientHelloInfo) TLSFingerprint {
+	ciphers := withoutGREASE(info.CipherSuites)
+	exts := withoutGREASE(info.Extensions)
+	versions := withoutGREASE(info.SupportedVersions)
+	curves := make([]uint16, 0, len(info.SupportedCurves))
+	for _, c := range info.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+	curves = withoutGREASE(curves)
+	sigs := make([]uint16, 0, len(info.SignatureSchemes))
+	for _, s := range info.SignatureSchemes {
+		sigs = append(sigs, uint16(s))
+	}
+	var maxVersion uint16
+	if len(versions) > 0 {
+		maxVersion = slices.Max(versions)
+	}
+	// TLS 1.3 clients advertise 1.2 as the legacy hello version.
+	helloVersion := min(maxVersion, tls.VersionTLS12)
+	points := make([]string, len(info.SupportedPoints))
+	for i, p := range info.SupportedPoints {
+		points[i] = strconv.Itoa(int(p))
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(helloVersion)),
+		joinUint16(ciphers, "-", 10),
+		joinUint16(exts, "-", 10),
+		joinUint16(curves, "-", 10),
+		strings.Join(points, "-"),
+	}, ",")
+	ja3Sum := md5.Sum([]byte(ja3))
+	// JA4_a: protocol, version, SNI, cipher count, extension count, ALPN.
+	sni := "i"
+	if info.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(info.SupportedProtos) > 0 && info.SupportedProtos[0] != "" {
+		p := info.SupportedProtos[0]
+		alpn = p[:1] + p[len(p)-1:]
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(maxVersion), sni, min(len(ciphers), 99), min(len(exts), 99), alpn)
+	// JA4_b: sorted ciphers. JA4_c: sorted extensions, minus SNI and ALPN,
+	// followed by signature algorithms in their original order.
+	sortedCiphers := slices.Sorted(slices.Values(ciphers))
+	sortedExts := slices.DeleteFunc(slices.Sorted(slices.Values(exts)), func(e uint16) bool {
+		return e == 0x0000 || e == 0x0010
+	})
+	c := joinUint16(sortedExts, ",", 16)
+	if len(sigs) > 0 {
+		c += "_" + joinUint16(sigs, ",", 16)
+	}
+	return TLSFingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(ja3Sum[:]),
+		JA4:     a + "_" + ja4Hash(joinUint16(sortedCiphers, ",", 16)) + "_" + ja4Hash(c),
+	}
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case tls.VersionSSL30:
+		return "s3"
+	}
+	return "00"
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// isGREASE reports whether v is an RFC 8701 GREASE value.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(vs []uint16) []uint16 {
+	out := make([]uint16, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16(vs []uint16, sep string, base int) string {
+	parts := make([]string, len(vs))
+	for i, v := range vs {
+		if base == 16 {
+			parts[i] = fmt.Sprintf("%04x", v)
+		} else {
+			parts[i] = strconv.Itoa(int(v))
+		}
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,165 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithForward turns the Server into a gateway: instead of being queued
+// for Accept, every conn is connected to address on network, e.g.
+// WithForward("tcp", "127.0.0.1:22"), and bytes are copied both ways
+// until either side closes. An empty address forwards each conn to the
+// target its client asked for with WithTarget, which lets any client
+// reach anything the server can, so restrict it with WithForwardPolicy.
+func WithForward(network, address string) ServerOption {
+	return func(s *Server) {
+		if s.forward == nil {
+			s.forward = &forwarder{}
+		}
+		s.forward.network, s.forward.address = network, address
+	}
+}
+
+// ForwardPolicy restricts the targets WithForward dials, so a gateway
+// forwarding to client targets can't become an open relay. The zero
+// value allows everything.
+type ForwardPolicy struct {
+	// Allow lists the host:port patterns targets must match, in the
+	// syntax of path.Match, e.g. "db-*.internal:5432" or "10.0.0.1:*".
+	// Empty means any target.
+	Allow []string
+	// Check, if set, is called for targets that passed Allow and denies
+	// them by returning an error, e.g. for per-identity rules.
+	Check func(info ConnInfo, target string) error
+	// Egress, if set, dials permitted targets, adding its port allowlist,
+	// duration cap and audit events.
+	Egress *EgressPolicy
+}
+
+// WithForwardPolicy applies p to WithForward. Handshakes for denied
+// targets are rejected with 403 Forbidden before anything is dialed.
+func WithForwardPolicy(p ForwardPolicy) ServerOption {
+	return func(s *Server) {
+		if s.forward == nil {
+			s.forward = &forwarder{}
+		}
+		s.forward.policy = p
+	}
+}
+
+type forwarder struct {
+	network string
+	address string
+	policy  ForwardPolicy
+}
+
+// target returns where a conn opened by r is forwarded to.
+func (f *forwarder) target(r *http.Request) string {
+	if f.address != "" {
+		return f.address
+	}
+	return requestTarget(r)
+}
+
+// check applies the policy to target.
+func (f *forwarder) check(info ConnInfo, target string) error {
+	if target == "" {
+		return errors.New("webdial: no forward target")
+	}
+	if len(f.policy.Allow) > 0 && !slices.ContainsFunc(f.policy.Allow, func(pattern string) bool {
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target))
+		return ok
+	}) {
+		return fmt.Errorf("webdial: forward target %q not allowed", target)
+	}
+	if f.policy.Check != nil {
+		return f.policy.Check(info, target)
+	}
+	return nil
+}
+
+func (f *forwarder) dial(ctx context.Context, target string) (net.Conn, error) {
+	if f.policy.Egress != nil {
+		return f.policy.Egress.DialContext(ctx, f.network, target)
+	}
+	return (&net.Dialer{}).DialContext(ctx, f.network, target)
+}
+
+// forwardAllowed runs the forward policy for a handshake, writing the
+// rejection if it fails.
+func (s *Server) forwardAllowed(w http.ResponseWriter, r *http.Request, transport string, identity any) bool {
+	if s.forward == nil {
+		return true
+	}
+	if err := s.forward.check(s.connInfo(r, transport, identity), s.forward.target(r)); err != nil {
+		s.reject(w, r, http.StatusForbidden, err.Error(), "")
+		return false
+	}
+	return true
+}
+
+// forwardDialTimeout bounds how long a backend may take to answer.
+const forwardDialTimeout = 10 * time.Second
+
+// forwardConn dials conn's backend and splices the two together.
+func (s *Server) forwardConn(conn *ServerConn) {
+	defer conn.Close()
+	conn.internal.Store(true)
+	s.accepted(conn)
+	address := s.forward.target(conn.Request())
+	log := s.logger.With(slog.String("id", conn.ID()), slog.String("target", address))
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	backend, err := s.forward.dial(ctx, address)
+	cancel()
+	if err != nil {
+		log.Warn("forward failed", slog.Any("err", err))
+		return
+	}
+	defer backend.Close()
+	if s.proxyProtocol {
+		header := proxyHeader(conn.ClientAddr(), serverAddr(conn.Request()))
+		if _, err := backend.Write(header); err != nil {
+			log.Warn("forward failed", slog.Any("err", err))
+			return
+		}
+	}
+	log.Debug("forwarding")
+	splice(conn, backend)
+}
+
+// splice copies between a and b until either side is done, then closes
+// both.
+func splice(a, b net.Conn) {
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		io.Copy(a, b)
+		done()
+	})
+	io.Copy(b, a)
+	done()
+	wg.Wait()
+}
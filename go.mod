@@ -4,12 +4,12 @@ go 1.25.6
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/jpillora/eventsource v1.2.0
 	github.com/stretchr/testify v1.11.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/jpillora/eventsource v1.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,42 @@
+package webdial
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewHTTPTransport returns an http.Transport that tunnels every connection
+// through the webdial server at baseURL, dialed using DefaultDialer modified
+// by opts, so an ordinary http.Client can reach services only the server
+// can reach. The host in each request URL is ignored for dialing: the
+// server decides where accepted conns go.
+func NewHTTPTransport(baseURL string, opts ...DialOption) *http.Transport {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.NewHTTPTransport(baseURL)
+}
+
+// NewHTTPTransport returns an http.Transport that tunnels every connection
+// through the webdial server at baseURL.
+func (d *Dialer) NewHTTPTransport(baseURL string) *http.Transport {
+	dialer := *d
+	// Idle conns live in the transport's pool, not the request's context.
+	dialer.CloseOnCancel = false
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, baseURL)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
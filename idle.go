@@ -0,0 +1,44 @@
+package webdial
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleWatch calls onIdle once there has been no activity for timeout.
+type idleWatch struct {
+	timeout time.Duration
+	last    atomic.Int64 // unix nanos of the last activity
+	fired   atomic.Bool
+	timer   *time.Timer
+	onIdle  func()
+}
+
+func newIdleWatch(timeout time.Duration, onIdle func()) *idleWatch {
+	w := &idleWatch{timeout: timeout, onIdle: onIdle}
+	w.touch()
+	// Arm only once w.timer is set, as check uses it.
+	w.timer = time.AfterFunc(time.Hour, w.check)
+	w.timer.Reset(timeout)
+	return w
+}
+
+func (w *idleWatch) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// check fires if the conn has been idle long enough, or waits out the
+// rest of the timeout since the last activity.
+func (w *idleWatch) check() {
+	idle := time.Since(time.Unix(0, w.last.Load()))
+	if idle < w.timeout {
+		w.timer.Reset(w.timeout - idle)
+		return
+	}
+	w.fired.Store(true)
+	w.onIdle()
+}
+
+func (w *idleWatch) stop() {
+	w.timer.Stop()
+}
@@ -0,0 +1,97 @@
+package webdial
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultKeepAlivePeriod is the period SetKeepAlive(true) uses when none
+// has been set, as for net.TCPConn.
+const defaultKeepAlivePeriod = 15 * time.Second
+
+// keepAliver is implemented by conns with keep-alives, with the methods of
+// net.TCPConn.
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// keepAlive is a conn's keep-alive setting, which SetKeepAlive and
+// SetKeepAlivePeriod can change while loop runs with it.
+type keepAlive struct {
+	mu      sync.Mutex
+	on      bool
+	period  time.Duration
+	changed chan struct{}
+}
+
+// newKeepAlive starts enabled if period is positive.
+func newKeepAlive(period time.Duration) *keepAlive {
+	return &keepAlive{on: period > 0, period: max(period, 0), changed: make(chan struct{}, 1)}
+}
+
+func (k *keepAlive) setEnabled(on bool) {
+	k.mu.Lock()
+	k.on = on
+	k.mu.Unlock()
+	signal(k.changed)
+}
+
+func (k *keepAlive) setPeriod(d time.Duration) {
+	k.mu.Lock()
+	k.period = max(d, 0)
+	k.mu.Unlock()
+	signal(k.changed)
+}
+
+// interval returns the period to ping on, or zero if disabled.
+func (k *keepAlive) interval() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case !k.on:
+		return 0
+	case k.period == 0:
+		return defaultKeepAlivePeriod
+	}
+	return k.period
+}
+
+// loop calls ping every interval until stop is closed or ping fails,
+// following changes to the setting.
+func (k *keepAlive) loop(stop <-chan struct{}, ping func(interval time.Duration) error) {
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for {
+		interval := k.interval()
+		var tick <-chan time.Time
+		switch {
+		case interval == 0 && ticker != nil:
+			ticker.Stop()
+			ticker = nil
+		case interval > 0 && ticker == nil:
+			ticker = time.NewTicker(interval)
+		case interval > 0:
+			ticker.Reset(interval)
+		}
+		if ticker != nil {
+			tick = ticker.C
+		}
+		for changed := false; !changed; {
+			select {
+			case <-tick:
+				if err := ping(interval); err != nil {
+					return
+				}
+			case <-k.changed:
+				changed = true
+			case <-stop:
+				return
+			}
+		}
+	}
+}
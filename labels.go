@@ -0,0 +1,27 @@
+package webdial
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// sessionLabels are the pprof labels of the goroutines serving a conn.
+func sessionLabels(id, transport, client string) pprof.LabelSet {
+	return pprof.Labels("webdial_session", id, "webdial_transport", transport, "webdial_client", client)
+}
+
+// labelGoroutine tags the calling goroutine, and those it starts, with
+// labels on top of ctx's, returning a func restoring ctx's, as pprof.Do
+// does.
+func labelGoroutine(ctx context.Context, labels pprof.LabelSet) (restore func()) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, labels))
+	return func() { pprof.SetGoroutineLabels(ctx) }
+}
+
+// Labels returns the pprof labels of the goroutines the server runs for
+// the conn: its session ID, transport and client address. CPU and
+// goroutine profiles of busy servers can be broken down by them, and an
+// application can tag its own goroutines for the conn with pprof.Do.
+func (c *ServerConn) Labels() pprof.LabelSet {
+	return sessionLabels(c.id, c.transport, c.req.RemoteAddr)
+}
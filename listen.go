@@ -0,0 +1,135 @@
+package webdial
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// WithListenName sets the name Listen registers under.
+func WithListenName(name string) DialOption {
+	return func(d *Dialer) { d.ListenName = name }
+}
+
+// Listen registers with a WithReverse server as a listener, named with
+// WithListenName, and returns a net.Listener whose Accept yields the conns
+// the server opens with DialClient. It suits serving HTTP or SSH from
+// behind NAT.
+func Listen(ctx context.Context, baseURL string, opts ...DialOption) (*Listener, error) {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.Listen(ctx, baseURL)
+}
+
+// Listen is like the package-level Listen. Only the registration is bound
+// by ctx.
+func (d *Dialer) Listen(ctx context.Context, baseURL string) (*Listener, error) {
+	if d.ListenName == "" {
+		// Without a name, the registration is just another conn.
+		return nil, errors.New("webdial: Listen needs a name, see WithListenName")
+	}
+	ctrlDialer := *d
+	ctrlDialer.Header = cloneHeader(d.Header)
+	ctrlDialer.Header.Set(listenHeader, d.ListenName)
+	ctrl, err := ctrlDialer.DialContext(ctx, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		dialer:  *d,
+		baseURL: baseURL,
+		ctrl:    ctrl,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	// Answering dials aren't bound to the registration's context.
+	l.dialer.CloseOnCancel = false
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.run()
+	return l, nil
+}
+
+// Listener is a net.Listener for conns opened by a server's DialClient,
+// returned by Listen.
+type Listener struct {
+	dialer  Dialer
+	baseURL string
+	ctrl    net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	conns   chan net.Conn
+	done    chan struct{}
+
+	mu        sync.Mutex
+	err       error // why the listener stopped
+	closeOnce sync.Once
+}
+
+// run answers every token the server sends down the control conn with a
+// new conn, until it fails.
+func (l *Listener) run() {
+	sc := bufio.NewScanner(l.ctrl)
+	for sc.Scan() {
+		go l.answer(sc.Text())
+	}
+	err := sc.Err()
+	if err == nil {
+		err = net.ErrClosed
+	}
+	l.stop(err)
+}
+
+func (l *Listener) answer(token string) {
+	d := l.dialer
+	d.Header = cloneHeader(d.Header)
+	d.Header.Set(reverseHeader, token)
+	conn, err := d.DialContext(l.ctx, l.baseURL)
+	if err != nil {
+		// The server's DialClient times out on its own.
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *Listener) stop(err error) {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		l.cancel()
+		l.ctrl.Close()
+		close(l.done)
+	})
+}
+
+// Accept waits for the server to open a conn. Once the listener is closed
+// or its registration drops, it returns the error that stopped it.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close unregisters the listener. Conns already accepted stay open.
+func (l *Listener) Close() error {
+	l.stop(net.ErrClosed)
+	return nil
+}
+
+// Addr returns the address of the server the listener is registered with.
+func (l *Listener) Addr() net.Addr {
+	return l.ctrl.RemoteAddr()
+}
@@ -0,0 +1,59 @@
+package webdial
+
+import (
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// metadataHeader carries client metadata, form-encoded so keys keep their
+// case. Clients that can't set headers use the meta query parameter.
+const metadataHeader = "X-Webdial-Metadata"
+
+// WithMetadata attaches key=value to the handshake, e.g. an agent ID or
+// labels, so the server can identify the conn with MetadataOf instead of
+// an in-band preamble.
+func WithMetadata(key, value string) DialOption {
+	return func(d *Dialer) {
+		d.Metadata = maps.Clone(d.Metadata)
+		if d.Metadata == nil {
+			d.Metadata = map[string]string{}
+		}
+		d.Metadata[key] = value
+	}
+}
+
+// MetadataOf returns the metadata the client of an accepted conn attached
+// with WithMetadata. It is nil if there was none.
+func MetadataOf(conn net.Conn) map[string]string {
+	mc, ok := conn.(interface{ meta() *connMeta })
+	if !ok {
+		return nil
+	}
+	return maps.Clone(mc.meta().metadata)
+}
+
+func encodeMetadata(md map[string]string) string {
+	v := url.Values{}
+	for k, val := range md {
+		v.Set(k, val)
+	}
+	return v.Encode()
+}
+
+func requestMetadata(r *http.Request) map[string]string {
+	raw := r.Header.Get(metadataHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get("meta")
+	}
+	v, err := url.ParseQuery(raw)
+	if err != nil || len(v) == 0 {
+		return nil
+	}
+	md := make(map[string]string, len(v))
+	for k := range v {
+		md[k] = v.Get(k)
+	}
+	return md
+}
@@ -0,0 +1,206 @@
+package webdial
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics are a Server's totals, for monitoring gateways.
+type Metrics struct {
+	// Conns counts live conns by transport, including those waiting for
+	// Accept.
+	Conns map[string]int64
+	// Sessions counts live SSE sessions.
+	Sessions int64
+	// Handshakes counts completed handshakes by transport.
+	Handshakes map[string]int64
+	// Rejected counts handshakes and POSTs turned away with an error
+	// status, e.g. by WithMaxConns or WithClientLimits.
+	Rejected int64
+	// Accepts counts conns taken by Accept, or handled by the server for
+	// WithForward, WithReverse or WithRendezvous.
+	Accepts int64
+	// Errors counts conns that closed after a read or write error.
+	Errors int64
+	// BytesRead and BytesWritten are totals across every conn, live or
+	// closed.
+	BytesRead    int64
+	BytesWritten int64
+	// AcceptQueue is how many conns are waiting for Accept.
+	AcceptQueue int
+	// ClientVersions counts live conns by the webdial version their
+	// client reported, "unknown" for clients that didn't and "other" for
+	// those reporting something other than a semantic version or
+	// "(devel)".
+	ClientVersions map[string]int64
+	// Version is the server's webdial version, see Server.Version.
+	Version string
+}
+
+// serverMetrics are the counters behind Server.Metrics.
+type serverMetrics struct {
+	rejected atomic.Int64
+	accepts  atomic.Int64
+	errors   atomic.Int64
+	// mu guards the rest, and ServerConn.retired, so that a closing
+	// conn's bytes move from the live conns to the totals at once.
+	mu           sync.Mutex
+	handshakes   map[string]int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+func (m *serverMetrics) opened(conn *ServerConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handshakes == nil {
+		m.handshakes = make(map[string]int64)
+	}
+	m.handshakes[conn.Transport()]++
+}
+
+// retire adds a closed conn's counters to the totals. It must be called
+// before the conn leaves Server.conns.
+func (m *serverMetrics) retire(conn *ServerConn) {
+	st := conn.Stats()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if conn.retired {
+		return
+	}
+	conn.retired = true
+	m.bytesRead += st.BytesRead
+	m.bytesWritten += st.BytesWritten
+	if conn.State().LastError != nil {
+		m.errors.Add(1)
+	}
+}
+
+// Metrics returns a snapshot of the server's counters.
+func (s *Server) Metrics() Metrics {
+	m := Metrics{
+		Conns:          map[string]int64{"ws": 0, "sse": 0},
+		Handshakes:     map[string]int64{"ws": 0, "sse": 0},
+		Rejected:       s.metrics.rejected.Load(),
+		Accepts:        s.metrics.accepts.Load(),
+		Errors:         s.metrics.errors.Load(),
+		ClientVersions: map[string]int64{},
+		Version:        version,
+	}
+	s.heldMu.Lock()
+	m.AcceptQueue = len(s.acceptCh) + len(s.held)
+	s.heldMu.Unlock()
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	for transport, n := range s.metrics.handshakes {
+		m.Handshakes[transport] = n
+	}
+	m.BytesRead, m.BytesWritten = s.metrics.bytesRead, s.metrics.bytesWritten
+	for conn := range s.Conns() {
+		if conn.retired {
+			continue
+		}
+		m.Conns[conn.Transport()]++
+		m.ClientVersions[versionLabel(conn.PeerVersion())]++
+		if conn.Transport() == "sse" {
+			m.Sessions++
+		}
+		st := conn.Stats()
+		m.BytesRead += st.BytesRead
+		m.BytesWritten += st.BytesWritten
+	}
+	return m
+}
+
+// expvarMap is the "webdial" map of expvar, where WithExpvar publishes.
+var expvarMap = sync.OnceValue(func() *expvar.Map { return expvar.NewMap("webdial") })
+
+// expvarMu makes publishing and unpublishing a name atomic.
+var expvarMu sync.Mutex
+
+// metricsVar is a Server's Metrics in expvar. Unlike an expvar.Func it's
+// comparable, so Close can tell whether it's still the one published.
+type metricsVar struct{ s *Server }
+
+func (v *metricsVar) String() string {
+	b, _ := json.Marshal(v.s.Metrics())
+	return string(b)
+}
+
+// WithExpvar publishes the server's Metrics with expvar, as name in its
+// "webdial" map, so that /debug/vars shows them without any other
+// dependency, until the server is closed. Servers publishing the same
+// name replace each other.
+func WithExpvar(name string) ServerOption {
+	return func(s *Server) {
+		s.expvarName, s.expvarVar = name, &metricsVar{s}
+		expvarMu.Lock()
+		defer expvarMu.Unlock()
+		expvarMap().Set(name, s.expvarVar)
+	}
+}
+
+// unpublish removes what WithExpvar published, unless another server has
+// replaced it.
+func (s *Server) unpublish() {
+	if s.expvarVar == nil {
+		return
+	}
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if v, ok := expvarMap().Get(s.expvarName).(*metricsVar); ok && v == s.expvarVar {
+		expvarMap().Delete(s.expvarName)
+	}
+}
+
+// labelEscaper escapes label values for the text exposition format, which
+// isn't Go's quoting.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricsHandler serves the server's Metrics in the Prometheus text
+// exposition format, for mounting at /metrics. It needs no Prometheus
+// client library, so scrape it directly rather than registering it; the
+// github.com/jpillora/webdial/prometheus module has a Collector for that.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := s.Metrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metric := func(name, kind, help string) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		}
+		byLabel := func(name, label string, values map[string]int64) {
+			for _, value := range slices.Sorted(maps.Keys(values)) {
+				fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(value), values[value])
+			}
+		}
+		metric("webdial_build_info", "gauge", "The server's webdial version.")
+		byLabel("webdial_build_info", "version", map[string]int64{m.Version: 1})
+		metric("webdial_conns", "gauge", "Live conns, including those waiting for Accept.")
+		byLabel("webdial_conns", "transport", m.Conns)
+		metric("webdial_conns_by_client_version", "gauge", "Live conns by their client's webdial version.")
+		byLabel("webdial_conns_by_client_version", "client_version", m.ClientVersions)
+		metric("webdial_sessions", "gauge", "Live SSE sessions.")
+		fmt.Fprintf(w, "webdial_sessions %d\n", m.Sessions)
+		metric("webdial_handshakes_total", "counter", "Completed handshakes.")
+		byLabel("webdial_handshakes_total", "transport", m.Handshakes)
+		metric("webdial_rejected_total", "counter", "Handshakes and POSTs turned away with an error status.")
+		fmt.Fprintf(w, "webdial_rejected_total %d\n", m.Rejected)
+		metric("webdial_accepts_total", "counter", "Conns accepted.")
+		fmt.Fprintf(w, "webdial_accepts_total %d\n", m.Accepts)
+		metric("webdial_conn_errors_total", "counter", "Conns closed after a read or write error.")
+		fmt.Fprintf(w, "webdial_conn_errors_total %d\n", m.Errors)
+		metric("webdial_read_bytes_total", "counter", "Bytes read from clients.")
+		fmt.Fprintf(w, "webdial_read_bytes_total %d\n", m.BytesRead)
+		metric("webdial_written_bytes_total", "counter", "Bytes written to clients.")
+		fmt.Fprintf(w, "webdial_written_bytes_total %d\n", m.BytesWritten)
+		metric("webdial_accept_queue", "gauge", "Conns waiting for Accept.")
+		fmt.Fprintf(w, "webdial_accept_queue %d\n", m.AcceptQueue)
+	})
+}
@@ -0,0 +1,514 @@
+package webdial
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mux carries many independent streams over one webdial conn, so each
+// logical connection doesn't cost a full HTTP handshake. The client end
+// wraps its conn with NewClientMux, the server end wraps the accepted conn
+// with NewServerMux, and then either end opens streams with Open and
+// accepts the other's with AcceptStream. Each stream has its own flow
+// control window, so a stream whose reader falls behind doesn't hold up
+// the others.
+//
+// Frames are a 1-byte type, a 4-byte big-endian stream ID and a 4-byte
+// big-endian payload length, followed by the payload. Client streams have
+// odd IDs and server streams even ones.
+type Mux struct {
+	conn   net.Conn
+	client bool
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	acceptCh chan *Stream
+	done     chan struct{}
+	err      error // why the mux stopped
+}
+
+const (
+	frameOpen   byte = iota // a new stream, carrying its name
+	frameData               // stream bytes
+	frameWindow             // 4-byte count of bytes the receiver has read
+	frameClose              // the sender closed the stream
+)
+
+const (
+	muxHeaderLen = 9
+	// maxFramePayload is the most data a frame carries. Each frame is one
+	// write on the conn, so one POST over SSE.
+	maxFramePayload = 64 << 10
+	// streamWindow is how many unread bytes a stream may have in flight.
+	streamWindow = 256 << 10
+	// muxBacklog is how many opened streams may wait for AcceptStream
+	// before more are refused.
+	muxBacklog = 64
+	// maxStreamName bounds the names given to OpenNamed.
+	maxStreamName = 1024
+)
+
+var (
+	errMuxProtocol   = errors.New("webdial: mux protocol error")
+	errStreamRefused = errors.New("webdial: stream refused, accept backlog full")
+	errStreamName    = errors.New("webdial: stream name too long")
+	// errStreamClosed fails writes to a stream the peer closed.
+	errStreamClosed error = &connError{io.ErrClosedPipe}
+)
+
+// NewClientMux wraps the client end of conn as a Mux.
+func NewClientMux(conn net.Conn) *Mux {
+	return newMux(conn, true)
+}
+
+// NewServerMux wraps the server end of conn as a Mux.
+func NewServerMux(conn net.Conn) *Mux {
+	return newMux(conn, false)
+}
+
+func newMux(conn net.Conn, client bool) *Mux {
+	m := &Mux{
+		conn:     conn,
+		client:   client,
+		streams:  map[uint32]*Stream{},
+		nextID:   2,
+		acceptCh: make(chan *Stream, muxBacklog),
+		done:     make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open opens a new stream to the other end.
+func (m *Mux) Open() (*Stream, error) {
+	return m.OpenNamed("")
+}
+
+// OpenNamed opens a new stream called name, e.g. "logs" or "shell", which
+// the other end reads with Stream.Name to route it.
+func (m *Mux) OpenNamed(name string) (*Stream, error) {
+	if len(name) > maxStreamName {
+		return nil, errStreamName
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		defer m.mu.Unlock()
+		return nil, m.err
+	}
+	s := newStream(m, m.nextID, name)
+	m.nextID += 2
+	m.streams[s.id] = s
+	m.mu.Unlock()
+	if err := m.writeFrame(frameOpen, s.id, []byte(name)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for the other end to open a stream.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-m.acceptCh:
+		return s, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Accept is AcceptStream, so that a Mux is a net.Listener and can be
+// handed to http.Serve.
+func (m *Mux) Accept() (net.Conn, error) {
+	s, err := m.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr returns the conn's local address.
+func (m *Mux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// Close closes the conn and every stream.
+func (m *Mux) Close() error {
+	m.shutdown(net.ErrClosed)
+	return nil
+}
+
+// Done is closed once the mux has stopped, see Err.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the mux stopped, or nil while it's running.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// NumStreams returns the number of open streams.
+func (m *Mux) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+func (m *Mux) shutdown(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	err = netError(err)
+	m.err = err
+	streams := m.streams
+	m.streams = map[uint32]*Stream{}
+	m.mu.Unlock()
+	m.conn.Close()
+	for _, s := range streams {
+		s.fail(err)
+	}
+	close(m.done)
+}
+
+func (m *Mux) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderLen+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	copy(frame[muxHeaderLen:], payload)
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	if _, err := m.conn.Write(frame); err != nil {
+		m.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (m *Mux) readLoop() {
+	var hdr [muxHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(m.conn, hdr[:]); err != nil {
+			m.shutdown(err)
+			return
+		}
+		typ, id, size := hdr[0], binary.BigEndian.Uint32(hdr[1:]), binary.BigEndian.Uint32(hdr[5:])
+		if size > maxFramePayload {
+			m.shutdown(fmt.Errorf("%w: %d byte frame", errMuxProtocol, size))
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.shutdown(err)
+			return
+		}
+		if err := m.handle(typ, id, payload); err != nil {
+			m.shutdown(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) handle(typ byte, id uint32, payload []byte) error {
+	if typ == frameOpen {
+		return m.handleOpen(id, string(payload))
+	}
+	m.mu.Lock()
+	s := m.streams[id]
+	m.mu.Unlock()
+	if s == nil {
+		// Frames for a stream closed here may still be in flight.
+		return nil
+	}
+	switch typ {
+	case frameData:
+		return s.push(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: bad window update", errMuxProtocol)
+		}
+		s.addCredit(int(binary.BigEndian.Uint32(payload)))
+	case frameClose:
+		s.remoteClose()
+		m.forget(s)
+	default:
+		return fmt.Errorf("%w: frame type %d", errMuxProtocol, typ)
+	}
+	return nil
+}
+
+func (m *Mux) handleOpen(id uint32, name string) error {
+	if (id%2 == 1) == m.client {
+		return fmt.Errorf("%w: stream %d opened by the wrong end", errMuxProtocol, id)
+	}
+	if len(name) > maxStreamName {
+		return fmt.Errorf("%w: %v", errMuxProtocol, errStreamName)
+	}
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice", errMuxProtocol, id)
+	}
+	s := newStream(m, id, name)
+	m.streams[id] = s
+	m.mu.Unlock()
+	select {
+	case m.acceptCh <- s:
+	default:
+		s.fail(errStreamRefused)
+		m.forget(s)
+		m.writeFrame(frameClose, id, nil)
+	}
+	return nil
+}
+
+// forget removes s, which the peer will send nothing more for.
+func (m *Mux) forget(s *Stream) {
+	m.mu.Lock()
+	if m.streams[s.id] == s {
+		delete(m.streams, s.id)
+	}
+	m.mu.Unlock()
+}
+
+// Stream is one of a Mux's streams. It is a net.Conn, and closing it
+// closes both directions.
+type Stream struct {
+	mux  *Mux
+	id   uint32
+	name string
+
+	mu            sync.Mutex
+	buf           bytes.Buffer // received, not yet read
+	unacked       int          // read but not yet reported to the peer
+	credit        int          // bytes the peer can take
+	localClosed   bool
+	remoteClosed  bool
+	err           error // set if the mux stopped
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newStream(m *Mux, id uint32, name string) *Stream {
+	return &Stream{
+		mux:      m,
+		id:       id,
+		name:     name,
+		credit:   streamWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's ID, unique within its Mux.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Name returns the name the stream was opened with by OpenNamed, or "".
+func (s *Stream) Name() string {
+	return s.name
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.unacked += n
+			var ack int
+			if s.unacked >= streamWindow/4 {
+				ack, s.unacked = s.unacked, 0
+			}
+			s.mu.Unlock()
+			if ack > 0 {
+				s.mux.writeFrame(frameWindow, s.id, binary.BigEndian.AppendUint32(nil, uint32(ack)))
+			}
+			return n, nil
+		}
+		if s.remoteClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			defer s.mu.Unlock()
+			return 0, s.err
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+		if err := s.wait(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		s.mu.Lock()
+		switch {
+		case s.localClosed:
+			s.mu.Unlock()
+			return written, net.ErrClosed
+		case s.remoteClosed:
+			s.mu.Unlock()
+			return written, errStreamClosed
+		case s.err != nil:
+			defer s.mu.Unlock()
+			return written, s.err
+		}
+		if s.credit == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := s.wait(s.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), s.credit, maxFramePayload)
+		s.credit -= n
+		s.mu.Unlock()
+		if err := s.mux.writeFrame(frameData, s.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait blocks until ch is signalled, the deadline passes or the mux stops.
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-s.mux.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (s *Stream) push(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localClosed {
+		return nil
+	}
+	if s.buf.Len()+s.unacked+len(b) > streamWindow {
+		return fmt.Errorf("%w: stream %d overran its window", errMuxProtocol, s.id)
+	}
+	s.buf.Write(b)
+	signal(s.readable)
+	return nil
+}
+
+func (s *Stream) addCredit(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.mu.Unlock()
+	signal(s.writable)
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteClosed = true
+	s.mu.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+}
+
+func (s *Stream) fail(err error) {
+	s.mu.Lock()
+	s.err = netError(err)
+	s.mu.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+}
+
+// Close closes the stream. The peer reads io.EOF once it has read what
+// was sent before.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	notify := !s.remoteClosed && s.err == nil
+	s.buf.Reset()
+	s.mu.Unlock()
+	signal(s.readable)
+	signal(s.writable)
+	s.mux.forget(s)
+	if notify {
+		s.mux.writeFrame(frameClose, s.id, nil)
+	}
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.mux.conn.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.mux.conn.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	signal(s.readable)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	signal(s.writable)
+	return nil
+}
+
+// signal wakes a waiter on ch, if there is one.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
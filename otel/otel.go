@@ -0,0 +1,88 @@
+// Package otel adapts OpenTelemetry to webdial.Tracer, so that a Dialer's
+// "webdial.dial" spans and a Server's "webdial.handshake" and
+// "webdial.session" spans go to an OpenTelemetry TracerProvider, with the
+// trace context carried in the handshake's headers. It is a module of its
+// own so that webdial itself needn't depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/jpillora/webdial"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scope names the tracer spans are started with.
+const scope = "github.com/jpillora/webdial"
+
+// Tracer is a webdial.Tracer starting OpenTelemetry spans.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+var _ webdial.Tracer = (*Tracer)(nil)
+
+// NewTracer returns a Tracer starting spans with tp, such as
+// otel.GetTracerProvider(), and carrying trace context with p. A nil p
+// means W3C traceparent and tracestate headers.
+func NewTracer(tp trace.TracerProvider, p propagation.TextMapPropagator) *Tracer {
+	if p == nil {
+		p = propagation.TraceContext{}
+	}
+	return &Tracer{tracer: tp.Tracer(scope), propagator: p}
+}
+
+// Start implements webdial.Tracer.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, webdial.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attributes(attrs)...))
+	return ctx, spanAdapter{span}
+}
+
+// Inject implements webdial.Tracer.
+func (t *Tracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Extract implements webdial.Tracer.
+func (t *Tracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return t.propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+type spanAdapter struct{ span trace.Span }
+
+func (s spanAdapter) End(err error, attrs ...slog.Attr) {
+	s.span.SetAttributes(attributes(attrs)...)
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+func attributes(attrs []slog.Attr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		v := a.Value.Resolve()
+		switch v.Kind() {
+		case slog.KindString:
+			kvs = append(kvs, attribute.String(a.Key, v.String()))
+		case slog.KindInt64:
+			kvs = append(kvs, attribute.Int64(a.Key, v.Int64()))
+		case slog.KindUint64:
+			kvs = append(kvs, attribute.Int64(a.Key, int64(v.Uint64())))
+		case slog.KindFloat64:
+			kvs = append(kvs, attribute.Float64(a.Key, v.Float64()))
+		case slog.KindBool:
+			kvs = append(kvs, attribute.Bool(a.Key, v.Bool()))
+		default:
+			kvs = append(kvs, attribute.String(a.Key, v.String()))
+		}
+	}
+	return kvs
+}
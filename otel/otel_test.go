@@ -0,0 +1,91 @@
+package otel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jpillora/webdial"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		exporter := tracetest.NewInMemoryExporter()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		tracer := NewTracer(tp, nil)
+		srv := webdial.NewServer(webdial.WithConnTracer(tracer))
+		traceparent := make(chan string, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				traceparent <- r.Header.Get("traceparent")
+			}
+			srv.ServeHTTP(w, r)
+		}))
+		conn, err := webdial.Dial(context.Background(), ts.URL, webdial.WithTracer(tracer),
+			func(d *webdial.Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		go conn.Write([]byte("hi"))
+		_, err = io.ReadFull(sc, make([]byte, 2))
+		require.NoError(t, err, transport)
+		sc.Close()
+		conn.Close()
+
+		find := func(name string) (tracetest.SpanStub, bool) {
+			for _, s := range exporter.GetSpans() {
+				if s.Name == name {
+					return s, true
+				}
+			}
+			return tracetest.SpanStub{}, false
+		}
+		require.Eventually(t, func() bool {
+			_, ok := find("webdial.session")
+			return ok
+		}, 5*time.Second, 10*time.Millisecond, transport)
+		dial, ok := find("webdial.dial")
+		require.True(t, ok, transport)
+		handshake, ok := find("webdial.handshake")
+		require.True(t, ok, transport)
+		session, _ := find("webdial.session")
+
+		// The handshake carries the dial span as W3C trace context, which
+		// the server's spans continue.
+		require.Equal(t, fmt.Sprintf("00-%s-%s-01", dial.SpanContext.TraceID(), dial.SpanContext.SpanID()),
+			<-traceparent, transport)
+		require.True(t, handshake.Parent.IsRemote(), transport)
+		require.Equal(t, dial.SpanContext.SpanID(), handshake.Parent.SpanID(), transport)
+		require.Equal(t, dial.SpanContext.TraceID(), session.SpanContext.TraceID(), transport)
+		require.Equal(t, handshake.SpanContext.SpanID(), session.Parent.SpanID(), transport)
+		require.Contains(t, dial.Attributes, attribute.String("transport", transport), transport)
+		require.Contains(t, session.Attributes, attribute.Int64("read", 2), transport)
+		require.Equal(t, codes.Unset, session.Status.Code, transport)
+		ts.Close()
+		srv.Close()
+	}
+
+	// Rejected handshakes end their spans with an error.
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), nil)
+	srv := webdial.NewServer(webdial.WithConnTracer(tracer),
+		webdial.WithAcceptFilter(func(webdial.ConnInfo) bool { return false }))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	_, err := webdial.Dial(context.Background(), ts.URL, func(d *webdial.Dialer) { d.Transport = "sse" })
+	require.Error(t, err)
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "webdial.handshake", spans[0].Name)
+	require.Equal(t, codes.Error, spans[0].Status.Code)
+}
@@ -0,0 +1,77 @@
+package webdial
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPacketSize is the largest packet a PacketConn will carry.
+const maxPacketSize = 1<<16 - 1
+
+var errPacketTooLarge = errors.New("webdial: packet too large")
+
+// PacketConn adapts a webdial conn into a net.PacketConn with a single
+// peer, so datagram protocols such as QUIC (e.g. quic-go via
+// quic.Transport{Conn: pc}) can run over one webdial tunnel. Each packet is
+// sent as a 2-byte big-endian length followed by the payload. Both ends of
+// the tunnel must wrap their conn with NewPacketConn.
+type PacketConn struct {
+	conn    net.Conn
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+	hdr     [2]byte
+	buf     []byte
+}
+
+// NewPacketConn wraps conn as a PacketConn.
+func NewPacketConn(conn net.Conn) *PacketConn {
+	return &PacketConn{
+		conn: conn,
+		buf:  make([]byte, maxPacketSize),
+	}
+}
+
+// ReadFrom reads the next packet into b. If b is too small the packet is
+// truncated, as with UDP. The returned address is always the conn's
+// remote address.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if _, err := io.ReadFull(c.conn, c.hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(c.hdr[:]))
+	pkt := c.buf[:size]
+	if _, err := io.ReadFull(c.conn, pkt); err != nil {
+		return 0, nil, err
+	}
+	return copy(b, pkt), c.conn.RemoteAddr(), nil
+}
+
+// WriteTo writes b as a single packet. The address is ignored since a
+// PacketConn only has one peer.
+func (c *PacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if len(b) > maxPacketSize {
+		return 0, errPacketTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error        { return c.conn.Close() }
+func (c *PacketConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+func (c *PacketConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *PacketConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *PacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,117 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var errPoolClosed = errors.New("webdial: pool closed")
+
+// Pool keeps a number of pre-dialed conns to a webdial server ready to hand
+// out, re-filling in the background as they are taken. Dialing, especially
+// the SSE handshake, takes several round trips, so request-heavy clients
+// can use a Pool to keep it off the request path.
+type Pool struct {
+	dialer  Dialer
+	baseURL string
+	conns   chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// NewPool starts dialing size conns to baseURL using DefaultDialer,
+// modified by opts.
+func NewPool(baseURL string, size int, opts ...DialOption) *Pool {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.NewPool(baseURL, size)
+}
+
+// NewPool starts dialing size conns to baseURL.
+func (d *Dialer) NewPool(baseURL string, size int) *Pool {
+	p := &Pool{
+		dialer:  *d,
+		baseURL: baseURL,
+		conns:   make(chan net.Conn),
+	}
+	// Pooled conns outlive any one Get.
+	p.dialer.CloseOnCancel = false
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for range max(size, 1) {
+		p.wg.Add(1)
+		go p.fill()
+	}
+	return p
+}
+
+// fill keeps one conn ready until it is taken, then dials another.
+func (p *Pool) fill() {
+	defer p.wg.Done()
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := p.dialer.DialContext(p.ctx, p.baseURL)
+		if err != nil {
+			p.mu.Lock()
+			p.lastErr = err
+			p.mu.Unlock()
+			select {
+			case <-time.After(backoff):
+				backoff = min(2*backoff, 30*time.Second)
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		backoff = 100 * time.Millisecond
+		select {
+		case p.conns <- conn:
+		case <-p.ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Get returns a pooled conn, waiting for one to be dialed if none is ready.
+// The caller owns the conn and must close it.
+func (p *Pool) Get(ctx context.Context) (net.Conn, error) {
+	for {
+		select {
+		case conn := <-p.conns:
+			if st, ok := StateOf(conn); ok && st.Phase >= PhaseDraining {
+				// Dropped while idle.
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		case <-p.ctx.Done():
+			return nil, errPoolClosed
+		case <-ctx.Done():
+			p.mu.Lock()
+			lastErr := p.lastErr
+			p.mu.Unlock()
+			if lastErr != nil {
+				return nil, fmt.Errorf("webdial: no pooled conn: %w (last dial error: %v)", ctx.Err(), lastErr)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops re-filling the pool and closes its idle conns. Conns already
+// handed out by Get are unaffected.
+func (p *Pool) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
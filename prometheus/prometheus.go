@@ -0,0 +1,87 @@
+// Package prometheus exports a webdial Server's Metrics to Prometheus, as
+// a prometheus.Collector. It is a module of its own so that webdial
+// itself needn't depend on the Prometheus client library; without it,
+// Server.MetricsHandler serves the same metrics in the text format.
+package prometheus
+
+import (
+	"net/http"
+
+	"github.com/jpillora/webdial"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	buildInfoDesc = prom.NewDesc("webdial_build_info",
+		"The server's webdial version.", []string{"version"}, nil)
+	connsDesc = prom.NewDesc("webdial_conns",
+		"Live conns, including those waiting for Accept.", []string{"transport"}, nil)
+	clientVersionsDesc = prom.NewDesc("webdial_conns_by_client_version",
+		"Live conns by their client's webdial version.", []string{"client_version"}, nil)
+	sessionsDesc = prom.NewDesc("webdial_sessions",
+		"Live SSE sessions.", nil, nil)
+	handshakesDesc = prom.NewDesc("webdial_handshakes_total",
+		"Completed handshakes.", []string{"transport"}, nil)
+	rejectedDesc = prom.NewDesc("webdial_rejected_total",
+		"Handshakes and POSTs turned away with an error status.", nil, nil)
+	acceptsDesc = prom.NewDesc("webdial_accepts_total",
+		"Conns accepted.", nil, nil)
+	errorsDesc = prom.NewDesc("webdial_conn_errors_total",
+		"Conns closed after a read or write error.", nil, nil)
+	readDesc = prom.NewDesc("webdial_read_bytes_total",
+		"Bytes read from clients.", nil, nil)
+	writtenDesc = prom.NewDesc("webdial_written_bytes_total",
+		"Bytes written to clients.", nil, nil)
+	queueDesc = prom.NewDesc("webdial_accept_queue",
+		"Conns waiting for Accept.", nil, nil)
+)
+
+// Collector collects a Server's Metrics on each scrape.
+type Collector struct {
+	srv *webdial.Server
+}
+
+// NewCollector returns a Collector of srv's Metrics, for registering
+// with a prometheus.Registerer.
+func NewCollector(srv *webdial.Server) *Collector {
+	return &Collector{srv: srv}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	for _, d := range []*prom.Desc{buildInfoDesc, connsDesc, clientVersionsDesc, sessionsDesc,
+		handshakesDesc, rejectedDesc, acceptsDesc, errorsDesc, readDesc, writtenDesc, queueDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	m := c.srv.Metrics()
+	ch <- prom.MustNewConstMetric(buildInfoDesc, prom.GaugeValue, 1, m.Version)
+	for transport, n := range m.Conns {
+		ch <- prom.MustNewConstMetric(connsDesc, prom.GaugeValue, float64(n), transport)
+	}
+	for v, n := range m.ClientVersions {
+		ch <- prom.MustNewConstMetric(clientVersionsDesc, prom.GaugeValue, float64(n), v)
+	}
+	for transport, n := range m.Handshakes {
+		ch <- prom.MustNewConstMetric(handshakesDesc, prom.CounterValue, float64(n), transport)
+	}
+	ch <- prom.MustNewConstMetric(sessionsDesc, prom.GaugeValue, float64(m.Sessions))
+	ch <- prom.MustNewConstMetric(rejectedDesc, prom.CounterValue, float64(m.Rejected))
+	ch <- prom.MustNewConstMetric(acceptsDesc, prom.CounterValue, float64(m.Accepts))
+	ch <- prom.MustNewConstMetric(errorsDesc, prom.CounterValue, float64(m.Errors))
+	ch <- prom.MustNewConstMetric(readDesc, prom.CounterValue, float64(m.BytesRead))
+	ch <- prom.MustNewConstMetric(writtenDesc, prom.CounterValue, float64(m.BytesWritten))
+	ch <- prom.MustNewConstMetric(queueDesc, prom.GaugeValue, float64(m.AcceptQueue))
+}
+
+// Handler serves srv's metrics for mounting at /metrics, from a registry
+// of their own. To scrape them with others, register a Collector instead.
+func Handler(srv *webdial.Server) http.Handler {
+	reg := prom.NewRegistry()
+	reg.MustRegister(NewCollector(srv))
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,37 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jpillora/webdial"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	srv := webdial.NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := webdial.Dial(context.Background(), ts.URL, func(d *webdial.Dialer) { d.Transport = "ws" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+
+	problems, err := testutil.CollectAndLint(NewCollector(srv))
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	rec := httptest.NewRecorder()
+	Handler(srv).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `webdial_conns{transport="ws"} 1`)
+	require.Contains(t, string(body), `webdial_handshakes_total{transport="ws"} 1`)
+	require.Contains(t, string(body), "webdial_accepts_total 1")
+	require.Contains(t, string(body), `webdial_conns_by_client_version{client_version="`+srv.Version()+`"} 1`)
+}
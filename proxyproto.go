@@ -0,0 +1,112 @@
+package webdial
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// WithProxyProtocol starts every conn WithForward dials with a PROXY
+// protocol v2 header, so backends that understand it, such as HAProxy,
+// nginx or Postgres behind a proxy-aware pooler, see the webdial client's
+// address rather than the server's. Backends must expect the header, or
+// they'll take it for data. Without WithForward it does nothing.
+func WithProxyProtocol() ServerOption {
+	return func(s *Server) { s.proxyProtocol = true }
+}
+
+// proxySignature starts every PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyLocal = 0x20 // version 2, LOCAL: no addresses
+	proxyProxy = 0x21 // version 2, PROXY
+	proxyTCP4  = 0x11
+	proxyTCP6  = 0x21
+)
+
+// proxyHeader returns the PROXY protocol v2 header for a conn from src to
+// dst. Addresses that aren't TCP give a LOCAL header, which tells the
+// backend to use the connection's own addresses.
+func proxyHeader(src, dst net.Addr) []byte {
+	h := bytes.Clone(proxySignature)
+	s, sok := tcpAddrPort(src)
+	d, dok := tcpAddrPort(dst)
+	if !sok || !dok {
+		return append(h, proxyLocal, 0, 0, 0)
+	}
+	if s.Addr().Is4() && d.Addr().Is4() {
+		h = append(h, proxyProxy, proxyTCP4, 0, 12)
+		h = append(h, s.Addr().AsSlice()...)
+		h = append(h, d.Addr().AsSlice()...)
+	} else {
+		h = append(h, proxyProxy, proxyTCP6, 0, 36)
+		s16, d16 := s.Addr().As16(), d.Addr().As16()
+		h = append(h, s16[:]...)
+		h = append(h, d16[:]...)
+	}
+	h = binary.BigEndian.AppendUint16(h, s.Port())
+	return binary.BigEndian.AppendUint16(h, d.Port())
+}
+
+func tcpAddrPort(a net.Addr) (netip.AddrPort, bool) {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	ap := ta.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+}
+
+// serverAddr returns the local address a handshake request arrived on.
+func serverAddr(r *http.Request) net.Addr {
+	a, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return a
+}
+
+// ReadProxyHeader reads a PROXY protocol v2 header from r, such as the
+// one WithProxyProtocol sends, returning the client address it carries
+// and the address the client connected to. Both are nil for a LOCAL
+// header. It reads only the header, so r can be a net.Conn whose data
+// follows.
+func ReadProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(h[:12], proxySignature) || h[12]>>4 != 2 {
+		return nil, nil, errors.New("webdial: not a PROXY protocol v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if h[12] == proxyLocal {
+		return nil, nil, nil
+	}
+	var size int
+	switch h[13] {
+	case proxyTCP4:
+		size = 4
+	case proxyTCP6:
+		size = 16
+	default:
+		return nil, nil, fmt.Errorf("webdial: unsupported PROXY protocol family %#x", h[13])
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("webdial: short PROXY protocol header")
+	}
+	ip := func(b []byte) netip.Addr {
+		a, _ := netip.AddrFromSlice(b)
+		return a.Unmap()
+	}
+	ports := body[2*size:]
+	src = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip(body[:size]), binary.BigEndian.Uint16(ports)))
+	dst = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip(body[size:2*size]), binary.BigEndian.Uint16(ports[2:])))
+	return src, dst, nil
+}
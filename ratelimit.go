@@ -0,0 +1,125 @@
+package webdial
+
+import (
+	"sync"
+	"time"
+)
+
+// WithRateLimit throttles the conn to bytesPerSec in each direction, with
+// bursts of up to a second's worth, so background transfers leave room on
+// the link for everything else.
+func WithRateLimit(bytesPerSec int) DialOption {
+	return func(d *Dialer) { d.RateLimit = bytesPerSec }
+}
+
+// WithConnRateLimit throttles every accepted conn to bytesPerSec in each
+// direction, with bursts of up to burst bytes, or a second's worth if
+// burst is zero, so one tunnel can't starve the others.
+func WithConnRateLimit(bytesPerSec, burst int) ServerOption {
+	return func(s *Server) {
+		s.connRate, s.connBurst = bytesPerSec, burst
+	}
+}
+
+// WithTotalRateLimit caps the bytes per second read, and separately
+// written, across all of the Server's conns, as WithConnRateLimit does
+// for each.
+func WithTotalRateLimit(bytesPerSec, burst int) ServerOption {
+	return func(s *Server) {
+		s.totalRead = newTokenBucket(bytesPerSec, burst)
+		s.totalWrite = newTokenBucket(bytesPerSec, burst)
+	}
+}
+
+// rateLimit applies the Server's per-conn settings to sc: its tap, write
+// buffer and rate limits.
+func (s *Server) rateLimit(sc *ServerConn) {
+	sc.tap = s.connTap
+	if s.connWriteBuffer > 0 {
+		sc.wbuf = newWriteBuffer(sc.write, s.connWriteBuffer)
+	}
+	if s.connRate > 0 {
+		sc.readRate = append(sc.readRate, newTokenBucket(s.connRate, s.connBurst))
+		sc.writeRate = append(sc.writeRate, newTokenBucket(s.connRate, s.connBurst))
+	}
+	if s.totalRead != nil {
+		sc.readRate = append(sc.readRate, s.totalRead)
+		sc.writeRate = append(sc.writeRate, s.totalWrite)
+	}
+}
+
+// tokenBuckets throttles a byte stream to the slowest of several buckets.
+type tokenBuckets []*tokenBucket
+
+// chunk is the most that may be read or written in one go.
+func (bs tokenBuckets) chunk(n int) int {
+	for _, b := range bs {
+		n = min(n, b.burst)
+	}
+	return n
+}
+
+func (bs tokenBuckets) take(n int) {
+	for _, b := range bs {
+		b.take(n)
+	}
+}
+
+// tokenBucket limits a byte stream to rate bytes per second. Takers may
+// overdraw it and then sleep off the debt, so a single large read or write
+// is never starved.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket holding burst tokens, or a
+// second's worth if burst is zero.
+func newTokenBucket(bytesPerSec, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	burst = max(burst, 1)
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accrued since the last call. b.mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, float64(b.burst))
+	b.last = now
+}
+
+// tryTake removes n tokens if the bucket has them, otherwise reporting
+// how long until it will.
+func (b *tokenBucket) tryTake(n int) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < float64(n) {
+		return time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens -= float64(n)
+	return 0, true
+}
+
+// take removes n tokens, sleeping until the bucket is out of debt.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
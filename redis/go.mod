@@ -0,0 +1,25 @@
+module github.com/jpillora/webdial/redis
+
+go 1.25.6
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/jpillora/webdial v0.0.0-20261014124615-0c366fac0fc8
+	github.com/redis/go-redis/v9 v9.22.0
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/jpillora/eventsource v1.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+// For development in this repository; ignored by modules requiring this one.
+replace github.com/jpillora/webdial => ../
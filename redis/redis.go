@@ -0,0 +1,336 @@
+// Package redis is a webdial.SessionStore shared through Redis, so that a
+// fleet of servers behind a load balancer that doesn't keep a client's
+// POSTs on one server can accept POSTs for any SSE session. It is a
+// module of its own so that webdial itself needn't depend on a Redis
+// client.
+//
+// Each server has its own Store, named for it. Storing a session records
+// in Redis that this server holds its stream, and Load on any other
+// server returns a Session relaying to it over Redis publish/subscribe,
+// POST bodies included.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/webdial"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Options configures a Store. The zero value is usable.
+type Options struct {
+	// Prefix starts the store's keys and channels, so that fleets can
+	// share a Redis. Empty means "webdial".
+	Prefix string
+	// TTL is how long a session outlives its server in Redis if that
+	// server goes away without deleting it. The server refreshes its
+	// sessions well within it. Zero means a minute.
+	TTL time.Duration
+	// Timeout bounds each call relayed to another server, and Redis
+	// commands. Zero means 30 seconds.
+	Timeout time.Duration
+}
+
+// Store is a webdial.SessionStore shared through Redis, see the package
+// documentation.
+type Store struct {
+	client  goredis.UniversalClient
+	owner   string
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	pubsub  *goredis.PubSub
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	local sync.Map // map[string]webdial.Session, those held here
+
+	calls   atomic.Uint64
+	mu      sync.Mutex
+	pending map[uint64]chan message // calls waiting for a reply
+}
+
+// NewStore returns the Store of the server named owner, which must be
+// unique in the fleet, e.g. the pod's name. It subscribes to the calls
+// other servers relay to it until Close.
+func NewStore(client goredis.UniversalClient, owner string, opts Options) (*Store, error) {
+	s := &Store{
+		client:  client,
+		owner:   owner,
+		prefix:  opts.Prefix,
+		ttl:     opts.TTL,
+		timeout: opts.Timeout,
+		pending: map[uint64]chan message{},
+	}
+	if s.prefix == "" {
+		s.prefix = "webdial"
+	}
+	if s.ttl <= 0 {
+		s.ttl = time.Minute
+	}
+	if s.timeout <= 0 {
+		s.timeout = 30 * time.Second
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.pubsub = client.Subscribe(s.ctx, s.channel(owner))
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+	if _, err := s.pubsub.Receive(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// Close unsubscribes, after which other servers can't reach this one's
+// sessions.
+func (s *Store) Close() error {
+	s.cancel()
+	return s.pubsub.Close()
+}
+
+func (s *Store) key(id string) string        { return s.prefix + ":session:" + id }
+func (s *Store) channel(owner string) string { return s.prefix + ":server:" + owner }
+
+// entry is what Redis holds for each session.
+type entry struct {
+	Owner   string `json:"owner"`
+	Binding string `json:"binding,omitempty"`
+}
+
+// Store records that this server holds sess.
+func (s *Store) Store(id string, sess webdial.Session) {
+	s.local.Store(id, sess)
+	s.publish(id, sess)
+}
+
+func (s *Store) publish(id string, sess webdial.Session) error {
+	b, _ := json.Marshal(entry{Owner: s.owner, Binding: sess.Binding()})
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+	return s.client.Set(ctx, s.key(id), b, s.ttl).Err()
+}
+
+// Load returns the session if this server holds it, or else one relaying
+// to the server that does.
+func (s *Store) Load(id string) (webdial.Session, bool) {
+	if sess, ok := s.local.Load(id); ok {
+		return sess.(webdial.Session), true
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+	b, err := s.client.Get(ctx, s.key(id)).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	var e entry
+	if json.Unmarshal(b, &e) != nil || e.Owner == s.owner {
+		// Ours, but gone.
+		return nil, false
+	}
+	return &relay{store: s, id: id, entry: e}, true
+}
+
+// Delete forgets a session this server held.
+func (s *Store) Delete(id string) {
+	s.local.Delete(id)
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+	s.client.Del(ctx, s.key(id))
+}
+
+// message is a call relayed to a session's server, or its reply.
+type message struct {
+	Op      string `json:"op"`
+	Session string `json:"session,omitempty"`
+	// Call numbers a call expecting a reply at From; zero expects none.
+	Call   uint64 `json:"call,omitempty"`
+	From   string `json:"from,omitempty"`
+	Seq    int64  `json:"seq"`
+	Key    string `json:"key,omitempty"`
+	Body   []byte `json:"body,omitempty"`
+	N      int64  `json:"n,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+const (
+	opTouch         = "touch"
+	opPost          = "post"
+	opCredit        = "credit"
+	opClose         = "close"
+	opCloseByClient = "close-by-client"
+	opReply         = "reply"
+)
+
+// run serves calls from other servers, and their replies to ours, and
+// refreshes this server's sessions in Redis.
+func (s *Store) run() {
+	refresh := time.NewTicker(s.ttl / 3)
+	defer refresh.Stop()
+	ch := s.pubsub.Channel()
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			var msg message
+			if json.Unmarshal([]byte(m.Payload), &msg) != nil {
+				continue
+			}
+			if msg.Op == opReply {
+				s.reply(msg)
+				continue
+			}
+			// Sequenced POSTs wait for those before them.
+			go s.serve(msg)
+		case <-refresh.C:
+			s.local.Range(func(id, sess any) bool {
+				s.publish(id.(string), sess.(webdial.Session))
+				return true
+			})
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// serve runs a call relayed from another server on the session held here.
+func (s *Store) serve(msg message) {
+	v, ok := s.local.Load(msg.Session)
+	if !ok {
+		s.respond(msg, errors.New("webdial: session not found"))
+		return
+	}
+	sess := v.(webdial.Session)
+	var err error
+	switch msg.Op {
+	case opTouch:
+		sess.Touch()
+	case opPost:
+		ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+		err = sess.Post(ctx, msg.Seq, msg.Key, bytes.NewReader(msg.Body))
+		cancel()
+	case opCredit:
+		sess.Credit(msg.N)
+	case opClose:
+		err = sess.Close()
+	case opCloseByClient:
+		err = sess.CloseByClient(int(msg.N), msg.Reason)
+	}
+	s.respond(msg, err)
+}
+
+func (s *Store) respond(msg message, err error) {
+	if msg.Call == 0 {
+		return
+	}
+	reply := message{Op: opReply, Call: msg.Call}
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	s.send(s.ctx, msg.From, reply)
+}
+
+func (s *Store) reply(msg message) {
+	s.mu.Lock()
+	ch := s.pending[msg.Call]
+	delete(s.pending, msg.Call)
+	s.mu.Unlock()
+	if ch != nil {
+		ch <- msg
+	}
+}
+
+func (s *Store) send(ctx context.Context, owner string, msg message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Publish(ctx, s.channel(owner), b).Err()
+}
+
+// call sends msg to owner and waits for its reply.
+func (s *Store) call(ctx context.Context, owner string, msg message) error {
+	msg.Call, msg.From = s.calls.Add(1), s.owner
+	ch := make(chan message, 1)
+	s.mu.Lock()
+	s.pending[msg.Call] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, msg.Call)
+		s.mu.Unlock()
+	}()
+	if err := s.send(ctx, owner, msg); err != nil {
+		return err
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-ch:
+		if reply.Err != "" {
+			return errors.New(reply.Err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return context.DeadlineExceeded
+	case <-s.ctx.Done():
+		return errors.New("webdial: session store closed")
+	}
+}
+
+// relay is a session held by another server.
+type relay struct {
+	store *Store
+	id    string
+	entry
+}
+
+func (r *relay) msg(op string) message { return message{Op: op, Session: r.id} }
+
+func (r *relay) Touch() {
+	r.store.send(r.store.ctx, r.Owner, r.msg(opTouch))
+}
+
+// Post relays body whole, so it is best bounded with WithMaxPostSize.
+func (r *relay) Post(ctx context.Context, seq int64, key string, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	msg := r.msg(opPost)
+	msg.Seq, msg.Key, msg.Body = seq, key, b
+	return r.store.call(ctx, r.Owner, msg)
+}
+
+func (r *relay) Credit(n int64) {
+	msg := r.msg(opCredit)
+	msg.N = n
+	r.store.send(r.store.ctx, r.Owner, msg)
+}
+
+func (r *relay) Close() error {
+	return r.store.call(r.store.ctx, r.Owner, r.msg(opClose))
+}
+
+func (r *relay) CloseByClient(code int, reason string) error {
+	msg := r.msg(opCloseByClient)
+	msg.N, msg.Reason = int64(code), reason
+	return r.store.call(r.store.ctx, r.Owner, msg)
+}
+
+func (r *relay) Binding() string { return r.entry.Binding }
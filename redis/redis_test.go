@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jpillora/webdial"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newServer := func(name string) *webdial.Server {
+		client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		store, err := NewStore(client, name, Options{})
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		srv := webdial.NewServer(webdial.WithSessionStore(store))
+		t.Cleanup(func() { srv.Close() })
+		return srv
+	}
+	a, b := newServer("a"), newServer("b")
+	// A load balancer sending the streams to a and the POSTs to b, which
+	// share nothing but Redis.
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			b.ServeHTTP(w, r)
+			return
+		}
+		a.ServeHTTP(w, r)
+	}))
+	defer lb.Close()
+
+	conn, err := webdial.Dial(context.Background(), lb.URL, func(d *webdial.Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := a.Accept()
+	require.NoError(t, err)
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	_, err = sc.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf))
+	_, err = conn.Ping(context.Background())
+	require.NoError(t, err)
+
+	// Closing relays too.
+	require.NoError(t, conn.Close())
+	_, err = sc.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+
+	// Unknown sessions aren't found anywhere.
+	resp, err := http.Post(lb.URL+"?s=nope", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
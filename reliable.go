@@ -0,0 +1,419 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrBufferFull is returned by ReliableConn.Write when the transport is down
+// and the reconnect buffer can't hold the write.
+var ErrBufferFull = errors.New("webdial: reconnect buffer full")
+
+// ReconnectPolicy configures how a ReliableConn re-dials.
+type ReconnectPolicy struct {
+	// MinBackoff is the delay before the first retry. Zero means 500ms.
+	MinBackoff time.Duration
+	// MaxBackoff caps the exponential backoff. Zero means 30 seconds.
+	MaxBackoff time.Duration
+	// MaxBuffer is how many bytes of writes are held while reconnecting.
+	// Zero means 1MiB.
+	MaxBuffer int
+}
+
+// WithReconnect sets the policy used by DialReliable.
+func WithReconnect(p ReconnectPolicy) DialOption {
+	return func(d *Dialer) { d.Reconnect = p }
+}
+
+// DialReliable is like Dial but returns a conn that transparently re-dials,
+// with exponential backoff and jitter, whenever the transport drops.
+func DialReliable(ctx context.Context, baseURL string, opts ...DialOption) (*ReliableConn, error) {
+	d := *DefaultDialer
+	for _, opt := range opts {
+		opt(&d)
+	}
+	return d.DialReliable(ctx, baseURL)
+}
+
+// DialReliable is like DialContext but returns a conn that transparently
+// re-dials whenever the transport drops. Only the initial dial is bound by
+// ctx.
+func (d *Dialer) DialReliable(ctx context.Context, baseURL string) (*ReliableConn, error) {
+	conn, err := d.DialContext(ctx, baseURL)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReliableConn{
+		dialer:  *d,
+		baseURL: baseURL,
+		conn:    conn,
+		ready:   make(chan struct{}),
+	}
+	// Re-dials aren't bound to the first dial's context.
+	r.dialer.CloseOnCancel = false
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	close(r.ready)
+	return r, nil
+}
+
+// ReliableConn is a net.Conn that survives transport failures by
+// re-dialing. The server sees every reconnect as a new conn, and bytes in
+// flight when the transport dropped may be lost, so it suits protocols that
+// can resynchronise, such as long-lived agents sending whole messages.
+//
+// It gives up, with Read and Write returning why, when the server closes
+// the conn other than by shutting down, as io.EOF or a *CloseError, or
+// when a re-dial is turned away in a way retrying won't change, such as
+// with a *VersionError or 403 Forbidden.
+type ReliableConn struct {
+	dialer  Dialer
+	baseURL string
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu            sync.Mutex
+	conn          net.Conn      // nil while reconnecting
+	ready         chan struct{} // closed once conn is set
+	pending       []byte        // writes held while reconnecting
+	flushing      net.Conn      // the new conn while pending is sent
+	reconnects    int
+	pastStats     Stats // totals from conns before the current one
+	closed        bool
+	err           error // why the conn gave up, see fail
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Reconnects returns how many times the conn has re-dialed.
+func (r *ReliableConn) Reconnects() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reconnects
+}
+
+// Stats returns counters totalled across every transport conn so far,
+// with the RTT and transport of the current one.
+func (r *ReliableConn) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := r.pastStats
+	if sc, ok := r.conn.(interface{ Stats() Stats }); ok {
+		cur := sc.Stats()
+		st = cur.add(st)
+	}
+	st.Reconnects = r.reconnects
+	return st
+}
+
+func (r *ReliableConn) Read(b []byte) (int, error) {
+	for {
+		c, err := r.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := c.Read(b)
+		if err == nil || isTimeout(err) {
+			return n, err
+		}
+		if closedByServer(c, err) {
+			r.mu.Lock()
+			if r.conn == c {
+				r.fail(err)
+			}
+			r.mu.Unlock()
+		} else {
+			r.broken(c)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// closedByServer reports whether err is c's server closing it for good,
+// rather than the transport dropping or the server shutting down, after
+// which a new conn would be welcome elsewhere.
+func closedByServer(c net.Conn, err error) bool {
+	var ce *CloseError
+	if !errors.Is(err, io.EOF) && !errors.As(err, &ce) {
+		return false
+	}
+	if d, ok := c.(interface{ Draining() <-chan struct{} }); ok {
+		select {
+		case <-d.Draining():
+			return false
+		default:
+		}
+	}
+	return true
+}
+
+func (r *ReliableConn) Write(b []byte) (int, error) {
+	var written int
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if r.err != nil {
+			r.mu.Unlock()
+			return written, r.err
+		}
+		c := r.conn
+		if c == nil {
+			defer r.mu.Unlock()
+			if _, err := r.buffer(b); err != nil {
+				return written, err
+			}
+			return written + len(b), nil
+		}
+		r.mu.Unlock()
+		n, err := c.Write(b)
+		written += n
+		b = b[n:]
+		if err == nil || isTimeout(err) {
+			return written, err
+		}
+		// Another write may have broken c already and a new conn be in
+		// place, in which case the rest goes there, after what that
+		// write buffered, rather than waiting for the next drop.
+		r.broken(c)
+	}
+}
+
+// buffer holds b until the next reconnect. r.mu must be held.
+func (r *ReliableConn) buffer(b []byte) (int, error) {
+	if len(r.pending)+len(b) > r.maxBuffer() {
+		return 0, ErrBufferFull
+	}
+	r.pending = append(r.pending, b...)
+	return len(b), nil
+}
+
+// current waits for a connected transport.
+func (r *ReliableConn) current() (net.Conn, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if r.err != nil {
+		r.mu.Unlock()
+		return nil, r.err
+	}
+	if r.conn != nil {
+		c := r.conn
+		r.mu.Unlock()
+		return c, nil
+	}
+	ready, deadline := r.ready, r.readDeadline
+	r.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ready:
+		return r.current()
+	case <-r.ctx.Done():
+		// Closed, or given up.
+		return r.current()
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// fail gives up on the conn, so that Read and Write return err. r.mu must
+// be held.
+func (r *ReliableConn) fail(err error) {
+	if r.closed || r.err != nil {
+		return
+	}
+	r.err = err
+	r.cancel()
+	if r.conn == nil {
+		// Wake Reads waiting for the reconnect.
+		close(r.ready)
+		return
+	}
+	r.conn.Close()
+	if sc, ok := r.conn.(interface{ Stats() Stats }); ok {
+		r.pastStats = r.pastStats.add(sc.Stats())
+	}
+	r.conn = nil
+}
+
+// broken starts reconnecting, unless c was already replaced.
+func (r *ReliableConn) broken(c net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != c || r.closed {
+		return
+	}
+	c.Close()
+	if sc, ok := c.(interface{ Stats() Stats }); ok {
+		r.pastStats = r.pastStats.add(sc.Stats())
+	}
+	r.conn = nil
+	r.ready = make(chan struct{})
+	go r.reconnect()
+}
+
+func (r *ReliableConn) reconnect() {
+	backoff := r.minBackoff()
+	for {
+		// Equal jitter: between half and all of the current backoff.
+		delay := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, r.maxBackoff())
+		conn, err := r.dialer.DialContext(r.ctx, r.baseURL)
+		if err != nil {
+			if rejected(err) {
+				r.mu.Lock()
+				r.fail(err)
+				r.mu.Unlock()
+				return
+			}
+			continue
+		}
+		if !r.flush(conn) {
+			conn.Close()
+			continue
+		}
+		return
+	}
+}
+
+// flush sends the writes held while reconnecting to conn, then puts conn
+// in place, reporting false if it failed or the ReliableConn was closed.
+// r.mu isn't held while sending, so Close and Write don't wait on it;
+// writes meanwhile are held too, and go after.
+func (r *ReliableConn) flush(conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.flushing = conn
+	defer func() { r.flushing = nil }()
+	for len(r.pending) > 0 {
+		pending := r.pending
+		r.pending = nil
+		conn.SetWriteDeadline(r.writeDeadline)
+		r.mu.Unlock()
+		n, err := conn.Write(pending)
+		r.mu.Lock()
+		if err != nil || r.closed {
+			// Keep what wasn't sent for the next conn.
+			r.pending = append(pending[n:], r.pending...)
+			return false
+		}
+	}
+	conn.SetReadDeadline(r.readDeadline)
+	conn.SetWriteDeadline(r.writeDeadline)
+	r.conn = conn
+	r.reconnects++
+	close(r.ready)
+	return true
+}
+
+func (r *ReliableConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cancel()
+	if r.flushing != nil {
+		r.flushing.Close()
+	}
+	if r.conn != nil {
+		return r.conn.Close()
+	}
+	return nil
+}
+
+func (r *ReliableConn) LocalAddr() net.Addr {
+	if c := r.snapshot(); c != nil {
+		return c.LocalAddr()
+	}
+	return addr{transport: "reliable", url: "local"}
+}
+
+func (r *ReliableConn) RemoteAddr() net.Addr {
+	if c := r.snapshot(); c != nil {
+		return c.RemoteAddr()
+	}
+	return addr{transport: "reliable", url: r.baseURL}
+}
+
+func (r *ReliableConn) SetDeadline(t time.Time) error {
+	r.SetReadDeadline(t)
+	return r.SetWriteDeadline(t)
+}
+
+func (r *ReliableConn) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readDeadline = t
+	if r.conn != nil {
+		return r.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (r *ReliableConn) SetWriteDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeDeadline = t
+	if r.conn != nil {
+		return r.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (r *ReliableConn) snapshot() net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+func (r *ReliableConn) minBackoff() time.Duration {
+	if r.dialer.Reconnect.MinBackoff > 0 {
+		return r.dialer.Reconnect.MinBackoff
+	}
+	return 500 * time.Millisecond
+}
+
+func (r *ReliableConn) maxBackoff() time.Duration {
+	if r.dialer.Reconnect.MaxBackoff > 0 {
+		return r.dialer.Reconnect.MaxBackoff
+	}
+	return 30 * time.Second
+}
+
+func (r *ReliableConn) maxBuffer() int {
+	if r.dialer.Reconnect.MaxBuffer > 0 {
+		return r.dialer.Reconnect.MaxBuffer
+	}
+	return 1 << 20
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
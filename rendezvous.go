@@ -0,0 +1,137 @@
+package webdial
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// roomHeader carries the room a client wants to be paired in. There's no
+// query parameter fallback, so that applications keep their own "room"
+// parameters.
+const roomHeader = "X-Webdial-Room"
+
+// WithRoom asks a WithRendezvous server to pair the conn with another
+// client dialing the same room. The room should be a secret shared by the
+// two clients, since anyone who knows it can take the other's place.
+func WithRoom(room string) DialOption {
+	return func(d *Dialer) { d.Room = room }
+}
+
+// WithRendezvous makes the Server a relay for clients behind NAT: conns
+// dialed with WithRoom never reach Accept, and are instead held until a
+// second client dials the same room, when bytes are copied between the
+// two until either closes. Bytes a client writes while waiting are kept
+// for its peer.
+func WithRendezvous() ServerOption {
+	return func(s *Server) {
+		s.rooms = &roomTable{waiting: map[string]*roomWaiter{}}
+	}
+}
+
+type roomTable struct {
+	mu      sync.Mutex
+	waiting map[string]*roomWaiter
+}
+
+// roomWaiter is a conn waiting for its peer, read ahead into data so that
+// it's noticed if it closes first.
+type roomWaiter struct {
+	conn *ServerConn
+	data chan []byte // closed once conn's reads fail
+	done chan struct{}
+}
+
+func requestRoom(r *http.Request) string {
+	return r.Header.Get(roomHeader)
+}
+
+// roomAllowed rejects rooms when WithRendezvous isn't enabled.
+func (s *Server) roomAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if s.rooms == nil && requestRoom(r) != "" {
+		s.reject(w, r, http.StatusForbidden, "webdial: rendezvous not enabled", "")
+		return false
+	}
+	return true
+}
+
+// pairConn takes over conn if it dialed a room, reporting whether it did.
+func (s *Server) pairConn(conn *ServerConn) bool {
+	room := requestRoom(conn.Request())
+	if s.rooms == nil || room == "" {
+		return false
+	}
+	conn.internal.Store(true)
+	s.accepted(conn)
+	s.rooms.mu.Lock()
+	if w, ok := s.rooms.waiting[room]; ok {
+		delete(s.rooms.waiting, room)
+		s.rooms.mu.Unlock()
+		s.logger.Debug("room paired", slog.String("id", conn.ID()), slog.String("peer", w.conn.ID()))
+		go w.relay(conn)
+		return true
+	}
+	w := &roomWaiter{conn: conn, data: make(chan []byte, 4), done: make(chan struct{})}
+	s.rooms.waiting[room] = w
+	s.rooms.mu.Unlock()
+	go func() {
+		w.readAhead()
+		s.rooms.mu.Lock()
+		if s.rooms.waiting[room] == w {
+			delete(s.rooms.waiting, room)
+		}
+		s.rooms.mu.Unlock()
+	}()
+	return true
+}
+
+func (w *roomWaiter) readAhead() {
+	defer close(w.data)
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := w.conn.Read(buf)
+		if n > 0 {
+			select {
+			case w.data <- buf[:n]:
+			case <-w.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relay copies between the waiter and its peer until either is done.
+func (w *roomWaiter) relay(peer *ServerConn) {
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(w.done)
+			w.conn.Close()
+			peer.Close()
+		})
+	}
+	go func() {
+		for b := range w.data {
+			if _, err := peer.Write(b); err != nil {
+				break
+			}
+		}
+		stop()
+	}()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := peer.Read(buf)
+		if n > 0 {
+			if _, werr := w.conn.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	stop()
+}
@@ -0,0 +1,51 @@
+package webdial
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WithReplica prepares a Server for running as one of several replicas
+// behind a load balancer that doesn't route SSE POSTs back to the replica
+// holding the session. Session IDs are prefixed with id, which must not
+// contain ".", and POSTs for another replica's sessions are proxied to
+// route(replica). If route returns nil, they get 404 like any unknown
+// session.
+func WithReplica(id string, route func(replica string) *url.URL) ServerOption {
+	return func(s *Server) {
+		s.replica = &replicaRouter{id: id, route: route}
+	}
+}
+
+type replicaRouter struct {
+	id      string
+	route   func(replica string) *url.URL
+	proxies sync.Map // map[string]*httputil.ReverseProxy, by target URL
+}
+
+// owner returns the replica holding sid, reporting false if it's this
+// one or sid names none.
+func (rr *replicaRouter) owner(sid string) (string, bool) {
+	replica, _, ok := strings.Cut(sid, ".")
+	return replica, ok && replica != rr.id
+}
+
+// proxy returns the handler forwarding POSTs to replica, or nil if it
+// has no route.
+func (rr *replicaRouter) proxy(replica string) http.Handler {
+	if rr.route == nil {
+		return nil
+	}
+	u := rr.route(replica)
+	if u == nil {
+		return nil
+	}
+	if p, ok := rr.proxies.Load(u.String()); ok {
+		return p.(http.Handler)
+	}
+	p, _ := rr.proxies.LoadOrStore(u.String(), httputil.NewSingleHostReverseProxy(u))
+	return p.(http.Handler)
+}
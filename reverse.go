@@ -0,0 +1,205 @@
+package webdial
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// listenHeader names the listener a client's control conn registers, and
+// reverseHeader carries the token of the server dial a conn answers. Both
+// fall back to the listen and reverse query parameters, as targetHeader
+// does.
+const (
+	listenHeader  = "X-Webdial-Listen"
+	reverseHeader = "X-Webdial-Reverse"
+)
+
+// WithReverse lets clients register as listeners that the server can dial
+// back through with DialClient, to reach services behind NAT. A listener
+// is a control conn whose handshake names it; it never reaches Accept.
+// For each DialClient the server sends a token down the control conn, and
+// the client answers with a new conn carrying the token, which DialClient
+// returns. Registration passes through WithAuth and WithAcceptFilter like
+// any other handshake, so use them to decide who may listen under which
+// name.
+func WithReverse() ServerOption {
+	return func(s *Server) {
+		s.reverse = &reverseTable{
+			listeners: map[string]*reverseListener{},
+			pending:   map[string]chan *ServerConn{},
+		}
+	}
+}
+
+type reverseTable struct {
+	mu        sync.Mutex
+	listeners map[string]*reverseListener
+	pending   map[string]chan *ServerConn // by token
+}
+
+type reverseListener struct {
+	conn    *ServerConn
+	writeMu sync.Mutex
+}
+
+func requestListen(r *http.Request) (string, bool) {
+	if r.Header.Get(listenHeader) != "" {
+		return r.Header.Get(listenHeader), true
+	}
+	return r.URL.Query().Get("listen"), r.URL.Query().Has("listen")
+}
+
+func requestReverse(r *http.Request) string {
+	if t := r.Header.Get(reverseHeader); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("reverse")
+}
+
+// reverseAllowed checks a listener registration or reverse conn before
+// its handshake completes, writing the rejection if it fails.
+func (s *Server) reverseAllowed(w http.ResponseWriter, r *http.Request) bool {
+	name, listen := requestListen(r)
+	token := requestReverse(r)
+	if !listen && token == "" {
+		return true
+	}
+	if s.reverse == nil {
+		s.reject(w, r, http.StatusForbidden, "webdial: reverse dialing not enabled", "")
+		return false
+	}
+	s.reverse.mu.Lock()
+	defer s.reverse.mu.Unlock()
+	switch {
+	case token != "":
+		if _, ok := s.reverse.pending[token]; !ok {
+			s.reject(w, r, http.StatusNotFound, "webdial: unknown reverse dial", "")
+			return false
+		}
+	case name == "":
+		s.reject(w, r, http.StatusBadRequest, "webdial: missing listener name", "")
+		return false
+	default:
+		if _, ok := s.reverse.listeners[name]; ok {
+			s.reject(w, r, http.StatusConflict, "webdial: listener name taken", "")
+			return false
+		}
+	}
+	return true
+}
+
+// reverseConn takes over conn if it's a listener or answers a DialClient,
+// reporting whether it did.
+func (s *Server) reverseConn(conn *ServerConn) bool {
+	if s.reverse == nil {
+		return false
+	}
+	if token := requestReverse(conn.Request()); token != "" {
+		s.reverse.mu.Lock()
+		defer s.reverse.mu.Unlock()
+		ch, ok := s.reverse.pending[token]
+		if !ok {
+			// DialClient gave up after the handshake was checked.
+			conn.Close()
+			return true
+		}
+		delete(s.reverse.pending, token)
+		ch <- conn // buffered, and sent under mu so DialClient can't miss it
+		return true
+	}
+	name, listen := requestListen(conn.Request())
+	if !listen {
+		return false
+	}
+	conn.internal.Store(true)
+	l := &reverseListener{conn: conn}
+	s.reverse.mu.Lock()
+	if _, ok := s.reverse.listeners[name]; ok {
+		// Another registered since the handshake was checked.
+		s.reverse.mu.Unlock()
+		conn.Close()
+		return true
+	}
+	s.reverse.listeners[name] = l
+	s.reverse.mu.Unlock()
+	s.accepted(conn)
+	s.logger.Debug("listener registered", slog.String("id", conn.ID()), slog.String("name", name))
+	go func() {
+		// The client sends nothing on the control conn, so any read
+		// returning means it's gone.
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		s.reverse.mu.Lock()
+		if s.reverse.listeners[name] == l {
+			delete(s.reverse.listeners, name)
+		}
+		s.reverse.mu.Unlock()
+		s.logger.Debug("listener gone", slog.String("id", conn.ID()), slog.String("name", name))
+	}()
+	return true
+}
+
+// DialClient opens a conn to the client registered as listener name, see
+// WithReverse. It returns ErrNoListener if there is no such listener.
+func (s *Server) DialClient(ctx context.Context, name string) (net.Conn, error) {
+	if s.reverse == nil {
+		return nil, ErrNoListener
+	}
+	s.reverse.mu.Lock()
+	l, ok := s.reverse.listeners[name]
+	if !ok {
+		s.reverse.mu.Unlock()
+		return nil, fmt.Errorf("%w %q", ErrNoListener, name)
+	}
+	token := generateSessionID()
+	ch := make(chan *ServerConn, 1)
+	s.reverse.pending[token] = ch
+	s.reverse.mu.Unlock()
+	cancel := func() {
+		s.reverse.mu.Lock()
+		delete(s.reverse.pending, token)
+		s.reverse.mu.Unlock()
+	}
+	l.writeMu.Lock()
+	_, err := l.conn.Write([]byte(token + "\n"))
+	l.writeMu.Unlock()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	select {
+	case conn := <-ch:
+		return s.accepted(conn), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.closed:
+		err = ErrServerClosed
+	}
+	cancel()
+	// The conn may have arrived as we gave up.
+	select {
+	case conn := <-ch:
+		conn.Close()
+	default:
+	}
+	return nil, err
+}
+
+// Listeners returns the names of the registered listeners.
+func (s *Server) Listeners() []string {
+	if s.reverse == nil {
+		return nil
+	}
+	s.reverse.mu.Lock()
+	defer s.reverse.mu.Unlock()
+	names := make([]string, 0, len(s.reverse.listeners))
+	for name := range s.reverse.listeners {
+		names = append(names, name)
+	}
+	return names
+}
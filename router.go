@@ -0,0 +1,84 @@
+package webdial
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Router is an http.Handler hosting several independent Servers, e.g. one
+// per tenant with its own auth and limits, on one HTTP port. Each request
+// goes to the Server registered under the key its key function returns.
+type Router struct {
+	key     func(*http.Request) string
+	mu      sync.RWMutex
+	servers map[string]*Server
+}
+
+// NewRouter returns a Router keying requests with key, such as
+// RouteByPath or RouteByHeader. The key must be the same for a conn's
+// handshake and, over SSE, its POSTs.
+func NewRouter(key func(*http.Request) string) *Router {
+	return &Router{key: key, servers: map[string]*Server{}}
+}
+
+// RouteByPath keys requests by path segment i, counting from zero, so that
+// RouteByPath(0) sends "/acme/wd" to the Server for "acme".
+func RouteByPath(i int) func(*http.Request) string {
+	return func(r *http.Request) string {
+		segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if i < len(segs) {
+			return segs[i]
+		}
+		return ""
+	}
+}
+
+// RouteByHeader keys requests by the value of a header, such as a tenant
+// ID added by an ingress.
+func RouteByHeader(name string) func(*http.Request) string {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// Handle registers srv under key, replacing any Server already there.
+func (rt *Router) Handle(key string, srv *Server) {
+	rt.mu.Lock()
+	rt.servers[key] = srv
+	rt.mu.Unlock()
+}
+
+// Remove unregisters the Server under key, returning it so the caller can
+// close it, or nil if there was none.
+func (rt *Router) Remove(key string) *Server {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	srv := rt.servers[key]
+	delete(rt.servers, key)
+	return srv
+}
+
+// Server returns the Server registered under key, or nil.
+func (rt *Router) Server(key string) *Server {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.servers[key]
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv := rt.Server(rt.key(r))
+	if srv == nil {
+		writeError(w, http.StatusNotFound, "webdial: no such endpoint", "")
+		return
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// Close closes every registered Server.
+func (rt *Router) Close() error {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, srv := range rt.servers {
+		srv.Close()
+	}
+	return nil
+}
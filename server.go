@@ -1,40 +1,299 @@
 package webdial
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"iter"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/eventsource"
 )
 
-var upgrader = websocket.Upgrader{
+// defaultUpgrader is what each Server's upgrader starts as.
+var defaultUpgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		hint := "sse"
+		if status == http.StatusForbidden {
+			// A rejected origin won't fare better over SSE.
+			hint = ""
+		}
+		writeError(w, status, reason.Error(), hint)
+	},
 }
 
+// Server accepts webdial conns over both transports. It is an
+// http.Handler, to be mounted directly at any path, and a net.Listener
+// handing the conns to Accept. Create one with NewServer.
 type Server struct {
 	// KeepAlive is the interval between keep-alive pings.
 	// Zero means 25 seconds. Negative means disabled.
 	KeepAlive time.Duration
-	acceptCh  chan net.Conn
-	sessions  sync.Map // map[string]*sseSession
-	closed    chan struct{}
-	closeOnce sync.Once
+	// PongTimeout closes WebSocket conns whose client hasn't answered a
+	// keep-alive ping within PongTimeout, so half-dead clients don't hold
+	// conns forever. Pongs are only seen while the conn is being read.
+	// Zero means no timeout.
+	PongTimeout time.Duration
+	// MinClientVersion rejects clients reporting an older webdial version,
+	// or none at all, with a VersionError. Empty accepts every client.
+	MinClientVersion string
+	acceptQueue      int
+	overflow         OverflowPolicy
+	auth             func(*http.Request) (any, error)
+	upgrader         websocket.Upgrader
+	cors             *CORSPolicy // nil without WithCORS
+	maxConns         int
+	clients          *clientTable // nil without WithClientLimits
+	sessionIdle      time.Duration
+	sessionLifetime  time.Duration
+	maxPostSize      int64
+	sseWriteBuffer   int
+	maxFrameSize     int
+	maxMessageSize   int64
+	flowWindow       int64
+	connWriteBuffer  int
+	connWriteTimeout time.Duration
+	connWriteQueue   int
+	trustedProxies   []netip.Prefix
+	sseFlushDelay    time.Duration
+	filter           func(ConnInfo) bool
+	events           func(ServerEvent)
+	logger           *slog.Logger
+	tracer           Tracer // nil without WithConnTracer
+	connTap          func(Direction, []byte)
+	replica          *replicaRouter // nil without WithReplica
+	tokens           *sessionSigner // nil without WithSessionKey
+	binding          func(*http.Request, any) string
+	forward          *forwarder    // nil without WithForward
+	proxyProtocol    bool          // see WithProxyProtocol
+	reverse          *reverseTable // nil without WithReverse
+	rooms            *roomTable    // nil without WithRendezvous
+	connRate         int
+	connBurst        int
+	totalRead        *tokenBucket // nil without WithTotalRateLimit
+	totalWrite       *tokenBucket
+	live             atomic.Int64 // conns admitted and not yet closed
+	acceptCh         chan net.Conn
+	heldMu           sync.Mutex
+	held             []*ServerConn // taken from acceptCh by AcceptMatch for others
+	heldChanged      chan struct{} // closed when held grows
+	store            SessionStore
+	conns            sync.Map // map[net.Conn]*ServerConn
+	closed           chan struct{}
+	closeOnce        sync.Once
+	shuttingDown     atomic.Bool
+	drainOnce        sync.Once
+	metrics          serverMetrics
+	expvarName       string      // see WithExpvar
+	expvarVar        *metricsVar // what WithExpvar published, if any
+}
+
+// ServerOption configures a Server in NewServer.
+type ServerOption func(*Server)
+
+// WithHeartbeat sets the interval between keep-alive pings, see
+// Server.KeepAlive.
+func WithHeartbeat(interval time.Duration) ServerOption {
+	return func(s *Server) { s.KeepAlive = interval }
+}
+
+// WithPongTimeout closes dead WebSocket conns, see Server.PongTimeout.
+func WithPongTimeout(d time.Duration) ServerOption {
+	return func(s *Server) { s.PongTimeout = d }
+}
+
+// WithMinClientVersion rejects clients older than v, see
+// Server.MinClientVersion.
+func WithMinClientVersion(v string) ServerOption {
+	return func(s *Server) { s.MinClientVersion = v }
+}
+
+// WithAcceptQueue sets how many handshaken conns may wait for Accept.
+// The default is 16.
+func WithAcceptQueue(n int) ServerOption {
+	return func(s *Server) { s.acceptQueue = n }
+}
+
+// WithMaxConns caps the number of live conns, counting those waiting for
+// Accept. Further handshakes get 503 Service Unavailable with Retry-After
+// until a conn is closed. Zero means no cap.
+func WithMaxConns(n int) ServerOption {
+	return func(s *Server) { s.maxConns = n }
+}
+
+// WithSessionIdleTimeout closes SSE sessions that have had no POST, ping
+// included, for d, in case the client vanished without closing and the
+// stream never breaks, as behind some proxies. Clients that only read
+// should Ping more often than d. Zero means no timeout.
+func WithSessionIdleTimeout(d time.Duration) ServerOption {
+	return func(s *Server) { s.sessionIdle = d }
+}
+
+// WithSessionLifetime closes SSE sessions d after they were opened,
+// however active. Zero means no limit.
+func WithSessionLifetime(d time.Duration) ServerOption {
+	return func(s *Server) { s.sessionLifetime = d }
 }
 
-func NewServer() *Server {
-	return &Server{
-		acceptCh: make(chan net.Conn, 16),
-		closed:   make(chan struct{}),
+// WithMaxPostSize rejects SSE POST bodies larger than n bytes with 413
+// Request Entity Too Large. A body found to be too large part way through
+// also closes its session, as the start of it has already been delivered.
+// Zero means no limit.
+func WithMaxPostSize(n int64) ServerOption {
+	return func(s *Server) { s.maxPostSize = n }
+}
+
+// WithSSEWriteBuffer buffers up to size bytes of each SSE conn's output,
+// so that Write returns before a slow client has received the data and
+// blocks only once the buffer is full. A background writer sends the
+// buffer in batches, waiting flushDelay after the first write of each to
+// gather more, or flushing at once if zero. Without it, each Write is
+// written and flushed to the client before returning.
+func WithSSEWriteBuffer(size int, flushDelay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.sseWriteBuffer = size
+		s.sseFlushDelay = flushDelay
 	}
 }
 
+// WithFrameSize splits the server's writes into WebSocket messages or SSE
+// events of at most n bytes, as WithMaxFrameSize does for clients, so a
+// large Write doesn't become one message the client must hold whole. Zero
+// means 1MB.
+func WithFrameSize(n int) ServerOption {
+	return func(s *Server) { s.maxFrameSize = n }
+}
+
+// WithMaxMessageSize closes WebSocket conns whose client sends a message
+// larger than n bytes, failing the conn's reads with ErrMessageTooLarge.
+// SSE POST bodies are streamed rather than buffered; cap them with
+// WithMaxPostSize. Zero means no limit.
+func WithMaxMessageSize(n int64) ServerOption {
+	return func(s *Server) { s.maxMessageSize = n }
+}
+
+// WithFlowControl caps what a WebSocket client that set Dialer.ReadWindow
+// may send ahead of its conn's reads at window bytes, the server granting
+// more as the conn is read. The client's own window applies the other way.
+// Zero means the same window as the client's. Clients without a
+// ReadWindow, and SSE POSTs, which are answered only once read, rely on
+// TCP's flow control.
+func WithFlowControl(window int) ServerOption {
+	return func(s *Server) { s.flowWindow = int64(window) }
+}
+
+// windowFor returns the server's read window for a client asking for
+// flow control with window, advertising it on h.
+func (s *Server) windowFor(window int64, h http.Header) int64 {
+	if s.flowWindow > 0 {
+		window = s.flowWindow
+	}
+	h.Set(windowHeader, strconv.FormatInt(window, 10))
+	return window
+}
+
+// WithConnWriteBuffer holds each accepted conn's writes in a buffer of
+// size bytes until it fills, ServerConn.Flush is called or the conn is
+// closed, as WithWriteBuffer does for clients. Broadcast flushes what it
+// writes. Conns the server handles itself aren't buffered.
+func WithConnWriteBuffer(size int) ServerOption {
+	return func(s *Server) { s.connWriteBuffer = size }
+}
+
+// WithConnWriteTimeout fails writes to a WebSocket conn with a net.Error
+// timeout once the client has taken d to accept one, as WithWriteTimeout
+// does for clients, so a stalled client can't block its writer forever.
+// The conn can't be written to afterwards. Zero means no timeout.
+func WithConnWriteTimeout(d time.Duration) ServerOption {
+	return func(s *Server) { s.connWriteTimeout = d }
+}
+
+// WithConnWriteQueue queues up to n writes to each WebSocket conn, as
+// WithWriteQueue does for clients, so ServerConn.Write returns without
+// waiting for the client. ServerConn.Flush waits for the queue to drain.
+func WithConnWriteQueue(n int) ServerOption {
+	return func(s *Server) { s.connWriteQueue = n }
+}
+
+// WithLogger logs handshakes, session lifecycle and errors to l: conns
+// opening and closing at info level, dropped conns at warn, and rejected
+// requests at debug. By default, or with a nil l, nothing is logged.
+func WithLogger(l *slog.Logger) ServerOption {
+	return func(s *Server) {
+		if l == nil {
+			l = slog.New(slog.DiscardHandler)
+		}
+		s.logger = l
+	}
+}
+
+// OverflowPolicy is what a Server does with new conns when its accept
+// queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock holds the handshake until Accept makes room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject turns the handshake away with 503 Service
+	// Unavailable and Retry-After, which WithRetry clients honor.
+	OverflowReject
+	// OverflowDropOldest closes the longest-waiting conn to make room. The
+	// queue holds at least one conn.
+	OverflowDropOldest
+)
+
+// WithAcceptOverflow sets what happens when the accept queue is full.
+// The default is OverflowBlock.
+func WithAcceptOverflow(p OverflowPolicy) ServerOption {
+	return func(s *Server) { s.overflow = p }
+}
+
+// NewServer returns a Server configured by opts.
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		acceptQueue: 16,
+		upgrader:    defaultUpgrader,
+		logger:      slog.New(slog.DiscardHandler),
+		store:       &memStore{},
+		closed:      make(chan struct{}),
+		heldChanged: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	upgradeError := s.upgrader.Error
+	s.upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		s.logger.Debug("websocket upgrade failed", requestAttrs(r, status, reason.Error())...)
+		upgradeError(w, r, status, reason)
+	}
+	queue := max(s.acceptQueue, 0)
+	if s.overflow == OverflowDropOldest {
+		// There must be an oldest to drop.
+		queue = max(queue, 1)
+	}
+	s.acceptCh = make(chan net.Conn, queue)
+	return s
+}
+
+// ServeHTTP routes on the request's method and headers, never its path,
+// so the Server works at whatever path it is mounted.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = s.realClient(r)
+	if s.cors != nil && s.cors.handle(w, r) {
+		return
+	}
 	if r.Header.Get("Upgrade") != "" {
 		s.handleWS(w, r)
 		return
@@ -47,31 +306,141 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleSSE(w, r)
 		return
 	}
-	http.Error(w, "webdial: unsupported request", http.StatusBadRequest)
+	if r.Header.Get("Sec-WebSocket-Key") != "" {
+		// A proxy stripped the upgrade headers, websockets won't work.
+		s.reject(w, r, http.StatusBadRequest, "webdial: websocket upgrade headers missing", "sse")
+		return
+	}
+	s.reject(w, r, http.StatusBadRequest, "webdial: unsupported request", "")
 }
 
+// Accept waits for the next conn. Conns are *ServerConn, exposing the
+// client's handshake request.
 func (s *Server) Accept() (net.Conn, error) {
+	return s.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for the next conn, or until ctx is done.
+func (s *Server) AcceptContext(ctx context.Context) (net.Conn, error) {
+	return s.AcceptMatch(ctx, nil)
+}
+
+// TryAccept returns a conn if one is waiting, without blocking.
+func (s *Server) TryAccept() (net.Conn, bool) {
+	s.heldMu.Lock()
+	if len(s.held) > 0 {
+		conn := s.held[0]
+		s.held = s.held[1:]
+		s.heldMu.Unlock()
+		return s.accepted(conn), true
+	}
+	s.heldMu.Unlock()
 	select {
 	case conn := <-s.acceptCh:
-		return conn, nil
-	case <-s.closed:
-		return nil, errors.New("webdial: server closed")
+		return s.accepted(conn), true
+	default:
+		return nil, false
 	}
 }
 
+// OnConn accepts conns in the background until the server is closed,
+// calling fn in a new goroutine for each and closing the conn when fn
+// returns. It replaces an Accept loop; don't mix the two.
+func (s *Server) OnConn(fn func(net.Conn)) {
+	go func() {
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			go pprof.Do(context.Background(), conn.(*ServerConn).Labels(), func(context.Context) {
+				defer conn.Close()
+				fn(conn)
+			})
+		}
+	}()
+}
+
+// accepted marks conn as handed to the application.
+func (s *Server) accepted(conn net.Conn) net.Conn {
+	s.metrics.accepts.Add(1)
+	if t, ok := conn.(interface{ advancePhase(ConnPhase) }); ok {
+		t.advancePhase(PhaseEstablished)
+	}
+	return conn
+}
+
+// Close stops the server accepting conns and closes every live one, as
+// going away, cancelling their contexts with ErrServerClosed. Clients see
+// Conn.Draining first, so that a ReliableConn re-dials.
 func (s *Server) Close() error {
 	s.closeOnce.Do(func() {
 		close(s.closed)
-		s.sessions.Range(func(key, value any) bool {
-			sess := value.(*sseSession)
-			sess.conn.Close()
-			s.sessions.Delete(key)
+		var wg sync.WaitGroup
+		s.conns.Range(func(key, _ any) bool {
+			conn := key.(interface {
+				end(error)
+				goingAway() error
+				CloseWithError(int, string) error
+			})
+			conn.end(ErrServerClosed)
+			wg.Go(func() {
+				conn.goingAway()
+				conn.CloseWithError(websocket.CloseGoingAway, "")
+			})
 			return true
 		})
+		wg.Wait()
+		s.unpublish()
 	})
 	return nil
 }
 
+// Addr returns a placeholder address, so that Server is a net.Listener
+// and can be passed to http.Serve, grpc.Server.Serve and the like. The
+// real listener is whichever HTTP server the Server is mounted on.
+func (s *Server) Addr() net.Addr {
+	return addr{transport: "server", url: "webdial"}
+}
+
+// Conns yields every live conn, including those waiting for Accept.
+func (s *Server) Conns() iter.Seq[*ServerConn] {
+	return func(yield func(*ServerConn) bool) {
+		s.conns.Range(func(_, value any) bool {
+			return yield(value.(*ServerConn))
+		})
+	}
+}
+
+// CloseConn closes the live conn with the given ID, reporting whether
+// there was one.
+func (s *Server) CloseConn(id string) bool {
+	for conn := range s.Conns() {
+		if conn.ID() == id {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// DumpState writes the state of every live conn to w, one per line.
+func (s *Server) DumpState(w io.Writer) error {
+	var err error
+	s.conns.Range(func(key, _ any) bool {
+		if st, ok := StateOf(key.(net.Conn)); ok {
+			_, err = fmt.Fprintln(w, st)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// Version returns the webdial version of the server, as reported to clients.
+func (s *Server) Version() string {
+	return version
+}
+
 func (s *Server) keepAliveInterval() time.Duration {
 	if s.KeepAlive == 0 {
 		return 25 * time.Second
@@ -79,22 +448,199 @@ func (s *Server) keepAliveInterval() time.Duration {
 	return s.KeepAlive
 }
 
+// admit runs the checks every handshake must pass, returning the client's
+// identity or writing the rejection if it fails.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, transport string) (any, bool) {
+	if s.rejectShutdown(w, r) {
+		return nil, false
+	}
+	if !checkClientVersion(w, r, s.MinClientVersion) {
+		s.logger.Debug("request rejected", requestAttrs(r, http.StatusUpgradeRequired, "client version")...)
+		s.metrics.rejected.Add(1)
+		return nil, false
+	}
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !s.filterAccepts(w, r, transport, identity) {
+		return nil, false
+	}
+	if !s.reverseAllowed(w, r) || !s.roomAllowed(w, r) {
+		return nil, false
+	}
+	if !s.forwardAllowed(w, r, transport, identity) {
+		return nil, false
+	}
+	if !s.acquire() {
+		w.Header().Set("Retry-After", "1")
+		s.reject(w, r, http.StatusServiceUnavailable, "webdial: too many conns", "")
+		return nil, false
+	}
+	if s.clients != nil && !s.clients.acquire(r) {
+		s.release()
+		s.tooMany(w, r, time.Second, "webdial: too many conns from client")
+		return nil, false
+	}
+	if s.forward == nil && s.overflow == OverflowReject && cap(s.acceptCh) > 0 && len(s.acceptCh) >= cap(s.acceptCh) {
+		s.releaseFor(r)
+		w.Header().Set("Retry-After", "1")
+		s.reject(w, r, http.StatusServiceUnavailable, "webdial: accept queue full", "")
+		return nil, false
+	}
+	return identity, true
+}
+
+// reject writes an error response for r, logging it at debug level.
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, status int, msg, hint string) {
+	s.logger.Debug("request rejected", requestAttrs(r, status, msg)...)
+	s.metrics.rejected.Add(1)
+	writeError(w, status, msg, hint)
+}
+
+func requestAttrs(r *http.Request, status int, reason string) []any {
+	return []any{
+		slog.String("method", r.Method),
+		slog.String("client", r.RemoteAddr),
+		slog.Int("status", status),
+		slog.String("reason", reason),
+	}
+}
+
+// acquire counts a new conn against WithMaxConns, reporting false if
+// there's no room. Each successful acquire is paired with a release once
+// the conn is closed.
+func (s *Server) acquire() bool {
+	if n := s.live.Add(1); s.maxConns > 0 && n > int64(s.maxConns) {
+		s.live.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *Server) release() {
+	s.live.Add(-1)
+}
+
+// releaseFor releases a conn admitted for r, including from its client's
+// limits.
+func (s *Server) releaseFor(r *http.Request) {
+	s.release()
+	if s.clients != nil {
+		s.clients.release(r)
+	}
+}
+
+// enqueue hands conn to Accept as the overflow policy dictates, closing it
+// and reporting false if it was turned away. Listeners and conns answering
+// DialClient are taken by WithReverse, conns dialing a room by
+// WithRendezvous, and with WithForward the rest are forwarded instead.
+func (s *Server) enqueue(conn net.Conn) bool {
+	if s.reverseConn(conn.(*ServerConn)) || s.pairConn(conn.(*ServerConn)) {
+		return true
+	}
+	if s.forward != nil {
+		go s.forwardConn(conn.(*ServerConn))
+		return true
+	}
+	for {
+		select {
+		case s.acceptCh <- conn:
+			return true
+		case <-s.closed:
+			conn.Close()
+			return false
+		default:
+		}
+		switch s.overflow {
+		case OverflowReject:
+			// The queue filled after admit.
+			s.logger.Warn("accept queue full, dropped new conn", slog.String("id", conn.(*ServerConn).ID()))
+			conn.Close()
+			return false
+		case OverflowDropOldest:
+			select {
+			case old := <-s.acceptCh:
+				s.logger.Warn("accept queue full, dropped oldest conn", slog.String("id", old.(*ServerConn).ID()))
+				old.Close()
+			default:
+			}
+			continue
+		}
+		select {
+		case s.acceptCh <- conn:
+			return true
+		case <-s.closed:
+			conn.Close()
+			return false
+		}
+	}
+}
+
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	traceCtx, span := s.traceHandshake(r, "ws")
+	identity, ok := s.admit(w, r, "ws")
+	if !ok {
+		span.End(errHandshakeRejected)
+		return
+	}
+	respHeader := http.Header{versionHeader: {version}}
+	sendWindow, flow := parseWindow(r.Header.Get(windowHeader))
+	var recvWindow int64
+	if flow {
+		recvWindow = s.windowFor(sendWindow, respHeader)
+	}
+	ws, err := s.upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
+		s.releaseFor(r)
+		span.End(err)
 		return
 	}
-	conn := newWSConn(ws, s.keepAliveInterval())
-	select {
-	case s.acceptCh <- conn:
-	case <-s.closed:
-		conn.Close()
+	span.End(nil)
+	if s.maxMessageSize > 0 {
+		ws.SetReadLimit(s.maxMessageSize)
+	}
+	id := generateSessionID()
+	// The conn's goroutines inherit the labels.
+	defer labelGoroutine(r.Context(), sessionLabels(id, "ws", r.RemoteAddr))()
+	conn := newWSConn(ws, s.keepAliveInterval(), s.PongTimeout)
+	conn.maxFrame = s.maxFrameSize
+	conn.writeTimeout = s.connWriteTimeout
+	if len(s.trustedProxies) > 0 {
+		// The socket is the proxy's.
+		conn.remoteAddr = clientAddr(r, "ws")
+	}
+	if s.connWriteQueue > 0 {
+		conn.startWriteQueue(s.connWriteQueue)
 	}
+	if flow {
+		conn.startFlowControl(sendWindow, recvWindow)
+	}
+	conn.connMeta = requestMeta(r)
+	sc := newServerConn(conn, "ws", id, r, identity)
+	sc.traceCtx = traceCtx
+	s.rateLimit(sc)
+	closed := s.connOpened(sc, "")
+	conn.onClose = func() {
+		// Before the conn leaves s.conns, for Metrics.
+		closed()
+		s.conns.Delete(conn)
+		s.releaseFor(r)
+	}
+	s.conns.Store(conn, sc)
+	s.enqueue(sc)
 }
 
 func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
-	sid := generateSessionID()
-	pr, pw := io.Pipe()
+	traceCtx, span := s.traceHandshake(r, "sse")
+	identity, ok := s.admit(w, r, "sse")
+	if !ok {
+		span.End(errHandshakeRejected)
+		return
+	}
+	sid := s.newSessionID(identity)
+	defer labelGoroutine(r.Context(), sessionLabels(sid, "sse", r.RemoteAddr))()
+	pr, pw := newPipe()
 	conn := &sseServerConn{
 		sessionID:  sid,
 		w:          w,
@@ -103,73 +649,205 @@ func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
 		closeCh:    make(chan struct{}),
 		localAddr:  addr{transport: "sse", url: "server"},
 		remoteAddr: addr{transport: "sse", url: r.RemoteAddr},
+		connMeta:   requestMeta(r),
+		maxFrame:   s.maxFrameSize,
+		keepAlive:  newKeepAlive(s.keepAliveInterval()),
+	}
+	if s.sseWriteBuffer > 0 {
+		conn.out = newSSEOutbox(s.sseWriteBuffer, s.sseFlushDelay)
 	}
-	s.sessions.Store(sid, &sseSession{conn: conn})
+	if n, ok := parseWindow(r.Header.Get(windowHeader)); ok {
+		conn.window = newSendWindow(n)
+		s.windowFor(n, w.Header())
+	}
+	sess := newSSESession(conn)
+	if s.binding != nil {
+		sess.binding = s.binding(r, identity)
+	}
+	if s.sessionIdle > 0 {
+		sess.idle = newIdleWatch(s.sessionIdle, func() {
+			s.logger.Info("session idle, closing", slog.String("id", sid))
+			conn.Close()
+		})
+		defer sess.idle.stop()
+	}
+	if s.sessionLifetime > 0 {
+		expiry := time.AfterFunc(s.sessionLifetime, func() {
+			s.logger.Info("session lifetime reached, closing", slog.String("id", sid))
+			conn.Close()
+		})
+		defer expiry.Stop()
+	}
+	sc := newServerConn(conn, "sse", sid, r, identity)
+	sc.traceCtx = traceCtx
+	s.rateLimit(sc)
+	s.store.Store(sid, sess)
+	s.conns.Store(conn, sc)
 	defer func() {
-		s.sessions.Delete(sid)
+		if conn.out != nil {
+			// Let the writer drain, unless the client has gone.
+			conn.out.closeWith(nil)
+			select {
+			case <-conn.out.done:
+			case <-r.Context().Done():
+			}
+		}
+		conn.finish()
+		// The client's stream is gone, if the conn wasn't closed.
+		conn.end(io.ErrUnexpectedEOF)
+		s.store.Delete(sid)
+		s.conns.Delete(conn)
+		s.releaseFor(r)
 		pw.Close()
 	}()
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(versionHeader, version)
+	conn.writeMu.Lock()
 	eventsource.WriteEvent(w, eventsource.Event{
 		Type: "sid",
 		Data: []byte(sid),
 	})
+	conn.writeMu.Unlock()
+	if conn.out != nil {
+		go conn.out.run(conn)
+	}
+	span.End(nil)
+	defer s.connOpened(sc, sid)()
+	if !s.enqueue(sc) {
+		return
+	}
+	stop, failed := make(chan struct{}), make(chan struct{})
+	defer close(stop)
+	go func() {
+		conn.keepAlive.loop(stop, func(time.Duration) error { return conn.writeHeartbeat() })
+		close(failed)
+	}()
 	select {
-	case s.acceptCh <- conn:
+	case <-failed:
+	case <-r.Context().Done():
+	case <-conn.closeCh:
 	case <-s.closed:
-		conn.Close()
-		return
+		// Close the conn as Server.Close does, before the stream ends.
+		conn.goingAway()
+		conn.CloseWithError(websocket.CloseGoingAway, "")
 	}
-	ka := s.keepAliveInterval()
-	if ka < 0 {
-		select {
-		case <-r.Context().Done():
-		case <-conn.closeCh:
-		case <-s.closed:
-		}
-		return
+}
+
+func requestMeta(r *http.Request) connMeta {
+	return connMeta{
+		fingerprint: requestFingerprint(r),
+		peerVersion: r.Header.Get(versionHeader),
+		target:      requestTarget(r),
+		metadata:    requestMetadata(r),
+		tags:        requestTags(r),
 	}
-	ticker := time.NewTicker(ka)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := conn.writeHeartbeat(); err != nil {
-				return
-			}
-		case <-r.Context().Done():
-			return
-		case <-conn.closeCh:
-			return
-		case <-s.closed:
-			return
-		}
+}
+
+// newSessionID returns the ID for an SSE session opened by identity.
+func (s *Server) newSessionID(identity any) string {
+	var prefix string
+	if s.replica != nil {
+		prefix = s.replica.id + "."
+	}
+	if s.tokens != nil {
+		return s.tokens.sign(prefix, identity)
 	}
+	return prefix + generateSessionID()
 }
 
 func (s *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
 	sid := r.URL.Query().Get("s")
 	if sid == "" {
-		http.Error(w, "missing session id", http.StatusBadRequest)
+		s.reject(w, r, http.StatusBadRequest, "missing session id", "")
 		return
 	}
-	val, ok := s.sessions.Load(sid)
+	if s.tokens != nil && !s.tokens.verify(sid, identity) {
+		s.reject(w, r, http.StatusForbidden, "webdial: invalid session token", "")
+		return
+	}
+	if s.replica != nil {
+		if replica, ok := s.replica.owner(sid); ok {
+			if p := s.replica.proxy(replica); p != nil {
+				p.ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+	sess, ok := s.store.Load(sid)
 	if !ok {
-		http.Error(w, "session not found", http.StatusNotFound)
+		s.reject(w, r, http.StatusNotFound, "session not found", "")
 		return
 	}
-	sess := val.(*sseSession)
+	if !s.samePoster(sess, r, identity) {
+		s.reject(w, r, http.StatusForbidden, "webdial: post from another client", "")
+		return
+	}
+	sess.Touch()
+	defer labelGoroutine(r.Context(), sessionLabels(sid, "sse", r.RemoteAddr))()
 	if r.URL.Query().Get("close") == "1" {
-		sess.conn.Close()
+		code := closeNormal
+		if c, err := strconv.Atoi(r.URL.Query().Get("code")); err == nil {
+			code = c
+		}
+		sess.CloseByClient(code, r.URL.Query().Get("reason"))
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "read error", http.StatusInternalServerError)
+	if r.URL.Query().Has("credit") {
+		// Not subject to WithClientLimits, as the stream would stall.
+		n, ok := parseWindow(r.URL.Query().Get("credit"))
+		if !ok {
+			s.reject(w, r, http.StatusBadRequest, "bad credit", "")
+			return
+		}
+		sess.Credit(n)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if s.clients != nil {
+		if wait, ok := s.clients.allowPost(r); !ok {
+			s.tooMany(w, r, wait, "webdial: too many posts from client")
+			return
+		}
+	}
+	if r.URL.Query().Get("ping") == "1" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	body := r.Body
+	if s.maxPostSize > 0 {
+		if r.ContentLength > s.maxPostSize {
+			s.reject(w, r, http.StatusRequestEntityTooLarge, "webdial: post too large", "")
+			return
+		}
+		body = http.MaxBytesReader(w, r.Body, s.maxPostSize)
+	}
+	seq := int64(-1)
+	if q := r.URL.Query().Get("q"); q != "" {
+		// Pipelined POSTs carry a sequence number to be delivered in order.
+		n, err := strconv.ParseInt(q, 10, 64)
+		if err != nil || n < 0 {
+			s.reject(w, r, http.StatusBadRequest, "bad sequence number", "")
+			return
+		}
+		seq = n
+	}
+	if err := sess.Post(r.Context(), seq, r.Header.Get(idempotencyHeader), body); err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, errSeqOutOfWindow), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			s.reject(w, r, http.StatusConflict, err.Error(), "")
+		case errors.As(err, &tooLarge):
+			s.reject(w, r, http.StatusRequestEntityTooLarge, "webdial: post too large", "")
+		default:
+			s.reject(w, r, http.StatusBadRequest, "read error", "")
+		}
 		return
 	}
-	sess.conn.writePipe.Write(body)
 	w.WriteHeader(http.StatusNoContent)
 }
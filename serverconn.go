@@ -0,0 +1,235 @@
+package webdial
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// ServerConn is a conn returned by Accept, carrying details of the
+// client's handshake request.
+type ServerConn struct {
+	net.Conn
+	transport string
+	id        string
+	req       *http.Request
+	identity  any
+	readRate  tokenBuckets // empty without rate limits
+	writeRate tokenBuckets
+	wbuf      *writeBuffer // nil without WithConnWriteBuffer
+	tap       func(Direction, []byte)
+	traceCtx  context.Context // the handshake span's, see traceSession
+	// internal is set for conns the server handles itself, such as
+	// forwarded conns, which Broadcast skips.
+	internal atomic.Bool
+	// retired is set once the conn's counters are in the server's
+	// Metrics totals, guarded by serverMetrics.mu.
+	retired bool
+}
+
+func newServerConn(conn net.Conn, transport, id string, r *http.Request, identity any) *ServerConn {
+	return &ServerConn{Conn: conn, transport: transport, id: id, req: r, identity: identity}
+}
+
+func (c *ServerConn) Read(b []byte) (int, error) {
+	n, err := c.read(b)
+	if c.tap != nil && n > 0 {
+		c.tap(Inbound, b[:n])
+	}
+	return n, err
+}
+
+func (c *ServerConn) read(b []byte) (int, error) {
+	if len(c.readRate) == 0 {
+		return c.Conn.Read(b)
+	}
+	n, err := c.Conn.Read(b[:c.readRate.chunk(len(b))])
+	c.readRate.take(n)
+	return n, err
+}
+
+func (c *ServerConn) Write(b []byte) (int, error) {
+	if c.wbuf != nil && !c.internal.Load() {
+		return c.wbuf.Write(b)
+	}
+	return c.write(b)
+}
+
+func (c *ServerConn) write(b []byte) (int, error) {
+	n, err := c.send(b)
+	if c.tap != nil && n > 0 {
+		c.tap(Outbound, b[:n])
+	}
+	return n, err
+}
+
+func (c *ServerConn) send(b []byte) (int, error) {
+	if len(c.writeRate) == 0 {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:c.writeRate.chunk(len(b))]
+		c.writeRate.take(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Flush sends any writes held back by WithConnWriteBuffer and waits for
+// those queued by WithConnWriteQueue.
+func (c *ServerConn) Flush() error {
+	if c.wbuf != nil {
+		if err := c.wbuf.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := c.Conn.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close flushes any buffered writes, then closes the conn.
+func (c *ServerConn) Close() error {
+	return c.CloseWithError(closeNormal, "")
+}
+
+// CloseWithError is Close, except that the client's reads return a
+// *CloseError carrying code and reason rather than io.EOF.
+func (c *ServerConn) CloseWithError(code int, reason string) error {
+	if c.wbuf != nil {
+		c.wbuf.Flush()
+	}
+	if cc, ok := c.Conn.(interface {
+		CloseWithError(int, string) error
+	}); ok {
+		return cc.CloseWithError(code, reason)
+	}
+	return c.Conn.Close()
+}
+
+// SetKeepAlive turns keep-alive pings on or off, as on a net.TCPConn:
+// WebSocket pings, or heartbeat events for SSE. It overrides
+// Server.KeepAlive for this conn.
+func (c *ServerConn) SetKeepAlive(keepalive bool) error {
+	if ka, ok := c.Conn.(keepAliver); ok {
+		return ka.SetKeepAlive(keepalive)
+	}
+	return nil
+}
+
+// SetKeepAlivePeriod sets the interval between keep-alive pings.
+func (c *ServerConn) SetKeepAlivePeriod(d time.Duration) error {
+	if ka, ok := c.Conn.(keepAliver); ok {
+		return ka.SetKeepAlivePeriod(d)
+	}
+	return nil
+}
+
+// Unwrap returns what the conn runs over: the *websocket.Conn, or the
+// SSE stream's http.ResponseWriter, for use with http.ResponseController.
+func (c *ServerConn) Unwrap() any {
+	if u, ok := c.Conn.(interface{ Unwrap() any }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// Context returns a context cancelled once the conn is closed, by either
+// end or by Server.Close, or the client's connection fails. context.Cause
+// reports why: net.ErrClosed for Close, ErrServerClosed for Server.Close,
+// or what Read returns for the client's close or the failure.
+func (c *ServerConn) Context() context.Context {
+	return connContext(c.Conn)
+}
+
+// Transport returns the transport the client connected with, "ws" or "sse".
+func (c *ServerConn) Transport() string {
+	return c.transport
+}
+
+// ID identifies the conn among those of its Server, see Server.CloseConn.
+// For SSE it is the session ID.
+func (c *ServerConn) ID() string {
+	return c.id
+}
+
+// Request returns the client's handshake request: the WebSocket upgrade,
+// or the GET opening the event stream. Use it for headers, cookies, query
+// parameters and TLS state; its body and context must not be used.
+func (c *ServerConn) Request() *http.Request {
+	return c.req
+}
+
+// Identity returns what the WithAuth function returned for the handshake,
+// or nil without WithAuth.
+func (c *ServerConn) Identity() any {
+	return c.identity
+}
+
+// ClientAddr returns the address the handshake request came from.
+func (c *ServerConn) ClientAddr() net.Addr {
+	return clientAddr(c.req, c.transport)
+}
+
+func clientAddr(r *http.Request, transport string) net.Addr {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return net.TCPAddrFromAddrPort(ap)
+	}
+	return addr{transport: transport, url: r.RemoteAddr}
+}
+
+// Target returns the target the client asked for with WithTarget, or ""
+// if it didn't.
+func (c *ServerConn) Target() string {
+	return c.meta().target
+}
+
+// Metadata returns the metadata the client attached with WithMetadata.
+// It is nil if there was none.
+func (c *ServerConn) Metadata() map[string]string {
+	return maps.Clone(c.meta().metadata)
+}
+
+// PeerVersion returns the webdial version the client reported during the
+// handshake, empty if it didn't.
+func (c *ServerConn) PeerVersion() string {
+	return c.meta().peerVersion
+}
+
+// Stats returns the conn's counters.
+func (c *ServerConn) Stats() Stats {
+	if sc, ok := c.Conn.(interface{ counters() *connStats }); ok {
+		return sc.counters().stats(c.transport)
+	}
+	return Stats{Transport: c.transport}
+}
+
+// State returns a snapshot of the conn's internal state.
+func (c *ServerConn) State() ConnState {
+	st, _ := StateOf(c.Conn)
+	return st
+}
+
+func (c *ServerConn) meta() *connMeta {
+	if mc, ok := c.Conn.(interface{ meta() *connMeta }); ok {
+		return mc.meta()
+	}
+	return &connMeta{}
+}
+
+func (c *ServerConn) advancePhase(p ConnPhase) {
+	if t, ok := c.Conn.(interface{ advancePhase(ConnPhase) }); ok {
+		t.advancePhase(p)
+	}
+}
@@ -0,0 +1,205 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Session is the server side of an SSE session, where the client's POSTs
+// are delivered.
+type Session interface {
+	// Touch records client activity, deferring WithSessionIdleTimeout.
+	Touch()
+	// Post delivers a POST body to the session's conn. A seq of zero or
+	// more is the client's sequence number, and the body is delivered
+	// only after those before it. A non-empty key is the POST's
+	// Idempotency-Key: a retry of a POST already delivered under the same
+	// key succeeds without delivering it again. If delivery fails part way
+	// the session can't continue and is closed.
+	Post(ctx context.Context, seq int64, key string, body io.Reader) error
+	// Credit lets the session's conn send n more bytes to a client that
+	// set Dialer.ReadWindow.
+	Credit(n int64)
+	// Close closes the session's conn.
+	Close() error
+	// CloseByClient closes the session's conn because the client closed
+	// it, giving code and reason, see CloseError.
+	CloseByClient(code int, reason string) error
+	// Binding returns the WithSessionBinding key of the request that
+	// opened the session.
+	Binding() string
+}
+
+// SessionStore registers the SSE sessions a Server's POSTs are routed to.
+// Store is only called with sessions whose event stream this Server
+// holds, and Delete when the stream ends. Each server of a fleet can have
+// a store of its own that knows which server it is, backed by one they
+// share, so that Load finds sessions held by other servers too, returning
+// a Session relaying to the server holding it. The
+// github.com/jpillora/webdial/redis module is such a store.
+type SessionStore interface {
+	Store(id string, sess Session)
+	Load(id string) (Session, bool)
+	Delete(id string)
+}
+
+// WithSessionStore replaces the Server's in-memory session registry.
+func WithSessionStore(store SessionStore) ServerOption {
+	return func(s *Server) { s.store = store }
+}
+
+// memStore is the default SessionStore, holding this Server's sessions.
+type memStore struct {
+	m sync.Map // map[string]Session
+}
+
+func (m *memStore) Store(id string, sess Session) {
+	m.m.Store(id, sess)
+}
+
+func (m *memStore) Load(id string) (Session, bool) {
+	v, ok := m.m.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(Session), true
+}
+
+func (m *memStore) Delete(id string) {
+	m.m.Delete(id)
+}
+
+func (s *sseSession) Touch() {
+	if s.idle != nil {
+		s.idle.touch()
+	}
+}
+
+func (s *sseSession) Post(ctx context.Context, seq int64, key string, body io.Reader) error {
+	if key == "" {
+		return s.post(ctx, seq, body)
+	}
+	for {
+		s.postMu.Lock()
+		p, dup := s.posted[key]
+		if !dup {
+			p = &postResult{done: make(chan struct{})}
+			s.remember(key, p)
+		}
+		s.postMu.Unlock()
+		if !dup {
+			p.err = s.post(ctx, seq, body)
+			if p.err != nil {
+				// Let a retry deliver it.
+				s.forget(key, p)
+			}
+			close(p.done)
+			return p.err
+		}
+		// A retry, perhaps while the first attempt is still in progress:
+		// it stands unless that attempt failed.
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if p.err == nil {
+			return nil
+		}
+	}
+}
+
+// postResult is the outcome of a POST with an idempotency key, which
+// retries of it wait for.
+type postResult struct {
+	done chan struct{}
+	err  error
+}
+
+// maxPostKeys bounds the idempotency keys a session remembers. Retries
+// follow soon after the first attempt, so only recent keys are needed.
+const maxPostKeys = 256
+
+// remember records key's POST, dropping the oldest key beyond
+// maxPostKeys. postMu must be held.
+func (s *sseSession) remember(key string, p *postResult) {
+	if s.posted == nil {
+		s.posted = make(map[string]*postResult)
+	}
+	s.posted[key] = p
+	s.postKeys = append(s.postKeys, key)
+	if len(s.postKeys) > maxPostKeys {
+		delete(s.posted, s.postKeys[0])
+		s.postKeys = s.postKeys[1:]
+	}
+}
+
+// forget drops key's failed POST, unless the key has been reused since.
+func (s *sseSession) forget(key string, p *postResult) {
+	s.postMu.Lock()
+	defer s.postMu.Unlock()
+	if s.posted[key] == p {
+		delete(s.posted, key)
+	}
+}
+
+// post delivers body, once those before seq have been if it is sequenced.
+func (s *sseSession) post(ctx context.Context, seq int64, body io.Reader) error {
+	deliver := func() error {
+		// Stream straight into the pipe. A write error means the conn was
+		// closed, which the client will hear about on the stream.
+		buf := getBuffer(32 << 10)
+		defer putBuffer(buf)
+		_, err := io.CopyBuffer(s, body, *buf)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		return nil
+	}
+	var err error
+	if seq >= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.conn.closeCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err = s.inOrder(ctx, uint64(seq), deliver)
+		if errors.Is(err, errSeqOutOfWindow) || (ctx.Err() != nil && errors.Is(err, ctx.Err())) {
+			return err
+		}
+	} else {
+		err = deliver()
+	}
+	s.conn.framesRead.Add(1)
+	if err != nil {
+		// Part of the body may have been delivered, leaving a gap in the
+		// stream, so the session can't continue.
+		s.conn.Close()
+	}
+	return err
+}
+
+func (s *sseSession) Credit(n int64) {
+	if s.conn.window != nil {
+		s.conn.window.grant(n)
+	}
+}
+
+func (s *sseSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *sseSession) CloseByClient(code int, reason string) error {
+	return s.conn.closedByClient(code, reason)
+}
+
+func (s *sseSession) Binding() string {
+	return s.binding
+}
@@ -0,0 +1,75 @@
+package webdial
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WithSessionKey makes SSE session IDs tokens signed with key, so that
+// POSTs can only name sessions this Server, or another sharing the key,
+// opened. With WithAuth the token is bound to the stream's identity, in
+// its %v form, and a POST authenticating as anyone else is rejected with
+// 403 Forbidden; the identity should be stable, such as a user ID. A ttl
+// above zero also rejects POSTs once the token is that old, so pair it
+// with a WithSessionLifetime of at most ttl.
+func WithSessionKey(key []byte, ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		s.tokens = &sessionSigner{key: key, ttl: ttl}
+	}
+}
+
+type sessionSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+const (
+	tokenNonceLen = 8
+	tokenMACLen   = 16
+)
+
+// sign returns a token for a session opened by identity. prefix, as
+// added by WithReplica, comes before the token and is signed with it.
+func (ss *sessionSigner) sign(prefix string, identity any) string {
+	payload := make([]byte, tokenNonceLen+8, tokenNonceLen+8+tokenMACLen)
+	rand.Read(payload[:tokenNonceLen])
+	if ss.ttl > 0 {
+		expiry := time.Now().Add(ss.ttl).Unix()
+		binary.BigEndian.PutUint64(payload[tokenNonceLen:], uint64(expiry))
+	}
+	token := append(payload, ss.mac(prefix, payload, identity)...)
+	return prefix + base64.RawURLEncoding.EncodeToString(token)
+}
+
+// verify reports whether sid is a live token for a session opened by
+// identity.
+func (ss *sessionSigner) verify(sid string, identity any) bool {
+	i := strings.LastIndex(sid, ".") + 1
+	prefix := sid[:i]
+	token, err := base64.RawURLEncoding.DecodeString(sid[i:])
+	if err != nil || len(token) != tokenNonceLen+8+tokenMACLen {
+		return false
+	}
+	payload, mac := token[:tokenNonceLen+8], token[tokenNonceLen+8:]
+	if !hmac.Equal(mac, ss.mac(prefix, payload, identity)) {
+		return false
+	}
+	expiry := int64(binary.BigEndian.Uint64(payload[tokenNonceLen:]))
+	return expiry == 0 || time.Now().Unix() < expiry
+}
+
+func (ss *sessionSigner) mac(prefix string, payload []byte, identity any) []byte {
+	h := hmac.New(sha256.New, ss.key)
+	h.Write([]byte(prefix))
+	h.Write(payload)
+	if identity != nil {
+		fmt.Fprint(h, identity)
+	}
+	return h.Sum(nil)[:tokenMACLen]
+}
@@ -0,0 +1,162 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnPhase is the lifecycle phase of a conn.
+type ConnPhase int32
+
+const (
+	// PhaseHandshaking means the conn has been set up but not yet
+	// handed to the application.
+	PhaseHandshaking ConnPhase = iota
+	// PhaseEstablished means the conn is open in both directions.
+	PhaseEstablished
+	// PhaseDraining means the peer has closed its side but buffered
+	// data remains to be read, or a local close is in progress.
+	PhaseDraining
+	// PhaseClosed means the conn is closed.
+	PhaseClosed
+)
+
+func (p ConnPhase) String() string {
+	switch p {
+	case PhaseHandshaking:
+		return "handshaking"
+	case PhaseEstablished:
+		return "established"
+	case PhaseDraining:
+		return "draining"
+	case PhaseClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnPhase(%d)", int32(p))
+}
+
+// ConnState is a snapshot of a conn's internal state, for debugging.
+type ConnState struct {
+	Phase      ConnPhase
+	Transport  string
+	LocalAddr  string
+	RemoteAddr string
+	// SessionID is the SSE session ID, empty for WebSocket conns.
+	SessionID string
+	// PeerVersion is the webdial version the peer reported during the
+	// handshake, empty if it didn't.
+	PeerVersion string
+	// Target is the backend the client asked for with WithTarget.
+	Target string
+	// ReadBuffered is the number of bytes received from the peer but not
+	// yet returned by Read.
+	ReadBuffered int
+	// LastError is the most recent read or write error, ignoring io.EOF.
+	LastError error
+}
+
+func (s ConnState) String() string {
+	str := fmt.Sprintf("%s %s local=%s remote=%s", s.Transport, s.Phase, s.LocalAddr, s.RemoteAddr)
+	if s.SessionID != "" {
+		str += " sid=" + s.SessionID
+	}
+	if s.PeerVersion != "" {
+		str += " version=" + s.PeerVersion
+	}
+	if s.Target != "" {
+		str += " target=" + s.Target
+	}
+	str += fmt.Sprintf(" buffered=%d", s.ReadBuffered)
+	if s.LastError != nil {
+		str += fmt.Sprintf(" err=%q", s.LastError.Error())
+	}
+	return str
+}
+
+// StateOf returns the internal state of a conn returned by Dial or Accept.
+func StateOf(conn net.Conn) (ConnState, bool) {
+	sc, ok := conn.(interface{ State() ConnState })
+	if !ok {
+		return ConnState{}, false
+	}
+	return sc.State(), true
+}
+
+// stateTracker records the phase and last error of a conn, and ends its
+// context once it is closed.
+type stateTracker struct {
+	phase   atomic.Int32
+	errMu   sync.Mutex
+	lastErr error
+	ctxOnce sync.Once
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+func (t *stateTracker) setPhase(p ConnPhase) {
+	t.phase.Store(int32(p))
+	if p == PhaseClosed {
+		t.end(net.ErrClosed)
+	}
+}
+
+// Context returns a context cancelled once the conn is closed, or its
+// reads find the peer has closed it or the connection has failed.
+// context.Cause reports which.
+func (t *stateTracker) Context() context.Context {
+	t.ctxOnce.Do(func() { t.ctx, t.cancel = context.WithCancelCause(context.Background()) })
+	return t.ctx
+}
+
+// connContext returns conn's context, or a background one if it has none.
+func connContext(conn net.Conn) context.Context {
+	if c, ok := conn.(interface{ Context() context.Context }); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// end cancels the conn's context with cause, unless it already is.
+func (t *stateTracker) end(cause error) {
+	t.Context()
+	t.cancel(cause)
+}
+
+// advancePhase moves to p unless the conn is already past it.
+func (t *stateTracker) advancePhase(p ConnPhase) {
+	for {
+		cur := t.phase.Load()
+		if cur >= int32(p) || t.phase.CompareAndSwap(cur, int32(p)) {
+			return
+		}
+	}
+}
+
+// recordErr records err as the conn's LastError, returning it as a
+// net.Error.
+func (t *stateTracker) recordErr(err error) error {
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = netError(err)
+		t.errMu.Lock()
+		t.lastErr = err
+		t.errMu.Unlock()
+	}
+	return err
+}
+
+func (t *stateTracker) snapshot(transport string, local, remote net.Addr) ConnState {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	return ConnState{
+		Phase:      ConnPhase(t.phase.Load()),
+		Transport:  transport,
+		LocalAddr:  local.String(),
+		RemoteAddr: remote.String(),
+		LastError:  t.lastErr,
+	}
+}
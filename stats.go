@@ -0,0 +1,73 @@
+package webdial
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of a conn, for dashboards and debugging.
+type Stats struct {
+	Transport    string
+	BytesRead    int64
+	BytesWritten int64
+	// FramesRead counts WebSocket messages or SSE data events received.
+	FramesRead int64
+	// FramesWritten counts WebSocket messages or POSTs sent.
+	FramesWritten int64
+	// Posts counts the POSTs issued by an SSE conn, including the close.
+	Posts int64
+	// Reconnects counts re-dials by a ReliableConn.
+	Reconnects int
+	// RTT is a smoothed round-trip time estimate from WebSocket pings or
+	// SSE POSTs. Zero means nothing has been measured yet.
+	RTT time.Duration
+}
+
+// connStats are the counters shared by every conn type.
+type connStats struct {
+	bytesRead     atomic.Int64
+	bytesWritten  atomic.Int64
+	framesRead    atomic.Int64
+	framesWritten atomic.Int64
+	posts         atomic.Int64
+	rtt           atomic.Int64 // smoothed, in nanoseconds
+}
+
+func (s *connStats) counters() *connStats { return s }
+
+// observeRTT folds a round-trip sample into the estimate, weighting it by
+// 1/8 as TCP does.
+func (s *connStats) observeRTT(sample time.Duration) {
+	for {
+		old := s.rtt.Load()
+		next := int64(sample)
+		if old != 0 {
+			next = old + (int64(sample)-old)/8
+		}
+		if s.rtt.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+func (s *connStats) stats(transport string) Stats {
+	return Stats{
+		Transport:     transport,
+		BytesRead:     s.bytesRead.Load(),
+		BytesWritten:  s.bytesWritten.Load(),
+		FramesRead:    s.framesRead.Load(),
+		FramesWritten: s.framesWritten.Load(),
+		Posts:         s.posts.Load(),
+		RTT:           time.Duration(s.rtt.Load()),
+	}
+}
+
+// add accumulates o into s, for totals across reconnects.
+func (s Stats) add(o Stats) Stats {
+	s.BytesRead += o.BytesRead
+	s.BytesWritten += o.BytesWritten
+	s.FramesRead += o.FramesRead
+	s.FramesWritten += o.FramesWritten
+	s.Posts += o.Posts
+	return s
+}
@@ -0,0 +1,96 @@
+package webdial
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// tagsHeader carries the client's tags, comma separated. Clients that
+// can't set headers use the tags query parameter.
+const tagsHeader = "X-Webdial-Tags"
+
+// WithTags labels the conn, e.g. "agent" or "dashboard", so the server can
+// route it with AcceptMatch.
+func WithTags(tags ...string) DialOption {
+	return func(d *Dialer) {
+		d.Tags = append(slices.Clip(d.Tags), tags...)
+	}
+}
+
+func requestTags(r *http.Request) []string {
+	raw := r.Header.Get(tagsHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get("tags")
+	}
+	if raw == "" {
+		return nil
+	}
+	var tags []string
+	for tag := range strings.SplitSeq(raw, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Tags returns the tags the client dialed with WithTags.
+func (c *ServerConn) Tags() []string {
+	return slices.Clone(c.meta().tags)
+}
+
+// HasTag reports whether the client dialed with tag.
+func (c *ServerConn) HasTag(tag string) bool {
+	return slices.Contains(c.meta().tags, tag)
+}
+
+// MatchTag returns an AcceptMatch filter for conns tagged tag.
+func MatchTag(tag string) func(*ServerConn) bool {
+	return func(c *ServerConn) bool { return c.HasTag(tag) }
+}
+
+// AcceptMatch waits for the next conn for which match returns true, so
+// that several goroutines can each accept only the conns they handle,
+// e.g. AcceptMatch(ctx, MatchTag("agent")). Conns that don't match are
+// held for other callers of AcceptMatch or Accept. A nil match accepts
+// any conn.
+func (s *Server) AcceptMatch(ctx context.Context, match func(*ServerConn) bool) (net.Conn, error) {
+	for {
+		s.heldMu.Lock()
+		for i, conn := range s.held {
+			if match == nil || match(conn) {
+				s.held = slices.Delete(s.held, i, i+1)
+				s.heldMu.Unlock()
+				return s.accepted(conn), nil
+			}
+		}
+		changed := s.heldChanged
+		// Stop pulling conns nobody wants once as many are held as the
+		// queue holds, so the accept queue still pushes back.
+		acceptCh := s.acceptCh
+		if len(s.held) >= max(cap(s.acceptCh), 1) {
+			acceptCh = nil
+		}
+		s.heldMu.Unlock()
+		select {
+		case conn := <-acceptCh:
+			sc := conn.(*ServerConn)
+			if match == nil || match(sc) {
+				return s.accepted(sc), nil
+			}
+			s.heldMu.Lock()
+			s.held = append(s.held, sc)
+			close(s.heldChanged)
+			s.heldChanged = make(chan struct{})
+			s.heldMu.Unlock()
+		case <-changed:
+		case <-s.closed:
+			return nil, ErrServerClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
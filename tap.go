@@ -0,0 +1,34 @@
+package webdial
+
+import "fmt"
+
+// Direction is which way the data a tap sees was going.
+type Direction int
+
+const (
+	// Inbound is data read from the peer.
+	Inbound Direction = iota
+	// Outbound is data written to the peer.
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// WithTap sets Dialer.Tap.
+func WithTap(fn func(dir Direction, b []byte)) DialOption {
+	return func(d *Dialer) { d.Tap = fn }
+}
+
+// WithConnTap calls fn with every chunk of data read from or written to
+// each conn, as Dialer.Tap does for clients.
+func WithConnTap(fn func(dir Direction, b []byte)) ServerOption {
+	return func(s *Server) { s.connTap = fn }
+}
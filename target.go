@@ -0,0 +1,35 @@
+package webdial
+
+import (
+	"net"
+	"net/http"
+)
+
+// targetHeader carries the backend the client wants, see WithTarget.
+// Clients that can't set headers, such as browser EventSource, use the
+// target query parameter instead.
+const targetHeader = "X-Webdial-Target"
+
+// WithTarget asks the server to connect the conn to target, e.g.
+// "db:5432", so one webdial endpoint can front several backends. The
+// server reads it with TargetOf and decides what it means.
+func WithTarget(target string) DialOption {
+	return func(d *Dialer) { d.Target = target }
+}
+
+// TargetOf returns the target the client of an accepted conn asked for
+// with WithTarget, or "" if it didn't.
+func TargetOf(conn net.Conn) string {
+	mc, ok := conn.(interface{ meta() *connMeta })
+	if !ok {
+		return ""
+	}
+	return mc.meta().target
+}
+
+func requestTarget(r *http.Request) string {
+	if t := r.Header.Get(targetHeader); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("target")
+}
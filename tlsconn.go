@@ -0,0 +1,53 @@
+package webdial
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds ClientTLS and ServerTLS handshakes, as
+// http.Transport's TLSHandshakeTimeout does.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ClientTLS runs a TLS client handshake over conn, for end-to-end TLS
+// with a peer behind the webdial server, such as a ServerTLS conn or a
+// TLS backend reached with WithForward. config may be nil for the
+// defaults, and is cloned, defaulting to TLS 1.3; it needs a ServerName
+// unless it skips verification. The handshake gives up after 10 seconds,
+// through conn's deadline, which it clears afterwards.
+func ClientTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tc := tls.Client(conn, tlsDefaults(config))
+	return tc, handshakeTLS(conn, tc)
+}
+
+// ServerTLS runs a TLS server handshake over conn, e.g. an accepted conn
+// whose client calls ClientTLS. config must have a certificate, and is
+// otherwise defaulted as for ClientTLS.
+func ServerTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	tc := tls.Server(conn, tlsDefaults(config))
+	return tc, handshakeTLS(conn, tc)
+}
+
+func tlsDefaults(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return config
+}
+
+func handshakeTLS(conn net.Conn, tc *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,88 @@
+package webdial
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Tracer traces dial attempts, server handshakes and session lifetimes,
+// see WithTracer and WithConnTracer. Its methods mirror OpenTelemetry's,
+// without webdial depending on otel; the github.com/jpillora/webdial/otel
+// module adapts an otel TracerProvider.
+type Tracer interface {
+	// Start starts a span named name, a child of any span in ctx.
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+	// Inject adds the trace context of ctx to the headers of an outgoing
+	// handshake, e.g. as W3C traceparent.
+	Inject(ctx context.Context, header http.Header)
+	// Extract returns ctx with the trace context of an incoming
+	// handshake's headers.
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+// Span is an operation started by a Tracer.
+type Span interface {
+	// End ends the span, failed if err isn't nil, adding attrs.
+	End(err error, attrs ...slog.Attr)
+}
+
+// WithTracer sets Dialer.Tracer.
+func WithTracer(t Tracer) DialOption {
+	return func(d *Dialer) { d.Tracer = t }
+}
+
+// WithConnTracer traces the server's handshakes, as "webdial.handshake"
+// spans, children of the span that the client's trace context headers
+// carry, such as a Dialer's "webdial.dial". Each conn's lifetime is a
+// "webdial.session" span, a child of its handshake's, ending with its
+// byte counts and last error.
+func WithConnTracer(t Tracer) ServerOption {
+	return func(s *Server) { s.tracer = t }
+}
+
+// errHandshakeRejected ends the spans of handshakes the server turned
+// away, which the response's status explains.
+var errHandshakeRejected = errors.New("webdial: handshake rejected")
+
+type noopSpan struct{}
+
+func (noopSpan) End(error, ...slog.Attr) {}
+
+func startSpan(t Tracer, ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	return t.Start(ctx, name, attrs...)
+}
+
+// traceHandshake starts the span of the handshake r, returning r's
+// context with it.
+func (s *Server) traceHandshake(r *http.Request, transport string) (context.Context, Span) {
+	if s.tracer == nil {
+		return r.Context(), noopSpan{}
+	}
+	ctx := s.tracer.Extract(r.Context(), r.Header)
+	return s.tracer.Start(ctx, "webdial.handshake",
+		slog.String("transport", transport),
+		slog.String("client", r.RemoteAddr))
+}
+
+// traceSession starts the span of conn's lifetime, returning a func
+// ending it.
+func (s *Server) traceSession(conn *ServerConn) func() {
+	if s.tracer == nil {
+		return func() {}
+	}
+	_, span := s.tracer.Start(conn.traceCtx, "webdial.session",
+		slog.String("id", conn.ID()),
+		slog.String("transport", conn.Transport()),
+		slog.String("client", conn.Request().RemoteAddr))
+	return func() {
+		st := conn.Stats()
+		span.End(conn.State().LastError,
+			slog.Int64("read", st.BytesRead),
+			slog.Int64("written", st.BytesWritten))
+	}
+}
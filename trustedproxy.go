@@ -0,0 +1,103 @@
+package webdial
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// WithTrustedProxies takes the client's address from the Forwarded or
+// X-Forwarded-For header of requests arriving from proxies within
+// prefixes, e.g. netip.MustParsePrefix("10.0.0.0/8"). The headers'
+// addresses are walked from the nearest hop outwards, and the first that
+// isn't itself a trusted proxy is the client. It then stands in for the
+// request's RemoteAddr everywhere the server uses it: conns' RemoteAddr
+// and ClientAddr, logs, WithAcceptFilter and the default ClientLimits
+// key. Requests from anywhere else are taken as they come, so clients
+// can't forge their address.
+func WithTrustedProxies(prefixes ...netip.Prefix) ServerOption {
+	return func(s *Server) { s.trustedProxies = prefixes }
+}
+
+// realClient returns r with RemoteAddr set to the client's address, if r
+// came from a trusted proxy that gave one.
+func (s *Server) realClient(r *http.Request) *http.Request {
+	if len(s.trustedProxies) == 0 {
+		return r
+	}
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !s.trusted(peer.Addr()) {
+		return r
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if s.trusted(hop.Addr()) && i > 0 {
+			continue
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.RemoteAddr = hop.String()
+		return r2
+	}
+	return r
+}
+
+func (s *Server) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses in the Forwarded header's for=
+// parameters, or in X-Forwarded-For without one, client first. Hops with
+// no port get port 0, and unparseable ones, such as obfuscated
+// identifiers, end the list, since nothing before them can be trusted.
+func forwardedFor(h http.Header) []netip.AddrPort {
+	var values []string
+	if fwd := h.Values("Forwarded"); len(fwd) > 0 {
+		for _, v := range fwd {
+			for elem := range strings.SplitSeq(v, ",") {
+				for pair := range strings.SplitSeq(elem, ";") {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if strings.EqualFold(key, "for") {
+						values = append(values, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+	} else {
+		for _, v := range h.Values("X-Forwarded-For") {
+			for hop := range strings.SplitSeq(v, ",") {
+				values = append(values, strings.TrimSpace(hop))
+			}
+		}
+	}
+	var hops []netip.AddrPort
+	for _, v := range values {
+		hop, ok := parseHop(v)
+		if !ok {
+			// Only what's after it, nearer us, stands.
+			hops = hops[:0]
+			continue
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseHop parses "1.2.3.4", "1.2.3.4:80", "[::1]" or "[::1]:80".
+func parseHop(s string) (netip.AddrPort, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0), true
+	}
+	return netip.AddrPort{}, false
+}
@@ -0,0 +1,63 @@
+package webdial
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// WithCheckOrigin sets the function deciding whether a WebSocket
+// handshake's Origin is acceptable. By default every origin is.
+func WithCheckOrigin(fn func(*http.Request) bool) ServerOption {
+	return func(s *Server) { s.upgrader.CheckOrigin = fn }
+}
+
+// WithAllowedOrigins only accepts WebSocket handshakes from browsers on
+// the given origins, e.g. "https://app.example.com". Handshakes without
+// an Origin header, as sent by non-browser clients, are accepted.
+func WithAllowedOrigins(origins ...string) ServerOption {
+	return WithCheckOrigin(func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		return slices.ContainsFunc(origins, func(o string) bool {
+			return strings.EqualFold(o, origin)
+		})
+	})
+}
+
+// WithSameOrigin only accepts WebSocket handshakes from browsers on the
+// host being dialed, like the gorilla/websocket default.
+func WithSameOrigin() ServerOption {
+	return WithCheckOrigin(func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	})
+}
+
+// WithBufferSizes sets the WebSocket read and write buffer sizes. Zero
+// means 4096 bytes.
+func WithBufferSizes(read, write int) ServerOption {
+	return func(s *Server) {
+		s.upgrader.ReadBufferSize = read
+		s.upgrader.WriteBufferSize = write
+	}
+}
+
+// WithCompression negotiates per-message deflate with WebSocket clients
+// that offer it.
+func WithCompression() ServerOption {
+	return func(s *Server) { s.upgrader.EnableCompression = true }
+}
+
+// WithSubprotocols sets the WebSocket subprotocols the server supports, in
+// order of preference. The first one the client also offers is selected.
+func WithSubprotocols(protocols ...string) ServerOption {
+	return func(s *Server) { s.upgrader.Subprotocols = protocols }
+}
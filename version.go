@@ -0,0 +1,139 @@
+package webdial
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// versionHeader carries the webdial version of each peer during the
+// handshake, in both directions.
+const versionHeader = "X-Webdial-Version"
+
+const modulePath = "github.com/jpillora/webdial"
+
+// version is the webdial module version compiled into this binary.
+var version = moduleVersion()
+
+// develVersion is the version of builds without one, such as a main
+// module built from a checkout or webdial replaced by a local directory.
+const develVersion = "(devel)"
+
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return develVersion
+	}
+	return buildVersion(info)
+}
+
+// buildVersion returns the webdial module version in info.
+func buildVersion(info *debug.BuildInfo) string {
+	v := ""
+	if info.Main.Path == modulePath {
+		v = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			v = dep.Version
+			if dep.Replace != nil {
+				v = dep.Replace.Version
+			}
+		}
+	}
+	if v == "" {
+		return develVersion
+	}
+	return v
+}
+
+// semverPattern matches semantic versions as Go modules have them, such
+// as v1.2.3, v1.3.0-rc.1 or a pseudo-version.
+var semverPattern = regexp.MustCompile(`^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+	`(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// maxVersionLabel bounds the versions versionLabel keeps.
+const maxVersionLabel = 64
+
+// versionLabel is a client's reported version as Metrics.ClientVersions
+// counts it: "unknown" if it reported none and "other" unless it is a
+// semantic version or "(devel)", so that clients can't grow the metrics
+// without bound by sending made-up versions.
+func versionLabel(v string) string {
+	switch {
+	case v == "":
+		return "unknown"
+	case v == develVersion:
+		return v
+	case len(v) > maxVersionLabel || !semverPattern.MatchString(v):
+		return "other"
+	}
+	return v
+}
+
+// VersionError is returned by Dial when the server requires a newer client.
+type VersionError struct {
+	ClientVersion string
+	MinVersion    string
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("webdial: client version %s is older than the server minimum %s", e.ClientVersion, e.MinVersion)
+}
+
+func (e *VersionError) Is(target error) bool { return target == ErrHandshake }
+
+// checkClientVersion rejects the request if the client is older than min.
+// Development builds are always accepted, clients that don't report a
+// version never are.
+func checkClientVersion(w http.ResponseWriter, r *http.Request, min string) bool {
+	if min == "" {
+		return true
+	}
+	v := r.Header.Get(versionHeader)
+	if v == develVersion || (v != "" && compareVersions(v, min) >= 0) {
+		return true
+	}
+	body := errorResponse{
+		Error:      fmt.Sprintf("client version %q is older than %s", v, min),
+		MinVersion: min,
+	}
+	writeJSON(w, http.StatusUpgradeRequired, body)
+	return false
+}
+
+// compareVersions compares two semantic versions such as v1.2.3-rc.1,
+// returning -1, 0 or 1. Build metadata is ignored and pre-releases sort
+// before their release.
+func compareVersions(a, b string) int {
+	a, aPre, _ := strings.Cut(strings.TrimPrefix(strings.SplitN(a, "+", 2)[0], "v"), "-")
+	b, bPre, _ := strings.Cut(strings.TrimPrefix(strings.SplitN(b, "+", 2)[0], "v"), "-")
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range max(len(as), len(bs)) {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return strings.Compare(aPre, bPre)
+}
@@ -3,7 +3,14 @@ package webdial
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,12 +28,169 @@ func generateSessionID() string {
 	return hex.EncodeToString(b)
 }
 
-type noopDeadline struct{}
+// errorResponse is the JSON body the server sends when it rejects a
+// request. Hint, if set, names the transport the client should use instead.
+type errorResponse struct {
+	Error string `json:"error"`
+	Hint  string `json:"hint,omitempty"`
+	// MinVersion is set when the client is too old.
+	MinVersion string `json:"minVersion,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, msg, hint string) {
+	writeJSON(w, status, errorResponse{Error: msg, Hint: hint})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serverError is a rejection reported by a webdial server.
+type serverError struct {
+	status     int
+	msg        string
+	hint       string
+	retryAfter time.Duration
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("webdial: server returned %d: %s", e.status, e.msg)
+}
 
-func (noopDeadline) SetDeadline(t time.Time) error      { return nil }
-func (noopDeadline) SetReadDeadline(t time.Time) error  { return nil }
-func (noopDeadline) SetWriteDeadline(t time.Time) error { return nil }
+func (e *serverError) Is(target error) bool { return target == ErrHandshake }
+
+// readServerError parses a webdial error response, returning nil if resp
+// did not come from a webdial server.
+func readServerError(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	var body errorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err != nil || body.Error == "" {
+		return nil
+	}
+	if body.MinVersion != "" {
+		return &VersionError{ClientVersion: version, MinVersion: body.MinVersion}
+	}
+	return &serverError{status: resp.StatusCode, msg: body.Error, hint: body.Hint, retryAfter: parseRetryAfter(resp)}
+}
+
+// statusError is an unexpected HTTP response that didn't come from a
+// webdial server, such as a 502 from a load balancer in front of it.
+type statusError struct {
+	err        error
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string        { return e.err.Error() }
+func (e *statusError) Unwrap() error        { return e.err }
+func (e *statusError) Is(target error) bool { return target == ErrHandshake }
+
+// responseError describes a failed handshake response, preferring the
+// webdial error in its body.
+func responseError(resp *http.Response, err error) error {
+	if se := readServerError(resp); se != nil {
+		return se
+	}
+	return &statusError{err: err, status: resp.StatusCode, retryAfter: parseRetryAfter(resp)}
+}
+
+// parseRetryAfter returns the delay in resp's Retry-After header, in
+// seconds or as an HTTP date, or zero.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// connMeta holds the handshake details shared by every conn type.
+type connMeta struct {
+	fingerprint *TLSFingerprint
+	peerVersion string
+	target      string
+	metadata    map[string]string
+	tags        []string
+}
+
+func (m *connMeta) meta() *connMeta { return m }
+
+// annotate adds the handshake details to st.
+func (m *connMeta) annotate(st *ConnState) {
+	st.PeerVersion = m.peerVersion
+	st.Target = m.target
+}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{ msg string }
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// defaultMaxFrameSize is the most a WebSocket message, SSE event or SSE
+// POST carries unless WithMaxFrameSize or WithFrameSize says otherwise.
+const defaultMaxFrameSize = 1 << 20
+
+// writeFrames writes b with write in pieces of at most max bytes, or of
+// defaultMaxFrameSize if max isn't positive, stopping at the first error.
+// An empty b is still written once.
+func writeFrames(b []byte, max int, write func([]byte) error) (int, error) {
+	if max <= 0 {
+		max = defaultMaxFrameSize
+	}
+	var n int
+	for first := true; first || len(b) > 0; first = false {
+		frame := b[:min(len(b), max)]
+		if err := write(frame); err != nil {
+			return n, err
+		}
+		n += len(frame)
+		b = b[len(frame):]
+	}
+	return n, nil
+}
+
+// connError makes err a net.Error, whose Timeout reports whether anything
+// it wraps is a timeout.
+type connError struct{ err error }
+
+func (e *connError) Error() string { return e.err.Error() }
+func (e *connError) Unwrap() error { return e.err }
+
+func (e *connError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.err, &ne) && ne.Timeout()
+}
+
+func (e *connError) Temporary() bool { return false }
+
+// netError returns err as a net.Error, so that callers type-asserting
+// errors from a conn, as http.Server and grpc do, see Timeout correctly.
+// io.EOF is left alone.
+func netError(err error) error {
+	if _, ok := err.(net.Error); ok || err == nil || err == io.EOF {
+		return err
+	}
+	return &connError{err}
+}
 
 var _ net.Conn = (*wsConn)(nil)
 var _ net.Conn = (*sseClientConn)(nil)
 var _ net.Conn = (*sseServerConn)(nil)
+var _ net.PacketConn = (*PacketConn)(nil)
+var _ net.Listener = (*Server)(nil)
+var _ net.Listener = (*Listener)(nil)
+var _ http.Handler = (*Server)(nil)
+var _ http.Handler = (*Router)(nil)
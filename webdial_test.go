@@ -1,10 +1,37 @@
 package webdial
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,7 +77,7 @@ func TestSSETransport(t *testing.T) {
 		_, err = conn.Write([]byte("pong"))
 		require.NoError(t, err)
 	}()
-	conn, err := dialSSE(context.Background(), ts.URL)
+	conn, err := (&Dialer{Transport: "sse"}).DialContext(context.Background(), ts.URL)
 	require.NoError(t, err)
 	defer conn.Close()
 	_, err = conn.Write([]byte("ping"))
@@ -61,3 +88,4022 @@ func TestSSETransport(t *testing.T) {
 	require.Equal(t, "pong", string(buf[:n]))
 	require.Equal(t, "webdial-sse", conn.LocalAddr().Network())
 }
+
+func TestPacketConn(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		pc := NewPacketConn(conn)
+		buf := make([]byte, 1500)
+		for range 2 {
+			n, addr, err := pc.ReadFrom(buf)
+			require.NoError(t, err)
+			_, err = pc.WriteTo(buf[:n], addr)
+			require.NoError(t, err)
+		}
+	}()
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	pc := NewPacketConn(conn)
+	for _, msg := range []string{"first", "second"} {
+		_, err = pc.WriteTo([]byte(msg), nil)
+		require.NoError(t, err)
+		buf := make([]byte, 1500)
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf[:n]))
+	}
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	// A browser-like hello, with GREASE values throughout and extensions
+	// out of order.
+	fp := newTLSFingerprint(&tls.ClientHelloInfo{
+		CipherSuites:      []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f},
+		ServerName:        "example.com",
+		SupportedCurves:   []tls.CurveID{0x3a3a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:   []uint8{0},
+		SignatureSchemes:  []tls.SignatureScheme{0x0403, 0x0804, 0x0401},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		Extensions:        []uint16{0x1a1a, 0x0000, 0x0033, 0x0010, 0x000d, 0x002b, 0x000a, 0x000b, 0x0017},
+	})
+	// JA3 keeps the hello's order; JA4 sorts ciphers and extensions, and
+	// drops SNI and ALPN from the latter, but not from its count.
+	require.Equal(t, TLSFingerprint{
+		JA3:     "771,4865-4866-4867-49195-49199,0-51-16-13-43-10-11-23,29-23-24,0",
+		JA3Hash: "4a68f08df060a50acafa8e5ddad66c4d",
+		JA4:     "t13d0508h2_e133e205ac38_0217bda7c7b8",
+	}, fp)
+
+	var filtered, opened *TLSFingerprint
+	srv := NewServer(
+		WithAcceptFilter(func(info ConnInfo) bool {
+			filtered = info.Fingerprint
+			return true
+		}),
+		WithEvents(func(ev ServerEvent) {
+			if ev.Type == EventOpen {
+				opened = ev.Fingerprint
+			}
+		}))
+	defer srv.Close()
+	ts := httptest.NewUnstartedServer(srv)
+	EnableTLSFingerprinting(ts.Config)
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	conn, err := srv.Accept()
+	require.NoError(t, err)
+	fp, ok := TLSFingerprintOf(conn)
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(fp.JA4, "t13i"), fp.JA4)
+	require.Len(t, fp.JA3Hash, 32)
+	require.Equal(t, &fp, filtered)
+	require.Equal(t, &fp, opened)
+}
+
+func TestTransportHint(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	// Simulate a proxy that strips hop-by-hop upgrade headers.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Upgrade")
+		r.Header.Del("Connection")
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	_, err := (&Dialer{Transport: "ws"}).DialContext(context.Background(), ts.URL)
+	var se *serverError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, "sse", se.hint)
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		conn.Close()
+	}()
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "webdial-sse", conn.LocalAddr().Network())
+}
+
+func TestDialerHeader(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		d := &Dialer{
+			Header:    http.Header{"Authorization": {"Bearer token"}},
+			Transport: transport,
+		}
+		conn, err := d.DialContext(context.Background(), ts.URL)
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "hi", string(buf))
+		conn.Close()
+	}
+	conn, err := Dial(context.Background(), ts.URL, WithHeader("Authorization", "Bearer token"))
+	require.NoError(t, err)
+	conn.Close()
+	_, err = Dial(context.Background(), ts.URL, WithHeaders(http.Header{"X-Other": {"1"}}))
+	require.Error(t, err)
+}
+
+func TestEgressPolicy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	var events []EgressEvent
+	p := &EgressPolicy{
+		AllowPorts:  []int{mustAtoi(t, port)},
+		MaxDuration: 50 * time.Millisecond,
+		Audit:       func(ev EgressEvent) { events = append(events, ev) },
+	}
+	_, err = p.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	conn, err := p.DialContext(context.Background(), "tcp", ln.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err, "conn should be closed after MaxDuration")
+	conn.Close()
+	require.Len(t, events, 3)
+	require.False(t, events[0].Allowed)
+	require.True(t, events[1].Allowed)
+	require.True(t, events[2].Closed)
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	n, err := strconv.Atoi(s)
+	require.NoError(t, err)
+	return n
+}
+
+func TestConnState(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		accepted <- conn
+	}()
+	conn, err := (&Dialer{Transport: "sse"}).DialContext(context.Background(), ts.URL)
+	require.NoError(t, err)
+	st, ok := StateOf(conn)
+	require.True(t, ok)
+	require.Equal(t, PhaseEstablished, st.Phase)
+	require.NotEmpty(t, st.SessionID)
+	sconn := <-accepted
+	var dump strings.Builder
+	require.NoError(t, srv.DumpState(&dump))
+	require.Contains(t, dump.String(), "sse established")
+	require.Contains(t, dump.String(), "sid="+st.SessionID)
+	sconn.Close()
+	st, _ = StateOf(sconn)
+	require.Equal(t, PhaseClosed, st.Phase)
+	conn.Close()
+	st, _ = StateOf(conn)
+	require.Equal(t, PhaseClosed, st.Phase)
+}
+
+type countingTransport struct {
+	n atomic.Int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.n.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestDialOptionClients(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		io.Copy(conn, conn)
+	}()
+	rt := &countingTransport{}
+	wd := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("websockets blocked")
+		},
+	}
+	conn, err := Dial(context.Background(), ts.URL, WithHTTPClient(&http.Client{Transport: rt}), WithWebsocketDialer(wd))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), rt.n.Load())
+}
+
+func TestDialTLS(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewTLSServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	cfg := &tls.Config{RootCAs: pool}
+	_, err := Dial(context.Background(), ts.URL, WithWebsocketDialer(&websocket.Dialer{}))
+	require.Error(t, err, "untrusted certificate should fail")
+	conn, err := Dial(context.Background(), ts.URL, WithTLSConfig(cfg))
+	require.NoError(t, err)
+	conn.Close()
+	conn, err = (&Dialer{TLSConfig: cfg, Transport: "sse"}).DialContext(context.Background(), ts.URL)
+	require.NoError(t, err)
+	conn.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err = Dial(context.Background(), ts.URL, WithInsecureSkipVerify(), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		conn.Close()
+	}
+}
+
+// testProxy is a minimal forward proxy supporting CONNECT and
+// absolute-URI requests, counting each request it handles.
+func testProxy(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	rp := &httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+		pr.Out.URL = pr.In.URL
+	}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Method != http.MethodConnect {
+			rp.ServeHTTP(w, r)
+			return
+		}
+		backend, err := net.Dial("tcp", r.Host)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusOK)
+		client, _, err := http.NewResponseController(w).Hijack()
+		require.NoError(t, err)
+		go func() {
+			io.Copy(backend, client)
+			backend.Close()
+		}()
+		io.Copy(client, backend)
+		client.Close()
+	}))
+}
+
+func TestDialProxy(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	var hits atomic.Int32
+	proxy := testProxy(t, &hits)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	for _, transport := range []string{"ws", "sse"} {
+		hits.Store(0)
+		d := &Dialer{Transport: transport}
+		WithProxy(proxyURL)(d)
+		conn, err := d.DialContext(context.Background(), ts.URL)
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		conn.Close()
+		require.NotZero(t, hits.Load(), transport)
+	}
+}
+
+func TestVersionHandshake(t *testing.T) {
+	srv := NewServer()
+	srv.MinClientVersion = "v1.2.0"
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer func(v string) { version = v }(version)
+	version = "v1.1.9"
+	_, err := Dial(context.Background(), ts.URL)
+	var ve *VersionError
+	require.ErrorAs(t, err, &ve)
+	require.Equal(t, "v1.2.0", ve.MinVersion)
+	version = "v1.2.0"
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		st, _ := StateOf(conn)
+		require.Equal(t, "v1.2.0", st.PeerVersion)
+		conn.Close()
+	}()
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	st, _ := StateOf(conn)
+	require.Equal(t, srv.Version(), st.PeerVersion)
+}
+
+func TestVersionHeader(t *testing.T) {
+	header := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case header <- r.Header.Get(versionHeader):
+		default:
+		}
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer ts.Close()
+	Dial(context.Background(), ts.URL)
+	require.Equal(t, version, <-header)
+	require.NotEmpty(t, version)
+
+	// A local replace has no version, so is a development build.
+	replaced := &debug.BuildInfo{Deps: []*debug.Module{{
+		Path: modulePath, Version: "v1.2.3", Replace: &debug.Module{Path: "../webdial"},
+	}}}
+	require.Equal(t, develVersion, buildVersion(replaced))
+	replaced.Deps[0].Replace.Version = "v1.2.4"
+	require.Equal(t, "v1.2.4", buildVersion(replaced))
+	require.Equal(t, "v1.2.3", buildVersion(&debug.BuildInfo{Deps: []*debug.Module{{Path: modulePath, Version: "v1.2.3"}}}))
+}
+
+func TestCompareVersions(t *testing.T) {
+	require.Equal(t, 0, compareVersions("v1.2.3", "1.2.3+build"))
+	require.Equal(t, -1, compareVersions("v1.2.3", "v1.10.0"))
+	require.Equal(t, 1, compareVersions("v2.0.0", "v1.9.9"))
+	require.Equal(t, -1, compareVersions("v1.2.3-rc.1", "v1.2.3"))
+}
+
+func TestVersionLabel(t *testing.T) {
+	for v, want := range map[string]string{
+		"":                                   "unknown",
+		"(devel)":                            "(devel)",
+		"v1.2.3":                             "v1.2.3",
+		"v1.3.0-rc.1+build.5":                "v1.3.0-rc.1+build.5",
+		"v0.0.0-20261014124615-0c366fac0fc8": "v0.0.0-20261014124615-0c366fac0fc8",
+		"1.2.3":                              "other",
+		"v01.2.3":                            "other",
+		"v1.2":                               "other",
+		`v1.2.3"} 1`:                         "other",
+		"v1.2.3-" + strings.Repeat("a", 64):  "other",
+	} {
+		require.Equal(t, want, versionLabel(v), v)
+	}
+}
+
+func TestCookieAffinity(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.SetCookie(w, &http.Cookie{Name: "affinity", Value: "replica-1"})
+		} else if c, err := r.Cookie("affinity"); err != nil || c.Value != "replica-1" {
+			http.Error(w, "wrong replica", http.StatusBadGateway)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		io.Copy(conn, conn)
+	}()
+	conn, err := (&Dialer{Transport: "sse"}).DialContext(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+}
+
+func TestDialError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	_, err := Dial(context.Background(), ts.URL)
+	var de *DialError
+	require.ErrorAs(t, err, &de)
+	require.Equal(t, []string{"ws", "sse"}, de.Transports)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Contains(t, err.Error(), "sse: webdial: sse returned 404")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// A server that starts an event stream but never sends the session ID.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	d := &Dialer{Transport: "sse"}
+	WithHandshakeTimeout(100 * time.Millisecond)(d)
+	start := time.Now()
+	_, err := d.DialContext(context.Background(), ts.URL)
+	var ne net.Error
+	require.ErrorAs(t, err, &ne)
+	require.True(t, ne.Timeout())
+	require.ErrorIs(t, err, ErrHandshakeTimeout)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSSEOutlivesDialContext(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		io.Copy(conn, conn)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	conn, err := (&Dialer{Transport: "sse"}).DialContext(ctx, ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	cancel()
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+}
+
+// lateWriter records writes after the handler using it has returned.
+type lateWriter struct {
+	http.ResponseWriter
+	returned, late atomic.Bool
+}
+
+func (w *lateWriter) Write(b []byte) (int, error) {
+	if w.returned.Load() {
+		w.late.Store(true)
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *lateWriter) Flush() {
+	if !w.returned.Load() {
+		w.ResponseWriter.(http.Flusher).Flush()
+	}
+}
+
+func (w *lateWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func TestSSEWriteAfterHandler(t *testing.T) {
+	srv := NewServer(WithHeartbeat(-1))
+	defer srv.Close()
+	writers := make(chan *lateWriter, 1)
+	cancels := make(chan context.CancelFunc, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			srv.ServeHTTP(w, r)
+			return
+		}
+		lw := &lateWriter{ResponseWriter: w}
+		writers <- lw
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels <- cancel
+		defer lw.returned.Store(true)
+		srv.ServeHTTP(lw, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	lw := <-writers
+	// The stream's handler returns, as when the client goes, leaving the
+	// conn open until the session is closed.
+	(<-cancels)()
+	require.Eventually(t, lw.returned.Load, 5*time.Second, 10*time.Millisecond)
+	_, err = sc.Write([]byte("late"))
+	require.Error(t, err)
+	require.False(t, lw.late.Load(), "wrote to a finished response")
+}
+
+func TestCloseOnCancel(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			if _, err := srv.Accept(); err != nil {
+				return
+			}
+			// Never read, so writes block until aborted.
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		conn, err := (&Dialer{Transport: transport, CloseOnCancel: true}).DialContext(ctx, ts.URL)
+		require.NoError(t, err, transport)
+		readErr, writeErr := make(chan error, 1), make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			readErr <- err
+		}()
+		var writes atomic.Int64
+		go func() {
+			chunk := make([]byte, 64<<10)
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					writeErr <- err
+					return
+				}
+				writes.Add(1)
+			}
+		}()
+		// Once the socket's buffers are full, or the first POST is held,
+		// the writes stall.
+		last := int64(-1)
+		require.Eventually(t, func() bool {
+			n := writes.Load()
+			stalled := n == last
+			last = n
+			return stalled
+		}, 10*time.Second, 100*time.Millisecond, transport)
+		require.Empty(t, writeErr, transport)
+		cancel()
+		for name, errs := range map[string]chan error{"read": readErr, "write": writeErr} {
+			select {
+			case err := <-errs:
+				require.Error(t, err, transport)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: %s not interrupted by cancel", transport, name)
+			}
+		}
+	}
+}
+
+// dropListener records the conns it accepts, so that a test can drop
+// them all as a failing network would.
+type dropListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *dropListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *dropListener) drop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestDialReliable(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var refuse atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := int(refuse.Load()); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	network := &dropListener{Listener: ts.Listener}
+	ts.Listener = network
+	ts.Start()
+	defer ts.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	echo := func() net.Conn {
+		sc := <-accepted
+		go io.Copy(sc, sc)
+		return sc
+	}
+	for _, transport := range []string{"ws", "sse"} {
+		dial := func() *ReliableConn {
+			conn, err := DialReliable(context.Background(), ts.URL,
+				func(d *Dialer) { d.Transport = transport },
+				WithReconnect(ReconnectPolicy{MinBackoff: 10 * time.Millisecond, MaxBuffer: 8}))
+			require.NoError(t, err, transport)
+			return conn
+		}
+		conn := dial()
+		echo()
+		_, err := conn.Write([]byte("one"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "one", string(buf), transport)
+
+		// The network drops, and re-dials are turned away for now.
+		refuse.Store(http.StatusServiceUnavailable)
+		got := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 3)
+			io.ReadFull(conn, buf)
+			got <- string(buf)
+		}()
+		network.drop()
+		require.Eventually(t, func() bool { return conn.snapshot() == nil }, 5*time.Second, time.Millisecond, transport)
+		// Writes meanwhile are held, up to MaxBuffer.
+		_, err = conn.Write([]byte("two"))
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("too much"))
+		require.ErrorIs(t, err, ErrBufferFull, transport)
+		refuse.Store(0)
+		sc := echo()
+		select {
+		case s := <-got:
+			require.Equal(t, "two", s, transport)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no echo after reconnect", transport)
+		}
+		st := conn.Stats()
+		require.Equal(t, 1, st.Reconnects, transport)
+		require.EqualValues(t, 6, st.BytesWritten, transport)
+
+		// The server closing the conn ends it, rather than a re-dial.
+		sc.Close()
+		_, err = conn.Read(buf)
+		require.Equal(t, io.EOF, err, transport)
+		_, err = conn.Write([]byte("two"))
+		require.Equal(t, io.EOF, err, transport)
+		require.Equal(t, 1, conn.Reconnects(), transport)
+		require.NoError(t, conn.Close(), transport)
+
+		// As does a re-dial turned away for good.
+		conn = dial()
+		echo()
+		refuse.Store(http.StatusForbidden)
+		network.drop()
+		_, err = conn.Read(buf)
+		require.Equal(t, http.StatusForbidden, errStatus(err), transport)
+		_, err = conn.Write([]byte("two"))
+		require.Equal(t, http.StatusForbidden, errStatus(err), transport)
+		require.Equal(t, 0, conn.Reconnects(), transport)
+		require.NoError(t, conn.Close(), transport)
+		refuse.Store(0)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail both transports of the first attempt, like a restarting
+		// backend behind a load balancer.
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "backend restarting", http.StatusServiceUnavailable)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		for {
+			if _, err := srv.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err := Dial(context.Background(), ts.URL)
+	require.ErrorContains(t, err, "503")
+
+	requests.Store(0)
+	start := time.Now()
+	conn, err := Dial(context.Background(), ts.URL, WithRetry(2, 10*time.Millisecond))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.GreaterOrEqual(t, time.Since(start), time.Second, "Retry-After ignored")
+	require.EqualValues(t, 3, requests.Load())
+}
+
+func TestPool(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	pool := NewPool(ts.URL, 2)
+	// Both conns are dialed before anyone asks for one.
+	require.Eventually(t, func() bool { return accepted.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+	for i := range 3 {
+		conn, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		msg := []byte("hello " + strconv.Itoa(i))
+		_, err = conn.Write(msg)
+		require.NoError(t, err)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+		conn.Close()
+	}
+	// Taken conns are replaced.
+	require.Eventually(t, func() bool { return accepted.Load() == 5 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, pool.Close())
+	_, err := pool.Get(context.Background())
+	require.Error(t, err)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go http.Serve(srv, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnelled " + r.URL.Path))
+	}))
+	for _, transport := range []string{"ws", "sse"} {
+		rt := NewHTTPTransport(ts.URL, func(d *Dialer) { d.Transport = transport })
+		client := &http.Client{Transport: rt}
+		for range 2 {
+			resp, err := client.Get("http://internal.example/status")
+			require.NoError(t, err, transport)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err, transport)
+			require.Equal(t, "tunnelled /status", string(body), transport)
+		}
+		rt.CloseIdleConnections()
+	}
+}
+
+func TestConnHandshake(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			if _, err := srv.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	for transport, status := range map[string]int{"ws": http.StatusSwitchingProtocols, "sse": http.StatusOK} {
+		conn, err := (&Dialer{Transport: transport}).DialContext(context.Background(), ts.URL)
+		require.NoError(t, err, transport)
+		require.Equal(t, transport, conn.Transport())
+		require.Equal(t, status, conn.HTTPResponse().StatusCode, transport)
+		require.Equal(t, srv.Version(), conn.PeerVersion(), transport)
+		st, ok := StateOf(conn)
+		require.True(t, ok, transport)
+		require.Equal(t, transport, st.Transport)
+		conn.Close()
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	var pings atomic.Int32
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		// Swallow pings without ponging, like a wedged peer.
+		ws.SetPingHandler(func(string) error {
+			pings.Add(1)
+			return nil
+		})
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer silent.Close()
+	conn, err := Dial(context.Background(), silent.URL, WithKeepAlive(20*time.Millisecond, 50*time.Millisecond))
+	require.NoError(t, err)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		require.ErrorIs(t, err, errPongTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn not closed after pongs stopped")
+	}
+	require.Positive(t, pings.Load())
+	require.ErrorIs(t, conn.State().LastError, errPongTimeout)
+
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			// Pings are only answered while the server reads.
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err = Dial(context.Background(), ts.URL, WithKeepAlive(20*time.Millisecond, 50*time.Millisecond))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	require.True(t, isTimeout(err), "live conn closed: %v", err)
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := Dial(context.Background(), ts.URL, WithRateLimit(50_000))
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	// The first second's worth is a free burst, the rest is throttled.
+	n, err := conn.Write(make([]byte, 100_000))
+	require.NoError(t, err)
+	require.Equal(t, 100_000, n)
+	elapsed := time.Since(start)
+	require.Greater(t, elapsed, 900*time.Millisecond)
+	require.Less(t, elapsed, 3*time.Second)
+}
+
+func TestDialPathPrefix(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	mux := http.NewServeMux()
+	var bad atomic.Value // string
+	mux.Handle("/tenant-a/wd/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "tenant-a.internal" || r.URL.Query().Get("token") != "x" {
+			bad.Store(r.Method + " " + r.Host + " " + r.URL.String())
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL+"/tenant-a/wd/?token=x",
+			WithHost("tenant-a.internal"), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "hi", string(buf), transport)
+		conn.Close()
+	}
+	require.Nil(t, bad.Load())
+}
+
+func TestDialHTTP2(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var mu sync.Mutex
+	remotes := map[string]bool{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "want h2c", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		mu.Lock()
+		remotes[r.RemoteAddr] = true
+		mu.Unlock()
+		srv.ServeHTTP(w, r)
+	}))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	conn, err := Dial(context.Background(), ts.URL, WithHTTP2(), func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	for range 3 {
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+	}
+	conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, remotes, 1, "stream and posts should share one connection")
+}
+
+func TestCoalescing(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var posts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posts.Add(1)
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	conn, err := Dial(context.Background(), ts.URL, WithCoalescing(50*time.Millisecond, 0),
+		func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := range 10 {
+		_, err := conn.Write([]byte{byte('0' + i)})
+		require.NoError(t, err)
+	}
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(buf))
+	require.EqualValues(t, 1, posts.Load())
+
+	// Flush doesn't wait for the delay.
+	conn.Write([]byte("x"))
+	require.NoError(t, conn.Flush())
+	require.EqualValues(t, 2, posts.Load())
+}
+
+func TestAsyncWrites(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var maxInflight, inflight atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("q") {
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				m := maxInflight.Load()
+				if n <= m || maxInflight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			// Jitter so pipelined POSTs arrive out of order.
+			time.Sleep(time.Duration(mustAtoi(t, r.URL.Query().Get("q"))%3) * time.Millisecond)
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	conn, err := Dial(context.Background(), ts.URL, WithAsyncWrites(8), func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	var want strings.Builder
+	for i := range 100 {
+		msg := fmt.Sprintf("%03d", i)
+		want.WriteString(msg)
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.NoError(t, conn.Flush())
+	got := make([]byte, want.Len())
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), string(got))
+	require.Greater(t, maxInflight.Load(), int32(1), "posts weren't pipelined")
+	require.LessOrEqual(t, maxInflight.Load(), int32(8))
+}
+
+func TestStrictOrder(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var maxInflight, inflight atomic.Int32
+	var fail atomic.Bool
+	var seqs []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.ContentLength > 0 {
+			if fail.Load() {
+				// As if the response was lost after delivery.
+				srv.ServeHTTP(httptest.NewRecorder(), r)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				m := maxInflight.Load()
+				if n <= m || maxInflight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			mu.Lock()
+			seqs = append(seqs, r.URL.Query().Get("q"))
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, WithStrictOrder(), WithAsyncWrites(8), func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 60)
+		io.ReadFull(sc, b)
+		got <- b
+	}()
+	var want strings.Builder
+	for i := range 20 {
+		msg := fmt.Sprintf("%03d", i)
+		want.WriteString(msg)
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.Equal(t, want.String(), string(<-got))
+	require.EqualValues(t, 1, maxInflight.Load(), "posts were pipelined")
+	for i, q := range seqs {
+		require.Equal(t, strconv.Itoa(i), q)
+	}
+	// A POST that may have been delivered fails the conn for writing,
+	// rather than risk sending its bytes twice.
+	go func() {
+		b := make([]byte, 1)
+		io.ReadFull(sc, b)
+		got <- b
+	}()
+	fail.Store(true)
+	_, err = conn.Write([]byte("x"))
+	require.Error(t, err)
+	fail.Store(false)
+	_, err2 := conn.Write([]byte("y"))
+	require.Equal(t, err, err2)
+	require.Equal(t, "x", string(<-got))
+}
+
+func TestDuplicatePosts(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method == http.MethodPost && r.ContentLength > 0 {
+			mu.Lock()
+			attempts[key]++
+			first := attempts[key] == 1
+			mu.Unlock()
+			if key == "2" && first {
+				// Deliver, then drop the connection before responding,
+				// so the client's transport retries.
+				srv.ServeHTTP(httptest.NewRecorder(), r)
+				c, _, err := http.NewResponseController(w).Hijack()
+				require.NoError(t, err)
+				c.Close()
+				return
+			}
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 3)
+		io.ReadFull(sc, b)
+		got <- b
+	}()
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := conn.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+	require.Equal(t, "abc", string(<-got))
+	mu.Lock()
+	require.Equal(t, 2, attempts["2"], "post wasn't retried")
+	mu.Unlock()
+
+	// The session delivers each key once, however often it is posted.
+	sess := newSSESession(&sseServerConn{closeCh: make(chan struct{})})
+	pr, pw := newPipe()
+	sess.conn.readPipe, sess.conn.writePipe = pr, pw
+	go func() {
+		for range 3 {
+			require.NoError(t, sess.Post(context.Background(), -1, "k", strings.NewReader("x")))
+		}
+		require.NoError(t, sess.Post(context.Background(), -1, "", strings.NewReader("y")))
+		pw.Close()
+	}()
+	b, err := io.ReadAll(pr)
+	require.NoError(t, err)
+	require.Equal(t, "xy", string(b))
+}
+
+func TestTypedErrors(t *testing.T) {
+	_, err := Dial(context.Background(), "http://127.0.0.1:1", func(d *Dialer) { d.Transport = "quic" })
+	require.ErrorIs(t, err, ErrUnsupportedTransport)
+	_, err = Dial(context.Background(), "ftp://127.0.0.1:1")
+	require.ErrorIs(t, err, ErrUnsupportedTransport)
+
+	notWebdial := httptest.NewServer(http.NotFoundHandler())
+	defer notWebdial.Close()
+	_, err = Dial(context.Background(), notWebdial.URL)
+	require.ErrorIs(t, err, ErrHandshake)
+
+	srv := NewServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := srv.Accept()
+		require.NoError(t, err)
+		accepted <- conn
+	}()
+	conn, err := (&Dialer{Transport: "sse"}).DialContext(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	// The server forgets the session.
+	(<-accepted).Close()
+	require.Eventually(t, func() bool {
+		_, err := conn.Write([]byte("x"))
+		return errors.Is(err, ErrSessionNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	srv.Close()
+	_, err = srv.Accept()
+	require.ErrorIs(t, err, ErrServerClosed)
+}
+
+func TestDialTarget(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(TargetOf(conn) + "\n"))
+			conn.Close()
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithTarget("db:5432"), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		got := make([]byte, len("db:5432\n"))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err, transport)
+		require.Equal(t, "db:5432\n", string(got), transport)
+		conn.Close()
+	}
+}
+
+func TestDialMetadata(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	got := make(chan map[string]string, 1)
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			got <- MetadataOf(conn)
+			conn.Close()
+		}
+	}()
+	want := map[string]string{"agentID": "a-42", "labels": "region=eu,tier=edge"}
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL,
+			WithMetadata("agentID", "a-42"), WithMetadata("labels", "region=eu,tier=edge"),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		require.Equal(t, want, <-got, transport)
+		conn.Close()
+	}
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	var remotes sync.Map
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remotes.Store(host, true)
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithLocalAddr(local), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("x"))
+		require.NoError(t, err, transport)
+		conn.Close()
+	}
+	remotes.Range(func(host, _ any) bool {
+		require.Equal(t, "127.0.0.2", host)
+		return true
+	})
+	_, err := Dial(context.Background(), ts.URL, WithNetwork("tcp6"))
+	require.Error(t, err, "tcp6 can't reach an IPv4 server")
+	_, err = Dial(context.Background(), ts.URL, WithNetwork("udp"))
+	require.ErrorContains(t, err, "unsupported network")
+}
+
+func TestDialSchemes(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	tlsTS := httptest.NewTLSServer(srv)
+	defer tlsTS.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	urls := []string{
+		strings.Replace(ts.URL, "http://", "wd://", 1),
+		strings.Replace(tlsTS.URL, "https://", "wds://", 1),
+	}
+	for _, u := range urls {
+		for _, transport := range []string{"ws", "sse"} {
+			conn, err := Dial(context.Background(), u, WithInsecureSkipVerify(), func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err, u, transport)
+			conn.Close()
+		}
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithKeepAlive(10*time.Millisecond, 0),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		for range 2 {
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err, transport)
+		}
+		buf := make([]byte, 10)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		// Keep reading so WebSocket pongs are processed.
+		go io.Copy(io.Discard, conn)
+		require.Eventually(t, func() bool { return conn.Stats().RTT > 0 }, 5*time.Second, 10*time.Millisecond, transport)
+		st := conn.Stats()
+		require.Equal(t, transport, st.Transport)
+		require.EqualValues(t, 10, st.BytesWritten, transport)
+		require.EqualValues(t, 10, st.BytesRead, transport)
+		require.EqualValues(t, 2, st.FramesWritten, transport)
+		require.Positive(t, st.FramesRead, transport)
+		if transport == "sse" {
+			require.EqualValues(t, 2, st.Posts)
+		}
+		conn.Close()
+	}
+}
+
+func TestPing(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		go io.Copy(io.Discard, conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rtt, err := conn.Ping(ctx)
+		cancel()
+		require.NoError(t, err, transport)
+		require.Positive(t, rtt, transport)
+		require.Positive(t, conn.Stats().RTT, transport)
+		conn.Close()
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_, err := (&Conn{Conn: a}).Ping(context.Background())
+	require.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithIdleTimeout(200*time.Millisecond),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		// Activity keeps the conn open past the timeout.
+		buf := make([]byte, 1)
+		for range 4 {
+			time.Sleep(100 * time.Millisecond)
+			_, err = conn.Write([]byte("x"))
+			require.NoError(t, err, transport)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err, transport)
+		}
+		start := time.Now()
+		_, err = conn.Read(buf)
+		require.ErrorIs(t, err, ErrIdleTimeout, transport)
+		require.True(t, isTimeout(err), transport)
+		require.Less(t, time.Since(start), 2*time.Second, transport)
+		conn.Close()
+	}
+}
+
+func TestSSEDeadlines(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Unlike gorilla's WebSocket conns, a timed-out Read leaves SSE conns
+	// usable once the deadline is cleared.
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.Read(buf)
+	require.True(t, isTimeout(err), "%v", err)
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	_, err = sc.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	require.NoError(t, sc.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = sc.Read(buf)
+	require.True(t, isTimeout(err), "%v", err)
+	require.NoError(t, sc.SetReadDeadline(time.Time{}))
+	go conn.Write([]byte("pong"))
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+
+	// A passed write deadline fails writes straight away.
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write([]byte("late"))
+	require.True(t, isTimeout(err), "%v", err)
+	conn.Close()
+	sc.Close()
+}
+
+func TestNetErrors(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	requireNetError := func(err error, timeout bool, transport string) {
+		t.Helper()
+		var ne net.Error
+		require.True(t, errors.As(err, &ne), "%s: %T %v", transport, err, err)
+		_, ok := err.(net.Error)
+		require.True(t, ok, "%s: %T %v", transport, err, err)
+		require.Equal(t, timeout, ne.Timeout(), "%s: %v", transport, err)
+	}
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+
+		require.NoError(t, sc.SetReadDeadline(time.Now().Add(20*time.Millisecond)), transport)
+		_, err = sc.Read(make([]byte, 1))
+		requireNetError(err, true, transport)
+
+		// The peer going away is io.EOF or a net.Error that isn't a
+		// timeout, and so is using a closed conn.
+		sc.Close()
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			requireNetError(err, false, transport)
+		}
+		_, err = sc.Write([]byte("x"))
+		requireNetError(err, false, transport)
+		conn.Close()
+		_, err = conn.Write([]byte("x"))
+		requireNetError(err, false, transport)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	srv := NewServer(WithFrameSize(1000), WithMaxPostSize(1000))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithMaxFrameSize(1000),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+
+		go conn.Write(msg)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(sc, got)
+		require.NoError(t, err, transport)
+		require.Equal(t, msg, got, transport)
+		require.Eventually(t, func() bool { return conn.Stats().FramesWritten == 10 }, 5*time.Second, 10*time.Millisecond, transport)
+
+		n, err := sc.Write(msg)
+		require.NoError(t, err, transport)
+		require.Equal(t, len(msg), n, transport)
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err, transport)
+		require.Equal(t, msg, got, transport)
+		require.Equal(t, int64(10), conn.Stats().FramesRead, transport)
+		conn.Close()
+		sc.Close()
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	srv := NewServer(WithMaxMessageSize(1000))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithReadLimit(1000),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+
+		// Messages up to the limit go through, larger ones fail the conn.
+		small := bytes.Repeat([]byte("x"), 1000)
+		_, err = sc.Write(small)
+		require.NoError(t, err, transport)
+		got := make([]byte, len(small))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err, transport)
+		go sc.Write(make([]byte, 5000))
+		_, err = io.ReadFull(conn, make([]byte, 5000))
+		require.ErrorIs(t, err, ErrMessageTooLarge, transport)
+		conn.Close()
+		sc.Close()
+	}
+
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "ws" })
+	require.NoError(t, err)
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	go conn.Write(make([]byte, 5000))
+	_, err = io.ReadFull(sc, make([]byte, 5000))
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	conn.Close()
+}
+
+func TestSSEReadWindow(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, WithReadWindow(1000),
+		func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+
+	// The server can't get more than the window ahead of the reader.
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+	done := make(chan error, 1)
+	go func() {
+		_, err := sc.Write(msg)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("write completed without the client reading: %v", err)
+	default:
+	}
+	require.LessOrEqual(t, sc.(*ServerConn).Stats().BytesWritten, int64(1000))
+
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	require.Equal(t, msg, got)
+	require.NoError(t, <-done)
+}
+
+func TestFlowControl(t *testing.T) {
+	srv := NewServer(WithFlowControl(2000))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithReadWindow(1000),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+
+		// Neither side gets further ahead of the other's reads than its
+		// window.
+		serverDone := make(chan error, 1)
+		go func() {
+			_, err := sc.Write(msg)
+			serverDone <- err
+		}()
+		clientDone := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(msg)
+			clientDone <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		require.Len(t, serverDone, 0, transport)
+		require.LessOrEqual(t, sc.(*ServerConn).Stats().BytesWritten, int64(1000), transport)
+		require.Len(t, clientDone, 0, transport)
+		if transport == "ws" {
+			require.LessOrEqual(t, conn.Stats().BytesWritten, int64(2000), transport)
+		}
+
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		require.NoError(t, err, transport)
+		require.Equal(t, msg, got, transport)
+		require.NoError(t, <-serverDone, transport)
+		_, err = io.ReadFull(sc, got)
+		require.NoError(t, err, transport)
+		require.Equal(t, msg, got, transport)
+		require.NoError(t, <-clientDone, transport)
+		conn.Close()
+		sc.Close()
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	msg := make([]byte, 32<<10)
+	for _, transport := range []string{"ws", "sse"} {
+		b.Run(transport, func(b *testing.B) {
+			conn, err := Dial(context.Background(), ts.URL, WithReadBuffer(64<<10),
+				func(d *Dialer) { d.Transport = transport })
+			require.NoError(b, err)
+			defer conn.Close()
+			sc, err := srv.Accept()
+			require.NoError(b, err)
+			defer sc.Close()
+			go func() {
+				for {
+					if _, err := sc.Write(msg); err != nil {
+						return
+					}
+				}
+			}()
+			buf := make([]byte, len(msg))
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	srv := NewServer(WithFlowControl(1 << 20))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Messages bigger than the buffers, read in pieces smaller than them.
+	var msgs [][]byte
+	for i := range 3 {
+		msg := make([]byte, 40000+i)
+		for j := range msg {
+			msg[j] = byte(i*7 + j*31)
+		}
+		msgs = append(msgs, msg)
+	}
+	want := bytes.Join(msgs, nil)
+	for _, transport := range []string{"ws", "sse"} {
+		// A read window puts WebSocket messages through its inbox.
+		for _, window := range []int{0, 1 << 20} {
+			conn, err := Dial(context.Background(), ts.URL, WithReadBuffer(512), WithReadWindow(window),
+				func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err, transport)
+			sc, err := srv.Accept()
+			require.NoError(t, err, transport)
+			go func() {
+				for _, msg := range msgs {
+					sc.Write(msg)
+				}
+			}()
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, 0, len(want))
+			buf := make([]byte, 1000)
+			for len(got) < len(want) {
+				n, err := conn.Read(buf)
+				require.NoError(t, err, transport, window)
+				got = append(got, buf[:n]...)
+			}
+			require.Equal(t, want, got, transport, window)
+			conn.Close()
+			sc.Close()
+		}
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	srv := NewServer(WithConnWriteBuffer(100))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, WithWriteBuffer(100),
+			func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+
+		// Small writes wait for Flush, then go as one frame.
+		for _, b := range []byte("hello") {
+			_, err = conn.Write([]byte{b})
+			require.NoError(t, err, transport)
+		}
+		require.Zero(t, conn.Stats().FramesWritten, transport)
+		done := make(chan error, 1)
+		go func() { done <- conn.Flush() }()
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(sc, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "hello", string(buf), transport)
+		require.NoError(t, <-done, transport)
+		require.EqualValues(t, 1, conn.Stats().FramesWritten, transport)
+
+		// Closing flushes too.
+		_, err = sc.Write([]byte("bye"))
+		require.NoError(t, err, transport)
+		require.Zero(t, sc.(*ServerConn).Stats().FramesWritten, transport)
+		require.NoError(t, sc.Close())
+		got, _ := io.ReadAll(conn)
+		require.Equal(t, "bye", string(got), transport)
+		conn.Close()
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	srv := NewServer(WithConnWriteTimeout(100 * time.Millisecond))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Writes to a peer that never reads fail once the socket's buffers
+	// are full.
+	writeUntilFail := func(conn net.Conn) error {
+		chunk := make([]byte, 1<<20)
+		for range 1000 {
+			if _, err := conn.Write(chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	conn, err := Dial(context.Background(), ts.URL, WithWriteTimeout(100*time.Millisecond),
+		func(d *Dialer) { d.Transport = "ws" })
+	require.NoError(t, err)
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	err = writeUntilFail(conn)
+	require.True(t, isTimeout(err), "%v", err)
+	err = writeUntilFail(sc)
+	require.True(t, isTimeout(err), "%v", err)
+	conn.Close()
+	sc.Close()
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		queue int
+	}{{"ws", 0}, {"ws", 4}, {"sse", 0}} {
+		t.Run(fmt.Sprintf("%s/queue=%d", tc.name, tc.queue), func(t *testing.T) {
+			srv := NewServer()
+			defer srv.Close()
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			conn, err := Dial(context.Background(), ts.URL, WithWriteQueue(tc.queue),
+				func(d *Dialer) { d.Transport = tc.name })
+			require.NoError(t, err)
+			defer conn.Close()
+			sc, err := srv.Accept()
+			require.NoError(t, err)
+			defer sc.Close()
+			// Each writer sends blocks of its own byte, which must arrive
+			// whole.
+			const writers, blocks, size = 8, 16, 32 << 10
+			var wg sync.WaitGroup
+			for i := range writers {
+				wg.Go(func() {
+					block := bytes.Repeat([]byte{byte('a' + i)}, size)
+					for range blocks {
+						_, err := conn.Write(block)
+						require.NoError(t, err)
+					}
+				})
+			}
+			buf := make([]byte, size)
+			counts := map[byte]int{}
+			for range writers * blocks {
+				_, err := io.ReadFull(sc, buf)
+				require.NoError(t, err)
+				require.Equal(t, bytes.Repeat(buf[:1], size), buf)
+				counts[buf[0]]++
+			}
+			require.Len(t, counts, writers)
+			wg.Wait()
+			require.NoError(t, conn.Flush())
+		})
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err)
+			defer conn.Close()
+			sc, err := srv.Accept()
+			require.NoError(t, err)
+			defer sc.Close()
+			if transport == "ws" {
+				ws, ok := conn.Unwrap().(*websocket.Conn)
+				require.True(t, ok)
+				require.NoError(t, ws.NetConn().(*net.TCPConn).SetNoDelay(false))
+				_, ok = sc.(*ServerConn).Unwrap().(*websocket.Conn)
+				require.True(t, ok)
+			} else {
+				require.Same(t, conn.HTTPResponse(), conn.Unwrap())
+				_, ok := sc.(*ServerConn).Unwrap().(http.ResponseWriter)
+				require.True(t, ok)
+			}
+		})
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			dial := func() (*Conn, *ServerConn) {
+				conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+				require.NoError(t, err)
+				sc, err := srv.Accept()
+				require.NoError(t, err)
+				return conn, sc.(*ServerConn)
+			}
+			// The server's reason reaches the client, after what was
+			// written before it.
+			conn, sc := dial()
+			_, err := sc.Write([]byte("bye"))
+			require.NoError(t, err)
+			require.NoError(t, sc.CloseWithError(4001, "shutting down"))
+			b, err := io.ReadAll(conn)
+			require.Equal(t, "bye", string(b))
+			var ce *CloseError
+			require.ErrorAs(t, err, &ce)
+			require.Equal(t, CloseError{Code: 4001, Reason: "shutting down"}, *ce)
+			conn.Close()
+
+			// And the client's reaches the server.
+			conn, sc = dial()
+			require.NoError(t, conn.CloseWithError(4002, "logged out"))
+			_, err = io.ReadAll(sc)
+			require.ErrorAs(t, err, &ce)
+			require.Equal(t, CloseError{Code: 4002, Reason: "logged out"}, *ce)
+			sc.Close()
+
+			// A plain close is still io.EOF.
+			conn, sc = dial()
+			sc.Close()
+			_, err = conn.Read(make([]byte, 1))
+			require.ErrorIs(t, err, io.EOF)
+			conn.Close()
+			conn, sc = dial()
+			conn.Close()
+			_, err = sc.Read(make([]byte, 1))
+			require.ErrorIs(t, err, io.EOF)
+			sc.Close()
+		})
+	}
+}
+
+func TestSetKeepAlive(t *testing.T) {
+	srv := NewServer(WithHeartbeat(-1))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	type keepAliver interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	}
+	enable := func(conn net.Conn) {
+		ka, ok := conn.(keepAliver)
+		require.True(t, ok)
+		require.NoError(t, ka.SetKeepAlivePeriod(10*time.Millisecond))
+		require.NoError(t, ka.SetKeepAlive(true))
+	}
+	for _, transport := range []string{"ws", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err)
+			defer conn.Close()
+			sc, err := srv.Accept()
+			require.NoError(t, err)
+			defer sc.Close()
+			// Pongs are only seen while reading.
+			go io.Copy(io.Discard, conn)
+			go io.Copy(io.Discard, sc)
+			enable(conn)
+			enable(sc)
+			if transport == "ws" {
+				require.Eventually(t, func() bool { return conn.Stats().RTT > 0 }, 2*time.Second, 5*time.Millisecond)
+				require.Eventually(t, func() bool { return sc.(*ServerConn).Stats().RTT > 0 }, 2*time.Second, 5*time.Millisecond)
+			} else {
+				require.Eventually(t, func() bool { return conn.Stats().Posts >= 3 }, 2*time.Second, 5*time.Millisecond)
+			}
+			require.NoError(t, conn.SetKeepAlive(false))
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	srv := NewServer(WithRendezvous())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	newKey := func() *ecdh.PrivateKey {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		return key
+	}
+	alice, bob, mallory := newKey(), newKey(), newKey()
+	for _, transport := range []string{"ws", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			force := func(d *Dialer) { d.Transport = transport }
+			room := WithRoom("encrypted-" + transport)
+			a, err := Dial(context.Background(), ts.URL, force, room,
+				WithEncryption(Encryption{Key: alice, PeerKeys: []*ecdh.PublicKey{bob.PublicKey()}}))
+			require.NoError(t, err)
+			defer a.Close()
+			b, err := Dial(context.Background(), ts.URL, force, room,
+				WithEncryption(Encryption{Key: bob, PeerKeys: []*ecdh.PublicKey{alice.PublicKey()}}))
+			require.NoError(t, err)
+			defer b.Close()
+			// More than one record each way.
+			msg := bytes.Repeat([]byte("secret"), 30000)
+			go a.Write(msg)
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(b, got)
+			require.NoError(t, err)
+			require.Equal(t, msg, got)
+			go b.Write([]byte("reply"))
+			_, err = io.ReadFull(a, got[:5])
+			require.NoError(t, err)
+			require.Equal(t, "reply", string(got[:5]))
+			require.True(t, a.PeerKey().Equal(bob.PublicKey()))
+
+			// A peer with another key is refused.
+			room = WithRoom("impostor-" + transport)
+			a, err = Dial(context.Background(), ts.URL, force, room,
+				WithEncryption(Encryption{Key: alice, PeerKeys: []*ecdh.PublicKey{bob.PublicKey()}}))
+			require.NoError(t, err)
+			defer a.Close()
+			m, err := Dial(context.Background(), ts.URL, force, room, WithEncryption(Encryption{Key: mallory}))
+			require.NoError(t, err)
+			defer m.Close()
+			go m.Handshake(context.Background())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.ErrorIs(t, a.Handshake(ctx), ErrUntrustedPeer)
+
+			// And so is one that isn't encrypted.
+			room = WithRoom("plain-" + transport)
+			a, err = Dial(context.Background(), ts.URL, force, room, WithEncryption(Encryption{}))
+			require.NoError(t, err)
+			defer a.Close()
+			p, err := Dial(context.Background(), ts.URL, force, room)
+			require.NoError(t, err)
+			defer p.Close()
+			go p.Write(make([]byte, 64))
+			require.ErrorIs(t, a.Handshake(ctx), ErrNotEncrypted)
+		})
+	}
+}
+
+// splitConn holds back the rest of a write after cut bytes until resume
+// is closed.
+type splitConn struct {
+	net.Conn
+	cut    int
+	resume chan struct{}
+}
+
+func (c *splitConn) Write(b []byte) (int, error) {
+	if c.resume == nil || len(b) <= c.cut {
+		return c.Conn.Write(b)
+	}
+	n, err := c.Conn.Write(b[:c.cut])
+	if err != nil {
+		return n, err
+	}
+	<-c.resume
+	m, err := c.Conn.Write(b[c.cut:])
+	return n + m, err
+}
+
+func TestEncryptionReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	split := &splitConn{Conn: a}
+	ea, eb := EncryptConn(split, Encryption{}), EncryptConn(b, Encryption{})
+	defer ea.Close()
+	defer eb.Close()
+	go ea.Handshake(context.Background())
+	require.NoError(t, eb.Handshake(context.Background()))
+	// Cut records in their length prefix and in their ciphertext.
+	for _, cut := range []int{1, 5} {
+		split.cut, split.resume = cut, make(chan struct{})
+		go ea.Write([]byte("hello"))
+		eb.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := eb.Read(make([]byte, 5))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded, cut)
+		close(split.resume)
+		eb.SetReadDeadline(time.Time{})
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(eb, buf)
+		require.NoError(t, err, cut)
+		require.Equal(t, "hello", string(buf), cut)
+		split.resume = nil
+	}
+}
+
+func TestClientServerTLS(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	// Borrow httptest's certificate for the inner TLS.
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certs.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(certs.Certificate())
+	for _, transport := range []string{"ws", "sse"} {
+		t.Run(transport, func(t *testing.T) {
+			conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err)
+			sc, err := srv.Accept()
+			require.NoError(t, err)
+			done := make(chan error, 1)
+			go func() {
+				tc, err := ServerTLS(sc, &tls.Config{Certificates: certs.TLS.Certificates})
+				if err == nil {
+					_, err = io.Copy(tc, tc)
+				}
+				done <- err
+			}()
+			tc, err := ClientTLS(conn, &tls.Config{RootCAs: pool, ServerName: "example.com"})
+			require.NoError(t, err)
+			require.Equal(t, uint16(tls.VersionTLS13), tc.ConnectionState().Version)
+			_, err = tc.Write([]byte("hello"))
+			require.NoError(t, err)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(tc, buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf))
+			tc.Close()
+			<-done
+
+			// A server the client doesn't trust fails the handshake.
+			conn, err = Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err)
+			sc, err = srv.Accept()
+			require.NoError(t, err)
+			go ServerTLS(sc, &tls.Config{Certificates: certs.TLS.Certificates})
+			_, err = ClientTLS(conn, &tls.Config{ServerName: "example.com"})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		trusted []netip.Prefix
+		header  string
+		value   string
+		want    string
+	}{
+		{[]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, "X-Forwarded-For", "203.0.113.7, 127.0.0.5", "203.0.113.7:0"},
+		{[]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, "X-Forwarded-For", "203.0.113.7, 198.51.100.2", "198.51.100.2:0"},
+		{[]netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, "Forwarded", `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`, "[2001:db8::1]:4711"},
+		// Headers from untrusted peers are ignored.
+		{nil, "X-Forwarded-For", "203.0.113.7", "127.0.0.1:"},
+		{[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, "X-Forwarded-For", "203.0.113.7", "127.0.0.1:"},
+	} {
+		srv := NewServer(WithTrustedProxies(tc.trusted...))
+		ts := httptest.NewServer(srv)
+		for _, transport := range []string{"ws", "sse"} {
+			conn, err := Dial(context.Background(), ts.URL, WithHeader(tc.header, tc.value),
+				func(d *Dialer) { d.Transport = transport })
+			require.NoError(t, err)
+			sc, err := srv.Accept()
+			require.NoError(t, err)
+			for _, got := range []string{sc.RemoteAddr().String(), sc.(*ServerConn).ClientAddr().String()} {
+				if strings.HasSuffix(tc.want, ":") {
+					require.True(t, strings.HasPrefix(got, tc.want), "%s %s: %s", transport, tc.value, got)
+				} else {
+					require.Equal(t, tc.want, got, "%s %s", transport, tc.value)
+				}
+			}
+			conn.Close()
+			sc.Close()
+		}
+		ts.Close()
+		srv.Close()
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		srv := NewServer()
+		ts := httptest.NewServer(srv)
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		sctx := sc.(*ServerConn).Context()
+		require.NoError(t, conn.Context().Err())
+		require.NoError(t, sctx.Err())
+		// The client closes: the server sees it on Read.
+		require.NoError(t, conn.Close())
+		require.ErrorIs(t, context.Cause(conn.Context()), net.ErrClosed)
+		_, err = sc.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err)
+		select {
+		case <-sctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal(transport, "server conn context not cancelled")
+		}
+		require.Equal(t, io.EOF, context.Cause(sctx))
+		// Server.Close ends the rest.
+		conn, err = Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		sc, err = srv.Accept()
+		require.NoError(t, err)
+		srv.Close()
+		require.ErrorIs(t, context.Cause(sc.(*ServerConn).Context()), ErrServerClosed)
+		_, err = conn.Read(make([]byte, 1))
+		require.Equal(t, io.EOF, err, transport)
+		<-conn.Context().Done()
+		require.Equal(t, io.EOF, context.Cause(conn.Context()), transport)
+		conn.Close()
+		ts.Close()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		srv := NewServer()
+		ts := httptest.NewServer(srv)
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		go conn.Read(make([]byte, 1)) // WebSocket pings need a reader
+		go func() {
+			io.Copy(io.Discard, sc)
+			sc.Close()
+		}()
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- srv.Shutdown(context.Background()) }()
+		select {
+		case <-conn.Draining():
+		case <-time.After(5 * time.Second):
+			t.Fatal(transport, "no drain notice")
+		}
+		// New conns are turned away, live ones go on.
+		_, err = Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.Error(t, err)
+		_, err = sc.Write([]byte("x"))
+		require.NoError(t, err)
+		select {
+		case err := <-shutdown:
+			t.Fatal(transport, "shutdown returned early:", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		conn.Close()
+		select {
+		case err := <-shutdown:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal(transport, "shutdown didn't finish")
+		}
+		ts.Close()
+	}
+	// A conn left open is closed once the context is done.
+	srv := NewServer()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	require.ErrorIs(t, context.Cause(sc.(*ServerConn).Context()), ErrServerClosed)
+}
+
+func TestMetrics(t *testing.T) {
+	srv := NewServer(WithMaxConns(2))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var conns, scs []net.Conn
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		defer conn.Close()
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		defer sc.Close()
+		go conn.Write([]byte("ping"))
+		_, err = io.ReadFull(sc, make([]byte, 4))
+		require.NoError(t, err)
+		conns, scs = append(conns, conn), append(scs, sc)
+	}
+	_, err := Dial(context.Background(), ts.URL)
+	require.Error(t, err)
+	m := srv.Metrics()
+	require.Equal(t, map[string]int64{"ws": 1, "sse": 1}, m.Conns)
+	require.Equal(t, map[string]int64{"ws": 1, "sse": 1}, m.Handshakes)
+	require.Equal(t, map[string]int64{version: 2}, m.ClientVersions)
+	require.EqualValues(t, 1, m.Sessions)
+	require.EqualValues(t, 2, m.Accepts)
+	require.EqualValues(t, 1, m.Rejected)
+	require.EqualValues(t, 8, m.BytesRead)
+	// Closed conns' bytes stay in the totals.
+	conns[0].Close()
+	_, err = scs[0].Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	scs[0].Close()
+	m = srv.Metrics()
+	require.Equal(t, map[string]int64{"ws": 0, "sse": 1}, m.Conns)
+	require.EqualValues(t, 8, m.BytesRead)
+
+	rec := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+	for _, line := range []string{
+		"# TYPE webdial_conns gauge",
+		`webdial_conns{transport="sse"} 1`,
+		`webdial_handshakes_total{transport="ws"} 1`,
+		"webdial_accepts_total 2",
+		"webdial_rejected_total 1",
+		"webdial_read_bytes_total 8",
+		"webdial_accept_queue 0",
+		`webdial_build_info{version="` + version + `"} 1`,
+		`webdial_conns_by_client_version{client_version="` + version + `"} 1`,
+	} {
+		require.Contains(t, rec.Body.String(), line+"\n")
+	}
+	// Made-up client versions are counted together.
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(versionHeader, "made-up-"+strings.Repeat("x", 100))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	require.Equal(t, map[string]int64{version: 1, "other": 1}, srv.Metrics().ClientVersions)
+	rec = httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Body.String(), `webdial_conns_by_client_version{client_version="other"} 1`+"\n")
+	require.Equal(t, `a\\b\"c\nd`, labelEscaper.Replace("a\\b\"c\nd"))
+}
+
+// testTracer records spans, propagating the trace as a header.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name, trace string
+	parent      string // the name of the local parent span, if any
+	attrs       []slog.Attr
+	ended       chan error
+}
+
+type (
+	traceKey struct{}
+	spanKey  struct{}
+)
+
+func (tr *testTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	if trace == "" {
+		trace = name
+	}
+	parent, _ := ctx.Value(spanKey{}).(string)
+	span := &testSpan{name: name, trace: trace, parent: parent, attrs: attrs, ended: make(chan error, 1)}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	ctx = context.WithValue(ctx, spanKey{}, name)
+	return context.WithValue(ctx, traceKey{}, trace), span
+}
+
+func (tr *testTracer) Inject(ctx context.Context, h http.Header) {
+	if trace, ok := ctx.Value(traceKey{}).(string); ok {
+		h.Set("X-Test-Trace", trace)
+	}
+}
+
+func (tr *testTracer) Extract(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, traceKey{}, h.Get("X-Test-Trace"))
+}
+
+func (s *testSpan) End(err error, attrs ...slog.Attr) {
+	s.attrs = append(s.attrs, attrs...)
+	s.ended <- err
+}
+
+func (tr *testTracer) span(t *testing.T, name string) *testSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.spans {
+		if s.name == name {
+			return s
+		}
+	}
+	t.Fatalf("no %s span", name)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		client, server := &testTracer{}, &testTracer{}
+		srv := NewServer(WithConnTracer(server))
+		ts := httptest.NewServer(srv)
+		conn, err := Dial(context.Background(), ts.URL, WithTracer(client), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		dial := client.span(t, "webdial.dial")
+		require.NoError(t, <-dial.ended)
+		require.Contains(t, dial.attrs, slog.String("transport", transport))
+		handshake := server.span(t, "webdial.handshake")
+		require.NoError(t, <-handshake.ended)
+		session := server.span(t, "webdial.session")
+		// The server's spans join the client's trace.
+		require.Equal(t, dial.trace, handshake.trace)
+		require.Equal(t, dial.trace, session.trace)
+		require.Equal(t, "webdial.handshake", session.parent)
+		go conn.Write([]byte("hi"))
+		_, err = io.ReadFull(sc, make([]byte, 2))
+		require.NoError(t, err)
+		sc.Close()
+		require.NoError(t, <-session.ended)
+		require.Contains(t, session.attrs, slog.Int64("read", 2))
+		conn.Close()
+		ts.Close()
+		srv.Close()
+	}
+	// Rejected handshakes end their spans with an error.
+	server := &testTracer{}
+	srv := NewServer(WithConnTracer(server), WithAcceptFilter(func(ConnInfo) bool { return false }))
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close()
+	_, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.Error(t, err)
+	require.Error(t, <-server.span(t, "webdial.handshake").ended)
+}
+
+func TestExpvar(t *testing.T) {
+	srv := NewServer(WithExpvar("test"))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = srv.Accept()
+	require.NoError(t, err)
+	v := expvar.Get("webdial").(*expvar.Map).Get("test")
+	require.NotNil(t, v)
+	var m Metrics
+	require.NoError(t, json.Unmarshal([]byte(v.String()), &m))
+	require.EqualValues(t, 1, m.Accepts)
+	require.EqualValues(t, 1, m.Conns["ws"])
+
+	// Closing a server unpublishes it, unless it has been replaced.
+	vars := expvar.Get("webdial").(*expvar.Map)
+	replaced := NewServer(WithExpvar("other"))
+	other := NewServer(WithExpvar("other"))
+	replaced.Close()
+	require.NotNil(t, vars.Get("other"))
+	other.Close()
+	require.Nil(t, vars.Get("other"))
+	srv.Close()
+	require.Nil(t, vars.Get("test"))
+}
+
+func TestPprofLabels(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	ids := make(chan string, 2)
+	release := make(chan struct{})
+	defer close(release)
+	srv.OnConn(func(conn net.Conn) {
+		ids <- conn.(*ServerConn).ID()
+		<-release
+	})
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		defer conn.Close()
+		id := <-ids
+		var buf bytes.Buffer
+		require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+		// The server's goroutines for the conn, and OnConn's.
+		labelled := strings.Count(buf.String(), fmt.Sprintf(`"webdial_session":%q`, id))
+		require.GreaterOrEqual(t, labelled, 2, transport)
+		require.Contains(t, buf.String(), fmt.Sprintf(`"webdial_transport":%q`, transport))
+	}
+}
+
+func TestTap(t *testing.T) {
+	type chunk struct {
+		dir Direction
+		b   string
+	}
+	tap := func(mu *sync.Mutex, chunks *[]chunk) func(Direction, []byte) {
+		return func(dir Direction, b []byte) {
+			mu.Lock()
+			*chunks = append(*chunks, chunk{dir, string(b)})
+			mu.Unlock()
+		}
+	}
+	for _, transport := range []string{"ws", "sse"} {
+		var mu sync.Mutex
+		var client, server []chunk
+		srv := NewServer(WithConnTap(tap(&mu, &server)))
+		ts := httptest.NewServer(srv)
+		conn, err := Dial(context.Background(), ts.URL, WithTap(tap(&mu, &client)), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err)
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write([]byte("hello"))
+			written <- err
+		}()
+		b := make([]byte, 5)
+		_, err = io.ReadFull(sc, b)
+		require.NoError(t, err)
+		require.NoError(t, <-written)
+		go func() {
+			_, err := sc.Write([]byte("world"))
+			written <- err
+		}()
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		require.NoError(t, <-written)
+		mu.Lock()
+		require.Equal(t, []chunk{{Outbound, "hello"}, {Inbound, "world"}}, client, transport)
+		require.Equal(t, []chunk{{Inbound, "hello"}, {Outbound, "world"}}, server, transport)
+		mu.Unlock()
+		require.Equal(t, "in", Inbound.String())
+		conn.Close()
+		sc.Close()
+		ts.Close()
+		srv.Close()
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	srv := NewServer(WithAcceptQueue(1), WithHeartbeat(-1), WithMinClientVersion("v2.0.0"))
+	defer srv.Close()
+	require.Equal(t, 1, cap(srv.acceptCh))
+	require.Equal(t, time.Duration(-1), srv.KeepAlive)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer func(v string) { version = v }(version)
+	version = "v1.0.0"
+	_, err := Dial(context.Background(), ts.URL)
+	var ve *VersionError
+	require.ErrorAs(t, err, &ve)
+	require.Equal(t, "v2.0.0", ve.MinVersion)
+}
+
+func TestAcceptContext(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	_, ok := srv.TryAccept()
+	require.False(t, ok)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := srv.AcceptContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	var sc net.Conn
+	require.Eventually(t, func() bool {
+		sc, ok = srv.TryAccept()
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	sc.Close()
+}
+
+func TestOnConn(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	srv.OnConn(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("echo"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "echo", string(buf), transport)
+		conn.Close()
+	}
+}
+
+func TestAcceptOverflow(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		srv := NewServer(WithAcceptQueue(1), WithAcceptOverflow(OverflowReject))
+		ts := httptest.NewServer(srv)
+		first, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		require.Eventually(t, func() bool { return len(srv.acceptCh) == 1 }, 5*time.Second, 10*time.Millisecond)
+		_, err = Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		var se *serverError
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, time.Second, se.retryAfter, transport)
+		first.Close()
+		srv.Close()
+		ts.Close()
+	}
+
+	// An unbuffered queue still has room for one to drop.
+	for _, queue := range []int{1, 0} {
+		srv := NewServer(WithAcceptQueue(queue), WithAcceptOverflow(OverflowDropOldest))
+		ts := httptest.NewServer(srv)
+		first, err := Dial(context.Background(), ts.URL)
+		require.NoError(t, err, queue)
+		require.Eventually(t, func() bool { return len(srv.acceptCh) == 1 }, 5*time.Second, 10*time.Millisecond)
+		second, err := Dial(context.Background(), ts.URL)
+		require.NoError(t, err, queue)
+		_, err = first.Read(make([]byte, 1))
+		require.Error(t, err, queue)
+		sc, err := srv.Accept()
+		require.NoError(t, err, queue)
+		sc.Close()
+		first.Close()
+		second.Close()
+		srv.Close()
+		ts.Close()
+	}
+}
+
+func TestServerConn(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL+"?room=42",
+			func(d *Dialer) { d.Transport = transport },
+			WithHeader("X-Test", "yes"),
+			WithTarget("db:5432"),
+			WithMetadata("agent", "a1"))
+		require.NoError(t, err, transport)
+		c, err := srv.Accept()
+		require.NoError(t, err, transport)
+		sc, ok := c.(*ServerConn)
+		require.True(t, ok, transport)
+		require.Equal(t, transport, sc.Transport())
+		require.Equal(t, "yes", sc.Request().Header.Get("X-Test"), transport)
+		require.Equal(t, "42", sc.Request().URL.Query().Get("room"), transport)
+		require.Equal(t, "db:5432", sc.Target(), transport)
+		require.Equal(t, map[string]string{"agent": "a1"}, sc.Metadata(), transport)
+		ca, ok := sc.ClientAddr().(*net.TCPAddr)
+		require.True(t, ok, transport)
+		require.True(t, ca.IP.IsLoopback(), transport)
+		st, ok := StateOf(sc)
+		require.True(t, ok, transport)
+		require.Equal(t, PhaseEstablished, st.Phase, transport)
+		sc.Close()
+		conn.Close()
+	}
+}
+
+func TestAuth(t *testing.T) {
+	srv := NewServer(WithAuth(func(r *http.Request) (any, error) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			return "alice", nil
+		case "":
+			return nil, ErrUnauthorized
+		}
+		return nil, errors.New("bad token")
+	}))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	srv.OnConn(func(conn net.Conn) {
+		conn.Write([]byte(conn.(*ServerConn).Identity().(string)))
+		io.Copy(io.Discard, conn)
+	})
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		conn, err := Dial(context.Background(), ts.URL, force, WithHeader("Authorization", "Bearer good"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "alice", string(buf), transport)
+		_, err = conn.Write([]byte("posted"))
+		require.NoError(t, err, transport)
+		conn.Close()
+
+		var se *serverError
+		_, err = Dial(context.Background(), ts.URL, force)
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, http.StatusUnauthorized, se.status, transport)
+		_, err = Dial(context.Background(), ts.URL, force, WithHeader("Authorization", "Bearer bad"))
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, http.StatusForbidden, se.status, transport)
+	}
+	resp, err := http.Post(ts.URL+"/post?s=nope", "application/octet-stream", strings.NewReader("x"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestUpgraderOptions(t *testing.T) {
+	srv := NewServer(WithAllowedOrigins("https://app.example.com"), WithSubprotocols("v2", "v1"), WithCompression())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	ws, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{
+		"Origin":                 {"https://app.example.com"},
+		"Sec-WebSocket-Protocol": {"v1, v2"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "v2", resp.Header.Get("Sec-WebSocket-Protocol"))
+	ws.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	sc.Close()
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.com"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, err = Dial(context.Background(), ts.URL, WithHeader("Origin", "https://evil.example.com"))
+	var se *serverError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusForbidden, se.status)
+}
+
+func TestCORS(t *testing.T) {
+	srv := NewServer(WithCORS(CORSPolicy{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		AllowHeaders:     []string{"Authorization"},
+		MaxAge:           time.Hour,
+	}))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/post?s=x", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := preflight("https://app.example.com")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	require.Contains(t, resp.Header.Get("Access-Control-Allow-Headers"), "Authorization")
+	require.Equal(t, "3600", resp.Header.Get("Access-Control-Max-Age"))
+	require.Equal(t, http.StatusForbidden, preflight("https://evil.example.com").StatusCode)
+
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" },
+		WithHeader("Origin", "https://app.example.com"))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "https://app.example.com", conn.HTTPResponse().Header.Get("Access-Control-Allow-Origin"))
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	sc.Close()
+}
+
+func TestDialMountRedirect(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/wd/", srv)
+	var redirectedPosts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/wd" {
+			redirectedPosts.Add(1)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	srv.OnConn(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL+"/wd", func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "hi", string(buf), transport)
+		conn.Close()
+	}
+	require.Zero(t, redirectedPosts.Load())
+
+	// A stream redirected to another host doesn't take the POSTs, and
+	// their credentials, with it.
+	var leaked, kept atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			leaked.Add(1)
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			kept.Add(1)
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, other.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer origin.Close()
+	conn, err := Dial(context.Background(), origin.URL, WithHeader("Authorization", "Bearer secret"),
+		func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("hi"))
+	require.Zero(t, leaked.Load())
+	require.NotZero(t, kept.Load())
+}
+
+func TestMaxConns(t *testing.T) {
+	srv := NewServer(WithMaxConns(1))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		conn, err := Dial(context.Background(), ts.URL, force)
+		require.NoError(t, err, transport)
+		_, err = Dial(context.Background(), ts.URL, force)
+		var se *serverError
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, http.StatusServiceUnavailable, se.status, transport)
+		require.Equal(t, time.Second, se.retryAfter, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		sc.Close()
+		conn.Close()
+		require.Eventually(t, func() bool { return srv.live.Load() == 0 }, 5*time.Second, 10*time.Millisecond, transport)
+	}
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestClientLimits(t *testing.T) {
+	// Behind a trusted proxy, RemoteIP is the forwarded client.
+	srv := NewServer(WithClientLimits(ClientLimits{MaxConns: 1, PostRate: 2}),
+		WithTrustedProxies(netip.MustParsePrefix("127.0.0.0/8")))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	srv.OnConn(func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	sse := func(d *Dialer) { d.Transport = "sse" }
+	a, err := Dial(context.Background(), ts.URL, sse, WithHeader("X-Forwarded-For", "192.0.2.1"))
+	require.NoError(t, err)
+	defer a.Close()
+	_, err = Dial(context.Background(), ts.URL, WithHeader("X-Forwarded-For", "192.0.2.1, 127.0.0.2"))
+	var se *serverError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusTooManyRequests, se.status)
+	b, err := Dial(context.Background(), ts.URL, WithHeader("X-Forwarded-For", "192.0.2.2"))
+	require.NoError(t, err)
+	b.Close()
+
+	var writeErr error
+	for range 5 {
+		if _, writeErr = a.Write([]byte("x")); writeErr != nil {
+			break
+		}
+	}
+	require.ErrorContains(t, writeErr, "429")
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	sse := func(d *Dialer) { d.Transport = "sse" }
+	srv := NewServer(WithSessionIdleTimeout(100 * time.Millisecond))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	srv.OnConn(func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	idle, err := Dial(context.Background(), ts.URL, sse)
+	require.NoError(t, err)
+	defer idle.Close()
+	active, err := Dial(context.Background(), ts.URL, sse)
+	require.NoError(t, err)
+	defer active.Close()
+	for range 10 {
+		_, err = active.Ping(context.Background())
+		require.NoError(t, err)
+		time.Sleep(30 * time.Millisecond)
+	}
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	_, err = active.Ping(context.Background())
+	require.NoError(t, err)
+
+	srv2 := NewServer(WithSessionLifetime(100 * time.Millisecond))
+	defer srv2.Close()
+	ts2 := httptest.NewServer(srv2)
+	defer ts2.Close()
+	conn, err := Dial(context.Background(), ts2.URL, sse)
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestStreamingPost(t *testing.T) {
+	srv := NewServer(WithMaxPostSize(8))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	sid := sc.(*ServerConn).Conn.(*sseServerConn).sessionID
+	postURL := ts.URL + "?s=" + sid
+
+	// The body reaches the reader before the POST has finished.
+	pr, pw := io.Pipe()
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(postURL, "application/octet-stream", pr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- resp
+	}()
+	pw.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+	pw.Close()
+	require.Equal(t, http.StatusNoContent, (<-done).StatusCode)
+	go io.Copy(io.Discard, sc)
+
+	// An oversized body with a length is refused up front.
+	resp, err := http.Post(postURL, "application/octet-stream", strings.NewReader("0123456789"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	_, err = conn.Write([]byte("ok"))
+	require.NoError(t, err)
+
+	// One without found out part way through ends the session.
+	resp, err = http.Post(postURL, "application/octet-stream", io.MultiReader(strings.NewReader("01234567"), strings.NewReader("89")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+}
+
+func TestSSEWriteBuffer(t *testing.T) {
+	srv := NewServer(WithSSEWriteBuffer(64, 5*time.Millisecond))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+
+	var want strings.Builder
+	go func() {
+		for i := range 200 {
+			sc.Write([]byte(strconv.Itoa(i) + ","))
+		}
+		// Buffered writes still reach the client ahead of the close.
+		sc.Close()
+	}()
+	for i := range 200 {
+		want.WriteString(strconv.Itoa(i) + ",")
+	}
+	got, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, want.String(), string(got))
+	_, err = sc.Write([]byte("late"))
+	require.Error(t, err)
+}
+
+func TestAcceptFilter(t *testing.T) {
+	var infos []ConnInfo
+	var mu sync.Mutex
+	srv := NewServer(WithAcceptFilter(func(info ConnInfo) bool {
+		mu.Lock()
+		infos = append(infos, info)
+		mu.Unlock()
+		return info.Target != "blocked" && info.Conns < 2
+	}))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		_, err := Dial(context.Background(), ts.URL, force, WithTarget("blocked"))
+		var se *serverError
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, http.StatusForbidden, se.status, transport)
+		conn, err := Dial(context.Background(), ts.URL, force, WithMetadata("k", "v"))
+		require.NoError(t, err, transport)
+		conn.Close()
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		sc.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, infos, 4)
+	require.Equal(t, "sse", infos[3].Transport)
+	require.Equal(t, map[string]string{"k": "v"}, infos[3].Metadata)
+	require.True(t, infos[3].ClientAddr.(*net.TCPAddr).IP.IsLoopback())
+}
+
+func TestServerEvents(t *testing.T) {
+	events := make(chan ServerEvent, 10)
+	srv := NewServer(WithEvents(func(ev ServerEvent) { events <- ev }))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport }, WithTarget("db"))
+		require.NoError(t, err, transport)
+		open := <-events
+		require.Equal(t, EventOpen, open.Type, transport)
+		require.Equal(t, transport, open.Transport)
+		require.Equal(t, "db", open.Target, transport)
+		require.Equal(t, transport == "sse", open.SessionID != "", transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		read := make(chan error)
+		go func() {
+			_, err := io.ReadFull(sc, make([]byte, 4))
+			read <- err
+		}()
+		_, err = conn.Write([]byte("ping"))
+		require.NoError(t, err, transport)
+		require.NoError(t, <-read, transport)
+		_, err = sc.Write([]byte("pong!"))
+		require.NoError(t, err, transport)
+		_, err = io.ReadFull(conn, make([]byte, 5))
+		require.NoError(t, err, transport)
+		sc.Close()
+		closed := <-events
+		require.Equal(t, EventClose, closed.Type, transport)
+		require.EqualValues(t, 4, closed.BytesRead, transport)
+		require.EqualValues(t, 5, closed.BytesWritten, transport)
+		require.Positive(t, closed.Duration, transport)
+		conn.Close()
+	}
+}
+
+func TestServerConns(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var clients []net.Conn
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport }, WithMetadata("t", transport))
+		require.NoError(t, err, transport)
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	require.Eventually(t, func() bool {
+		n := 0
+		for range srv.Conns() {
+			n++
+		}
+		return n == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	byTransport := map[string]*ServerConn{}
+	for conn := range srv.Conns() {
+		require.Equal(t, conn.Transport(), conn.Metadata()["t"])
+		require.NotEmpty(t, conn.ID())
+		byTransport[conn.Transport()] = conn
+	}
+	st, _ := StateOf(byTransport["sse"])
+	require.Equal(t, st.SessionID, byTransport["sse"].ID())
+
+	for i, transport := range []string{"ws", "sse"} {
+		require.True(t, srv.CloseConn(byTransport[transport].ID()), transport)
+		_, err := clients[i].Read(make([]byte, 1))
+		require.Error(t, err, transport)
+	}
+	require.False(t, srv.CloseConn("nope"))
+	require.Eventually(t, func() bool {
+		for range srv.Conns() {
+			return false
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerLogger(t *testing.T) {
+	var mu sync.Mutex
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(writerFunc(func(b []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(b)
+	}), &slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv := NewServer(WithLogger(logger), WithMinClientVersion("v9.0.0"))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"?s=nope", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set(versionHeader, "v1.0.0")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	sc.Close()
+	conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	out := buf.String()
+	require.Contains(t, out, `msg="request rejected"`)
+	require.Contains(t, out, "status=404")
+	require.Contains(t, out, `reason="client version"`)
+	require.Contains(t, out, `msg="conn opened"`)
+	require.Contains(t, out, `msg="conn closed"`)
+
+	// A nil logger logs nothing.
+	quiet := NewServer(WithLogger(nil))
+	defer quiet.Close()
+	qts := httptest.NewServer(quiet)
+	defer qts.Close()
+	resp, err = http.Post(qts.URL+"?s=nope", "text/plain", strings.NewReader("x"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServerPongTimeout(t *testing.T) {
+	srv := NewServer(WithHeartbeat(20*time.Millisecond), WithPongTimeout(50*time.Millisecond))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	// A raw client that swallows pings without ponging, like a wedged peer.
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetPingHandler(func(string) error { return nil })
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := sc.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		require.ErrorIs(t, err, errPongTimeout)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server conn not closed after pongs stopped")
+	}
+
+	// A live client answers pings, as gorilla/websocket does by default.
+	conn, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	sc, err = srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	go io.Copy(io.Discard, sc)
+	time.Sleep(200 * time.Millisecond)
+	_, err = sc.Write([]byte("alive"))
+	require.NoError(t, err)
+}
+
+func TestReplicaAffinity(t *testing.T) {
+	urls := map[string]*url.URL{}
+	route := func(replica string) *url.URL { return urls[replica] }
+	a := NewServer(WithReplica("a", route))
+	defer a.Close()
+	b := NewServer(WithReplica("b", route))
+	defer b.Close()
+	tsA := httptest.NewServer(a)
+	defer tsA.Close()
+	tsB := httptest.NewServer(b)
+	defer tsB.Close()
+	urls["a"], _ = url.Parse(tsA.URL)
+	urls["b"], _ = url.Parse(tsB.URL)
+	// A load balancer that sends streams to a and every POST to b.
+	toA := httputil.NewSingleHostReverseProxy(urls["a"])
+	toB := httputil.NewSingleHostReverseProxy(urls["b"])
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			toB.ServeHTTP(w, r)
+			return
+		}
+		toA.ServeHTTP(w, r)
+	}))
+	defer lb.Close()
+
+	conn, err := Dial(context.Background(), lb.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := a.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	require.True(t, strings.HasPrefix(sc.(*ServerConn).ID(), "a."))
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	resp, err := http.Post(tsB.URL+"?s=c.123", "application/octet-stream", strings.NewReader("x"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSessionStore(t *testing.T) {
+	// A store shared in-process stands in for one shared across a fleet.
+	store := &memStore{}
+	a := NewServer(WithSessionStore(store))
+	defer a.Close()
+	b := NewServer(WithSessionStore(store))
+	defer b.Close()
+	tsA := httptest.NewServer(a)
+	defer tsA.Close()
+	tsB := httptest.NewServer(b)
+	defer tsB.Close()
+	// A load balancer that sends streams to a and every POST to b.
+	urlA, _ := url.Parse(tsA.URL)
+	urlB, _ := url.Parse(tsB.URL)
+	toA := httputil.NewSingleHostReverseProxy(urlA)
+	toB := httputil.NewSingleHostReverseProxy(urlB)
+	lb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			toB.ServeHTTP(w, r)
+			return
+		}
+		toA.ServeHTTP(w, r)
+	}))
+	defer lb.Close()
+
+	conn, err := Dial(context.Background(), lb.URL, func(d *Dialer) { d.Transport = "sse" })
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := a.Accept()
+	require.NoError(t, err)
+	sid := sc.(*ServerConn).ID()
+	_, ok := store.Load(sid)
+	require.True(t, ok)
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	sc.Close()
+	require.Eventually(t, func() bool {
+		_, ok := store.Load(sid)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSessionKey(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	auth := WithAuth(func(r *http.Request) (any, error) {
+		return r.Header.Get("X-User"), nil
+	})
+	srv := NewServer(auth, WithSessionKey(key, time.Hour))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" }, WithHeader("X-User", "alice"))
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	post := func(sid, user string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"?s="+url.QueryEscape(sid)+"&ping=1", nil)
+		req.Header.Set("X-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	sid := sc.(*ServerConn).ID()
+	require.Equal(t, http.StatusNoContent, post(sid, "alice"))
+	require.Equal(t, http.StatusForbidden, post(sid, "mallory"))
+	require.Equal(t, http.StatusForbidden, post(generateSessionID(), "alice"))
+
+	// Tokens from a server with another key, or expired ones, are refused.
+	other := &sessionSigner{key: []byte("fedcba9876543210")}
+	require.Equal(t, http.StatusForbidden, post(other.sign("", "alice"), "alice"))
+	expired := &sessionSigner{key: key, ttl: time.Nanosecond}
+	require.False(t, expired.verify(expired.sign("", "alice"), "alice"))
+	replica := &sessionSigner{key: key}
+	tok := replica.sign("a.", "alice")
+	require.True(t, strings.HasPrefix(tok, "a."))
+	require.True(t, replica.verify(tok, "alice"))
+	require.False(t, replica.verify("b."+strings.TrimPrefix(tok, "a."), "alice"))
+}
+
+func TestSessionBinding(t *testing.T) {
+	srv := NewServer(WithSessionBinding(BindAuthorization))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" }, WithHeader("Authorization", "Bearer alice"))
+	require.NoError(t, err)
+	defer conn.Close()
+	sc, err := srv.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	go conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(sc, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	post := func(auth string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"?s="+sc.(*ServerConn).ID(), strings.NewReader("x"))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusForbidden, post("Bearer mallory"))
+	require.Equal(t, http.StatusForbidden, post(""))
+	require.Empty(t, BindAuthorization(&http.Request{Header: http.Header{}}, nil))
+	require.Equal(t, "alice", BindIdentity(nil, "alice"))
+}
+
+func TestConnRateLimit(t *testing.T) {
+	for _, transport := range []string{"ws", "sse"} {
+		srv := NewServer(WithConnRateLimit(50_000, 0))
+		ts := httptest.NewServer(srv)
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		go io.Copy(io.Discard, conn)
+		start := time.Now()
+		// The first second's worth is a free burst, the rest is throttled.
+		n, err := sc.Write(make([]byte, 75_000))
+		require.NoError(t, err, transport)
+		require.Equal(t, 75_000, n, transport)
+		elapsed := time.Since(start)
+		require.Greater(t, elapsed, 400*time.Millisecond, transport)
+		require.Less(t, elapsed, 2*time.Second, transport)
+		conn.Close()
+		ts.Close()
+		srv.Close()
+	}
+
+	// The total is shared by every conn.
+	srv := NewServer(WithTotalRateLimit(50_000, 0))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range 2 {
+		conn, err := Dial(context.Background(), ts.URL)
+		require.NoError(t, err)
+		defer conn.Close()
+		sc, err := srv.Accept()
+		require.NoError(t, err)
+		go io.Copy(io.Discard, conn)
+		wg.Go(func() {
+			_, err := sc.Write(make([]byte, 40_000))
+			require.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	require.Greater(t, time.Since(start), 400*time.Millisecond)
+}
+
+// echoBackend is a TCP server echoing every conn, returning its address.
+func echoBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestForward(t *testing.T) {
+	backend := echoBackend(t)
+	for _, address := range []string{backend, ""} {
+		srv := NewServer(WithForward("tcp", address))
+		ts := httptest.NewServer(srv)
+		for _, transport := range []string{"ws", "sse"} {
+			conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport }, WithTarget(backend))
+			require.NoError(t, err, transport)
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err, transport)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err, transport)
+			require.Equal(t, "hello", string(buf), transport)
+			conn.Close()
+		}
+		ts.Close()
+		srv.Close()
+	}
+
+	// Without a target the handshake is refused.
+	srv := NewServer(WithForward("tcp", ""))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var se *serverError
+	_, err := Dial(context.Background(), ts.URL)
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusForbidden, se.status)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				src, dst, err := ReadProxyHeader(c)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "%s %s\n", src, dst)
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	srv := NewServer(WithForward("tcp", l.Addr().String()), WithProxyProtocol())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err, transport)
+		src, dst, _ := strings.Cut(strings.TrimSpace(line), " ")
+		require.True(t, strings.HasPrefix(src, "127.0.0.1:"), src)
+		require.Equal(t, ts.Listener.Addr().String(), dst, transport)
+		conn.Close()
+	}
+
+	// Without WithForward, conns are accepted as usual.
+	plain := NewServer(WithProxyProtocol())
+	defer plain.Close()
+	pts := httptest.NewServer(plain)
+	defer pts.Close()
+	go plain.Accept()
+	conn, err := Dial(context.Background(), pts.URL)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Round trips, including a LOCAL header.
+	h := proxyHeader(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443})
+	src, dst, err := ReadProxyHeader(bytes.NewReader(h))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:1234", src.String())
+	require.Equal(t, "10.0.0.1:443", dst.String())
+	src, dst, err = ReadProxyHeader(bytes.NewReader(proxyHeader(nil, nil)))
+	require.NoError(t, err)
+	require.Nil(t, src)
+	require.Nil(t, dst)
+	_, _, err = ReadProxyHeader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.Error(t, err)
+}
+
+func TestForwardPolicy(t *testing.T) {
+	backend := echoBackend(t)
+	_, port, _ := net.SplitHostPort(backend)
+	var audited atomic.Int32
+	srv := NewServer(WithForward("tcp", ""), WithAuth(func(r *http.Request) (any, error) {
+		return r.Header.Get("X-User"), nil
+	}), WithForwardPolicy(ForwardPolicy{
+		Allow: []string{"127.0.0.*:" + port, "localhost:*"},
+		Check: func(info ConnInfo, target string) error {
+			if info.Identity != "admin" && strings.HasPrefix(target, "localhost:") {
+				return errors.New("admins only")
+			}
+			return nil
+		},
+		Egress: &EgressPolicy{Audit: func(EgressEvent) { audited.Add(1) }},
+	}))
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	dial := func(target, user string) error {
+		conn, err := Dial(context.Background(), ts.URL, WithTarget(target), WithHeader("X-User", user))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("hi"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		return err
+	}
+	require.NoError(t, dial(backend, "bob"))
+	require.NotZero(t, audited.Load())
+	var se *serverError
+	require.ErrorAs(t, dial("10.0.0.1:"+port, "bob"), &se)
+	require.Equal(t, http.StatusForbidden, se.status)
+	require.ErrorAs(t, dial("localhost:"+port, "bob"), &se)
+	require.Equal(t, http.StatusForbidden, se.status)
+	require.NoError(t, dial("localhost:"+port, "admin"))
+}
+
+func TestReverseDial(t *testing.T) {
+	srv := NewServer(WithReverse())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		ctrl, err := Dial(context.Background(), ts.URL, force, WithHeader(listenHeader, "laptop"))
+		require.NoError(t, err, transport)
+		go func() {
+			// Answer each of the server's dials with an echoing conn.
+			sc := bufio.NewScanner(ctrl)
+			for sc.Scan() {
+				conn, err := Dial(context.Background(), ts.URL, force, WithHeader(reverseHeader, sc.Text()))
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		require.Eventually(t, func() bool { return slices.Contains(srv.Listeners(), "laptop") }, time.Second, 10*time.Millisecond, transport)
+
+		_, err = Dial(context.Background(), ts.URL, force, WithHeader(listenHeader, "laptop"))
+		var se *serverError
+		require.ErrorAs(t, err, &se, transport)
+		require.Equal(t, http.StatusConflict, se.status, transport)
+
+		for range 2 {
+			conn, err := srv.DialClient(context.Background(), "laptop")
+			require.NoError(t, err, transport)
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err, transport)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			require.NoError(t, err, transport)
+			require.Equal(t, "hello", string(buf), transport)
+			conn.Close()
+		}
+
+		ctrl.Close()
+		require.Eventually(t, func() bool { return len(srv.Listeners()) == 0 }, 2*time.Second, 10*time.Millisecond, transport)
+		_, err = srv.DialClient(context.Background(), "laptop")
+		require.ErrorIs(t, err, ErrNoListener, transport)
+	}
+
+	// Unknown tokens are refused, and nothing reaches Accept.
+	_, err := Dial(context.Background(), ts.URL, WithHeader(reverseHeader, "nope"))
+	var se *serverError
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusNotFound, se.status)
+	_, ok := srv.TryAccept()
+	require.False(t, ok)
+}
+
+func TestListen(t *testing.T) {
+	srv := NewServer(WithReverse())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		l, err := Listen(context.Background(), ts.URL, WithListenName("laptop"), func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello from "+r.URL.Path)
+		}))
+		require.Eventually(t, func() bool { return slices.Contains(srv.Listeners(), "laptop") }, time.Second, 10*time.Millisecond, transport)
+
+		// The server reaches the client's HTTP server through the listener.
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return srv.DialClient(ctx, "laptop")
+			},
+		}}
+		resp, err := client.Get("http://laptop/x")
+		require.NoError(t, err, transport)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, "hello from /x", string(body), transport)
+		client.CloseIdleConnections()
+
+		l.Close()
+		_, err = l.Accept()
+		require.ErrorIs(t, err, net.ErrClosed, transport)
+		require.Eventually(t, func() bool { return len(srv.Listeners()) == 0 }, 2*time.Second, 10*time.Millisecond, transport)
+	}
+	_, err := Listen(context.Background(), ts.URL)
+	require.ErrorContains(t, err, "WithListenName")
+}
+
+func TestMux(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport })
+		require.NoError(t, err, transport)
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		client, server := NewClientMux(conn), NewServerMux(sc)
+		go func() {
+			for {
+				s, err := server.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer s.Close()
+					io.Copy(s, s)
+				}()
+			}
+		}()
+
+		// A stream nobody reads fills its window without holding up others.
+		stalled, err := client.Open()
+		require.NoError(t, err, transport)
+		stalled.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = stalled.Write(make([]byte, 4*streamWindow))
+		require.True(t, isTimeout(err), "%s: %v", transport, err)
+
+		var wg sync.WaitGroup
+		for i := range 4 {
+			s, err := client.Open()
+			require.NoError(t, err, transport)
+			want := bytes.Repeat([]byte{byte(i)}, 300_000)
+			wg.Go(func() {
+				defer s.Close()
+				go s.Write(want)
+				got := make([]byte, len(want))
+				_, err := io.ReadFull(s, got)
+				require.NoError(t, err, transport)
+				require.Equal(t, want, got, transport)
+			})
+		}
+		wg.Wait()
+
+		// The client end accepts streams the server end opens.
+		go func() {
+			s, err := client.AcceptStream()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			io.WriteString(s, "from client")
+		}()
+		fromServer, err := server.Open()
+		require.NoError(t, err, transport)
+		require.Zero(t, fromServer.ID()%2, transport)
+		got, err := io.ReadAll(fromServer)
+		require.NoError(t, err, transport)
+		require.Equal(t, "from client", string(got), transport)
+		fromServer.Close()
+
+		s, err := client.Open()
+		require.NoError(t, err, transport)
+		client.Close()
+		_, err = s.Read(make([]byte, 1))
+		require.ErrorIs(t, err, net.ErrClosed, transport)
+		<-server.Done()
+	}
+}
+
+func TestMuxNamedStreams(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewClientMux(a), NewServerMux(b)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				io.WriteString(s, strings.ToUpper(s.Name()))
+			}()
+		}
+	}()
+	for _, name := range []string{"logs", "shell", ""} {
+		s, err := client.OpenNamed(name)
+		require.NoError(t, err)
+		require.Equal(t, name, s.Name())
+		got, err := io.ReadAll(s)
+		require.NoError(t, err)
+		require.Equal(t, strings.ToUpper(name), string(got))
+		s.Close()
+	}
+	_, err := client.OpenNamed(strings.Repeat("x", maxStreamName+1))
+	require.Error(t, err)
+}
+
+func TestRendezvous(t *testing.T) {
+	srv := NewServer(WithRendezvous())
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		a, err := Dial(context.Background(), ts.URL, force, WithRoom("secret-"+transport))
+		require.NoError(t, err, transport)
+		// Written before the peer arrives, and kept for it.
+		go a.Write([]byte("early"))
+		time.Sleep(50 * time.Millisecond)
+		b, err := Dial(context.Background(), ts.URL, force, WithRoom("secret-"+transport))
+		require.NoError(t, err, transport)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(b, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "early", string(buf), transport)
+		go b.Write([]byte("reply"))
+		_, err = io.ReadFull(a, buf)
+		require.NoError(t, err, transport)
+		require.Equal(t, "reply", string(buf), transport)
+
+		a.Close()
+		b.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = b.Read(buf)
+		require.Error(t, err, transport)
+		require.False(t, isTimeout(err), transport)
+		b.Close()
+	}
+	_, ok := srv.TryAccept()
+	require.False(t, ok)
+
+	plain := NewServer()
+	defer plain.Close()
+	ts2 := httptest.NewServer(plain)
+	defer ts2.Close()
+	var se *serverError
+	_, err := Dial(context.Background(), ts2.URL, WithRoom("x"))
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusForbidden, se.status)
+}
+
+func TestBroadcast(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var clients []net.Conn
+	for _, transport := range []string{"ws", "sse", "ws"} {
+		conn, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = transport }, WithMetadata("transport", transport))
+		require.NoError(t, err, transport)
+		defer conn.Close()
+		sc, err := srv.Accept()
+		require.NoError(t, err, transport)
+		defer sc.Close()
+		clients = append(clients, conn)
+	}
+	// Not yet accepted, so not broadcast to.
+	queued, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer queued.Close()
+
+	require.Equal(t, 3, srv.Broadcast([]byte("all")))
+	for _, conn := range clients {
+		buf := make([]byte, 3)
+		_, err := io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "all", string(buf))
+	}
+	n := srv.BroadcastFunc([]byte("sse"), func(c *ServerConn) bool { return c.Metadata()["transport"] == "sse" })
+	require.Equal(t, 1, n)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(clients[1], buf)
+	require.NoError(t, err)
+	require.Equal(t, "sse", string(buf))
+}
+
+func TestAcceptMatch(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	// The dashboard dials first, but only the agent acceptor is waiting.
+	dash, err := Dial(context.Background(), ts.URL, WithTags("dashboard"))
+	require.NoError(t, err)
+	defer dash.Close()
+	agent, err := Dial(context.Background(), ts.URL, func(d *Dialer) { d.Transport = "sse" }, WithTags("agent", "linux"))
+	require.NoError(t, err)
+	defer agent.Close()
+
+	c, err := srv.AcceptMatch(context.Background(), MatchTag("agent"))
+	require.NoError(t, err)
+	defer c.Close()
+	sc := c.(*ServerConn)
+	require.Equal(t, []string{"agent", "linux"}, sc.Tags())
+	require.True(t, sc.HasTag("linux"))
+
+	// The dashboard was held for someone else.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = srv.AcceptMatch(ctx, MatchTag("agent"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	c, err = srv.AcceptMatch(context.Background(), MatchTag("dashboard"))
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.(*ServerConn).HasTag("dashboard"))
+
+	// Plain Accept takes held conns too.
+	other, err := Dial(context.Background(), ts.URL)
+	require.NoError(t, err)
+	defer other.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = srv.AcceptMatch(ctx, MatchTag("agent"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	c, ok := srv.TryAccept()
+	require.True(t, ok)
+	defer c.Close()
+	require.Empty(t, c.(*ServerConn).Tags())
+}
+
+func TestRouter(t *testing.T) {
+	acme := NewServer(WithAuth(func(r *http.Request) (any, error) {
+		if r.Header.Get("Authorization") != "Bearer acme" {
+			return nil, ErrUnauthorized
+		}
+		return "acme", nil
+	}))
+	globex := NewServer()
+	rt := NewRouter(RouteByPath(0))
+	rt.Handle("acme", acme)
+	rt.Handle("globex", globex)
+	defer rt.Close()
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+
+	for _, transport := range []string{"ws", "sse"} {
+		force := func(d *Dialer) { d.Transport = transport }
+		conn, err := Dial(context.Background(), ts.URL+"/acme/wd", force, WithHeader("Authorization", "Bearer acme"))
+		require.NoError(t, err, transport)
+		sc, err := acme.Accept()
+		require.NoError(t, err, transport)
+		go conn.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(sc, buf)
+		require.NoError(t, err, transport)
+		conn.Close()
+		sc.Close()
+
+		// Each tenant keeps its own auth.
+		_, err = Dial(context.Background(), ts.URL+"/acme/wd", force)
+		require.Error(t, err, transport)
+		conn, err = Dial(context.Background(), ts.URL+"/globex/wd", force)
+		require.NoError(t, err, transport)
+		sc, err = globex.Accept()
+		require.NoError(t, err, transport)
+		conn.Close()
+		sc.Close()
+	}
+
+	var se *serverError
+	_, err := Dial(context.Background(), ts.URL+"/initech/wd")
+	require.ErrorAs(t, err, &se)
+	require.Equal(t, http.StatusNotFound, se.status)
+	require.Equal(t, "acme", RouteByHeader("X-Tenant")(&http.Request{Header: http.Header{"X-Tenant": {"acme"}}}))
+}
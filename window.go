@@ -0,0 +1,90 @@
+package webdial
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// windowHeader carries the bytes a client is willing to have sent ahead
+// of its reads, see Dialer.ReadWindow. The server answers with its own
+// window, see WithFlowControl, to say it will honour the client's.
+// Credit is granted with SSE POSTs and WebSocket pings.
+const windowHeader = "X-Webdial-Window"
+
+// sendWindow is the credit a peer has granted for sending to it. Writers
+// take credit before sending and wait when there is none.
+type sendWindow struct {
+	mu      sync.Mutex
+	credit  int64
+	granted chan struct{} // closed and replaced when credit arrives
+}
+
+func newSendWindow(credit int64) *sendWindow {
+	return &sendWindow{credit: credit, granted: make(chan struct{})}
+}
+
+// take waits for credit, then takes up to n bytes of it. It returns
+// net.ErrClosed once closed is, and os.ErrDeadlineExceeded once deadline
+// is.
+func (w *sendWindow) take(n int, closed, deadline <-chan struct{}) (int, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			n = int(min(int64(n), w.credit))
+			w.credit -= int64(n)
+			w.mu.Unlock()
+			return n, nil
+		}
+		granted := w.granted
+		w.mu.Unlock()
+		select {
+		case <-granted:
+		case <-closed:
+			return 0, net.ErrClosed
+		case <-deadline:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// grant adds n bytes of credit.
+func (w *sendWindow) grant(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.credit += n
+	close(w.granted)
+	w.granted = make(chan struct{})
+}
+
+// recvWindow counts what the reader has consumed, and reports when enough
+// has been to grant the sender more credit.
+type recvWindow struct {
+	mu     sync.Mutex
+	size   int64
+	unsent int64 // consumed but not yet granted
+}
+
+// consumed records n bytes read, returning the credit to grant, if any.
+// Credit is granted once half the window has been read, so the sender
+// rarely waits and grants are few.
+func (w *recvWindow) consumed(n int) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.unsent += int64(n)
+	if w.unsent < w.size/2 {
+		return 0
+	}
+	grant := w.unsent
+	w.unsent = 0
+	return grant
+}
+
+func parseWindow(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil && n > 0
+}